@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/xitongsys/ptcp/ptcp"
+)
+
+//Throughput and CPU time of the link types. Run a server and a client on two hosts,
+//once with each link type, e.g.
+//
+//	bench -iface eth0 -server -addr 10.0.0.1:12222 -ring
+//	bench -iface eth0 -addr 10.0.0.1:12222 -ring
+//
+//The client reports the bytes delivered to the server, which sends back its count.
+func main() {
+	iface := flag.String("iface", "eth0", "interface of the stack")
+	server := flag.Bool("server", false, "receive instead of send")
+	addr := flag.String("addr", "127.0.0.1:12222", "address of the server")
+	ring := flag.Bool("ring", false, "use the TPACKET_V3 rings instead of recvmmsg/sendmmsg")
+	l3 := flag.Bool("l3", false, "use the raw IP sockets instead of AF_PACKET")
+	size := flag.Int("size", 0, "payload size, the max payload of the conn if 0")
+	duration := flag.Duration("t", 10*time.Second, "duration of the client")
+	flag.Parse()
+
+	cfg := &ptcp.Config{Interface: *iface}
+	if *ring {
+		cfg.LinkType = ptcp.LINKRING
+	} else if *l3 {
+		cfg.LinkType = ptcp.LINKL3
+	}
+	stack, err := ptcp.NewStack(cfg)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer stack.Close()
+
+	var bytes uint64
+	go report(&bytes)
+	if *server {
+		serve(stack, *addr, &bytes)
+	} else {
+		send(stack, *addr, *size, *duration, &bytes)
+	}
+}
+
+func serve(stack *ptcp.Stack, addr string, bytes *uint64) {
+	ln, err := stack.Listen("ptcp", addr)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			var received uint64
+			done := make(chan struct{})
+			defer close(done)
+			//Count of the bytes received on the conn, sent back every 100ms
+			go func() {
+				msg := make([]byte, 8)
+				for {
+					select {
+					case <-done:
+						return
+					case <-time.After(100 * time.Millisecond):
+					}
+					binary.BigEndian.PutUint64(msg, atomic.LoadUint64(&received))
+					conn.Write(msg)
+				}
+			}()
+			buf := make([]byte, 65535)
+			for {
+				n, err := conn.Read(buf)
+				if err != nil {
+					return
+				}
+				atomic.AddUint64(&received, uint64(n))
+				atomic.AddUint64(bytes, uint64(n))
+			}
+		}(conn)
+	}
+}
+
+func send(stack *ptcp.Stack, addr string, size int, duration time.Duration, bytes *uint64) {
+	c, err := stack.Dial("ptcp", addr)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	conn := c.(*ptcp.Conn)
+	defer conn.Close()
+	if size <= 0 || size > conn.MaxPayload() {
+		size = conn.MaxPayload()
+	}
+
+	//bytes is the last count received from the server
+	go func() {
+		msg := make([]byte, 8)
+		for {
+			n, err := conn.Read(msg)
+			if err != nil {
+				return
+			}
+			if n == 8 {
+				atomic.StoreUint64(bytes, binary.BigEndian.Uint64(msg))
+			}
+		}
+	}()
+
+	buf := make([]byte, size)
+	sent := uint64(0)
+	end := time.Now().Add(duration)
+	for time.Now().Before(end) {
+		if _, err := conn.Write(buf); err != nil {
+			fmt.Println(err)
+			return
+		}
+		sent += uint64(size)
+	}
+	//Wait for the final count
+	time.Sleep(500 * time.Millisecond)
+	delivered := atomic.LoadUint64(bytes)
+	fmt.Printf("sent %d bytes, delivered %d bytes (%.2f%% lost)\n", sent, delivered, 100*float64(sent-delivered)/float64(sent))
+}
+
+//Print the payload rate and the CPU time per GB every second
+func report(bytes *uint64) {
+	last, lastCpu := uint64(0), cpuTime()
+	for range time.Tick(time.Second) {
+		cur, cpu := atomic.LoadUint64(bytes), cpuTime()
+		n := cur - last
+		perGB := time.Duration(0)
+		if n > 0 {
+			perGB = time.Duration(float64(cpu-lastCpu) * float64(1<<30) / float64(n))
+		}
+		fmt.Printf("%.1f Mbit/s, cpu %v/s, %v/GB\n", float64(n)*8/1e6, cpu-lastCpu, perGB)
+		last, lastCpu = cur, cpu
+	}
+}
+
+func cpuTime() time.Duration {
+	var ru syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &ru)
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
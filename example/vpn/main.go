@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/xitongsys/ptcp/ptcp"
+	"github.com/xitongsys/ptcp/tun"
+)
+
+//VPN over ptcp. It can be tried on one host with a network namespace and a veth pair, e.g.
+//
+//	ip netns add vpn
+//	ip link add veth0 type veth peer name veth1
+//	ip link set veth1 netns vpn
+//	ip addr add 10.99.0.1/24 dev veth0 && ip link set veth0 up
+//	ip netns exec vpn ip addr add 10.99.0.2/24 dev veth1
+//	ip netns exec vpn ip link set veth1 up
+//	ip netns exec vpn vpn -iface veth1 -server -addr 10.99.0.2:13000 -net 10.8.0.0/24
+//	vpn -iface veth0 -addr 10.99.0.2:13000
+//	ping 10.8.0.1
+func main() {
+	iface := flag.String("iface", "eth0", "interface of the stack")
+	server := flag.Bool("server", false, "run the server")
+	addr := flag.String("addr", "127.0.0.1:13000", "address of the server")
+	network := flag.String("net", "10.8.0.0/24", "network of the tunnel, on the server")
+	dev := flag.String("dev", "", "name of the tun device")
+	l3 := flag.Bool("l3", false, "use the raw IP sockets, for the interfaces without Ethernet framing")
+	reliable := flag.Bool("reliable", false, "retransmit the lost packets")
+	flag.Parse()
+
+	cfg := &ptcp.Config{
+		Interface: *iface,
+		Conn:      ptcp.ConnConfig{Reliable: *reliable},
+	}
+	if *l3 {
+		cfg.LinkType = ptcp.LINKL3
+	}
+	stack, err := ptcp.NewStack(cfg)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer stack.Close()
+
+	if *server {
+		s, err := tun.NewServer(stack, &tun.ServerConfig{Addr: *addr, Network: *network, Device: *dev})
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println("serving on", s.Device().Name())
+		if err := s.Serve(); err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+
+	c, err := tun.NewClient(stack, &tun.ClientConfig{Server: *addr, Device: *dev})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("address", c.Addr(), "on", c.Device().Name())
+	if err := c.Run(); err != nil {
+		fmt.Println(err)
+	}
+}
@@ -0,0 +1,61 @@
+package mux
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const VERSION = 1
+
+//version (1) + command (1) + stream id (4)
+const HEADERLEN = 6
+
+//Frame commands
+const (
+	//Opens a stream. Payload: receive window of the opener (uint32)
+	CMDSYN = iota + 1
+	//Data of a stream
+	CMDPSH
+	//Closes the sending side of a stream
+	CMDFIN
+	//Reliable sessions only. Payload: bytes read since the stream was opened (uint32) + receive window (uint32)
+	CMDUPD
+)
+
+//One frame is sent in one packet of the conn
+type frame struct {
+	cmd  byte
+	id   uint32
+	data []byte
+}
+
+func (f *frame) marshal() []byte {
+	b := make([]byte, HEADERLEN+len(f.data))
+	b[0], b[1] = VERSION, f.cmd
+	binary.BigEndian.PutUint32(b[2:], f.id)
+	copy(b[HEADERLEN:], f.data)
+	return b
+}
+
+//The payload is copied, b is the read buffer of the session
+func parseFrame(b []byte) (*frame, error) {
+	if len(b) < HEADERLEN {
+		return nil, fmt.Errorf("frame too short: %v", len(b))
+	}
+	if b[0] != VERSION {
+		return nil, fmt.Errorf("unknown frame version %v", b[0])
+	}
+	return &frame{
+		cmd:  b[1],
+		id:   binary.BigEndian.Uint32(b[2:]),
+		data: append([]byte{}, b[HEADERLEN:]...),
+	}, nil
+}
+
+func u32bytes(vs ...uint32) []byte {
+	b := make([]byte, 4*len(vs))
+	for i, v := range vs {
+		binary.BigEndian.PutUint32(b[4*i:], v)
+	}
+	return b
+}
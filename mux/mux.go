@@ -0,0 +1,257 @@
+package mux
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+//Default max bytes of a stream buffered by its receiver
+var STREAMWINDOW = 256 * 1024
+
+//Default max payload of a frame. A frame is sent in one packet, it's lowered to the MaxPayload of a ptcp Conn
+var MAXFRAMESIZE = 1300
+
+//Default max opened streams waiting for AcceptStream
+var ACCEPTBACKLOG = 256
+
+//Size of the read buffer, larger than any frame
+var READBUFSIZE = 65535
+
+type Config struct {
+	//Datagram streams for the conns without the ptcp reliable mode: each Write sends one frame,
+	//which may be lost or reordered, and each Read returns one frame. A stream whose receiver buffers
+	//StreamWindow bytes drops the new frames. Both sides must have the same mode.
+	Datagram bool
+	//Max bytes of a stream buffered by its receiver. In reliable mode it's the send window of the peer. STREAMWINDOW if 0
+	StreamWindow int
+	//Max payload of a frame, MAXFRAMESIZE if 0. Longer writes are split in reliable mode and refused in datagram mode
+	MaxFrameSize int
+	//Max opened streams waiting for AcceptStream, the others are closed. ACCEPTBACKLOG if 0
+	AcceptBacklog int
+}
+
+//Fill the defaults
+func (cfg Config) normalize() Config {
+	if cfg.StreamWindow <= 0 {
+		cfg.StreamWindow = STREAMWINDOW
+	}
+	if cfg.MaxFrameSize <= 0 {
+		cfg.MaxFrameSize = MAXFRAMESIZE
+	}
+	if cfg.AcceptBacklog <= 0 {
+		cfg.AcceptBacklog = ACCEPTBACKLOG
+	}
+	return cfg
+}
+
+//Session multiplexes streams over one conn, which must keep the message boundaries like a ptcp Conn
+//without Stream mode. The streams share the handshake and the keepalives of the conn.
+//The client opens the odd stream ids and the server the even ones.
+type Session struct {
+	conn net.Conn
+	cfg  Config
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	//Highest stream id opened by the peer, the frames of older unknown streams are dropped
+	peerID uint32
+
+	acceptChan chan *Stream
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+//cfg may be nil for the defaults. A reliable session is refused over a conn which reports
+//it's unreliable, like a ptcp Conn without the reliable mode. The Stream mode of a ptcp Conn is disabled.
+func NewSession(conn net.Conn, client bool, cfg *Config) (*Session, error) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	if c, ok := conn.(interface{ Reliable() bool }); ok && !cfg.Datagram && !c.Reliable() {
+		return nil, fmt.Errorf("reliable session over an unreliable conn, Datagram is required")
+	}
+	//A frame is read in one Read
+	if c, ok := conn.(interface{ SetStream(bool) }); ok {
+		c.SetStream(false)
+	}
+
+	s := &Session{
+		conn:    conn,
+		cfg:     cfg.normalize(),
+		streams: map[uint32]*Stream{},
+		nextID:  2,
+		done:    make(chan struct{}),
+	}
+	if client {
+		s.nextID = 1
+	}
+	s.acceptChan = make(chan *Stream, s.cfg.AcceptBacklog)
+	go s.recvLoop()
+	return s, nil
+}
+
+func (s *Session) OpenStream() (*Stream, error) {
+	if s.IsClosed() {
+		return nil, io.EOF
+	}
+
+	s.mu.Lock()
+	id := s.nextID
+	if id+2 < id {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("stream ids exhausted")
+	}
+	s.nextID += 2
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(CMDSYN, id, u32bytes(uint32(s.cfg.StreamWindow))); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+//Block until the peer opens a stream or the session is closed
+func (s *Session) AcceptStream() (*Stream, error) {
+	select {
+	case st := <-s.acceptChan:
+		return st, nil
+	case <-s.done:
+		return nil, io.EOF
+	}
+}
+
+//Accept makes the session a net.Listener of its streams
+func (s *Session) Accept() (net.Conn, error) {
+	return s.AcceptStream()
+}
+
+func (s *Session) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+//Close the streams and the conn
+func (s *Session) Close() error {
+	err := fmt.Errorf("session already closed")
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.mu.Lock()
+		for _, st := range s.streams {
+			st.notify()
+		}
+		s.streams = map[uint32]*Stream{}
+		s.mu.Unlock()
+		err = s.conn.Close()
+	})
+	return err
+}
+
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+//MaxFrameSize, or less if the conn has a lower max payload like a ptcp Conn whose path MTU dropped
+func (s *Session) maxFrameSize() int {
+	n := s.cfg.MaxFrameSize
+	if c, ok := s.conn.(interface{ MaxPayload() int }); ok {
+		if m := c.MaxPayload() - HEADERLEN; m > 0 && m < n {
+			n = m
+		}
+	}
+	return n
+}
+
+func (s *Session) writeFrame(cmd byte, id uint32, data []byte) error {
+	f := &frame{cmd: cmd, id: id, data: data}
+	_, err := s.conn.Write(f.marshal())
+	return err
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.streams, id)
+}
+
+//The session is closed when the conn fails
+func (s *Session) recvLoop() {
+	defer s.Close()
+	buf := make([]byte, READBUFSIZE)
+	for {
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		f, err := parseFrame(buf[:n])
+		if err != nil {
+			continue
+		}
+		s.handleFrame(f)
+	}
+}
+
+func (s *Session) handleFrame(f *frame) {
+	s.mu.Lock()
+	st, ok := s.streams[f.id]
+	//A lost SYN of a datagram session is implied by the data
+	if !ok && (f.cmd == CMDSYN || (f.cmd == CMDPSH && s.cfg.Datagram)) {
+		st = s.peerStream(f.id)
+	}
+	s.mu.Unlock()
+	if st == nil {
+		return
+	}
+
+	switch f.cmd {
+	case CMDSYN:
+		if len(f.data) >= 4 {
+			st.updateWindow(0, binary.BigEndian.Uint32(f.data))
+		}
+	case CMDPSH:
+		st.push(f.data)
+	case CMDFIN:
+		st.remoteClose()
+	case CMDUPD:
+		if len(f.data) >= 8 {
+			st.updateWindow(binary.BigEndian.Uint32(f.data), binary.BigEndian.Uint32(f.data[4:]))
+		}
+	}
+}
+
+//Stream opened by the peer, nil if the id isn't a new one of the peer. s.mu is held.
+func (s *Session) peerStream(id uint32) *Stream {
+	if id%2 == s.nextID%2 || id <= s.peerID {
+		return nil
+	}
+	s.peerID = id
+	st := newStream(s, id)
+
+	select {
+	case s.acceptChan <- st:
+	default:
+		go s.writeFrame(CMDFIN, id, nil)
+		return nil
+	}
+	s.streams[id] = st
+	if !s.cfg.Datagram {
+		go s.writeFrame(CMDUPD, id, u32bytes(0, uint32(s.cfg.StreamWindow)))
+	}
+	return st
+}
@@ -0,0 +1,257 @@
+package mux
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xitongsys/ptcp/ptcp"
+)
+
+//A net.Conn reporting its reliability like a ptcp Conn
+type modeConn struct {
+	net.Conn
+	reliable bool
+	stream   bool
+}
+
+func (c *modeConn) Reliable() bool {
+	return c.reliable
+}
+
+func (c *modeConn) SetStream(stream bool) {
+	c.stream = stream
+}
+
+//Client and server sessions over a net.Pipe, which keeps the message boundaries
+func newPipeSessions(t testing.TB, cfg *Config) (*Session, *Session) {
+	a, b := net.Pipe()
+	cs, err := NewSession(a, true, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := NewSession(b, false, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cs.Close()
+		ss.Close()
+	})
+	return cs, ss
+}
+
+func TestFrame(t *testing.T) {
+	f := &frame{cmd: CMDUPD, id: 7, data: u32bytes(1, 2)}
+	p, err := parseFrame(f.marshal())
+	if err != nil || p.cmd != CMDUPD || p.id != 7 || !bytes.Equal(p.data, f.data) {
+		t.Fatal(p, err)
+	}
+	if _, err = parseFrame([]byte{VERSION, CMDPSH, 0}); err == nil {
+		t.Fatal("short frame parsed")
+	}
+	if _, err = parseFrame([]byte{VERSION + 1, CMDPSH, 0, 0, 0, 1}); err == nil {
+		t.Fatal("unknown version parsed")
+	}
+}
+
+func TestNewSessionMode(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if _, err := NewSession(&modeConn{Conn: a}, true, nil); err == nil {
+		t.Fatal("reliable session over an unreliable conn")
+	}
+
+	c := &modeConn{Conn: a, stream: true}
+	s, err := NewSession(c, true, &Config{Datagram: true})
+	if err != nil || c.stream {
+		t.Fatal("stream mode kept", err)
+	}
+	s.Close()
+}
+
+func TestStreams(t *testing.T) {
+	cs, ss := newPipeSessions(t, &Config{StreamWindow: 8000, MaxFrameSize: 500})
+	go func() {
+		for {
+			st, err := ss.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(st, st)
+				st.Close()
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			st, err := cs.OpenStream()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			data := make([]byte, 50000+i)
+			rand.Read(data)
+			go func() {
+				st.Write(data)
+				st.Close()
+			}()
+			st.SetReadDeadline(time.Now().Add(10 * time.Second))
+			got, err := io.ReadAll(st)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Error(i, err, len(got))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	deadline := time.Now().Add(time.Second)
+	for cs.NumStreams() != 0 || ss.NumStreams() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("streams left", cs.NumStreams(), ss.NumStreams())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFlowControl(t *testing.T) {
+	const window = 1000
+	cs, ss := newPipeSessions(t, &Config{StreamWindow: window, MaxFrameSize: 100})
+	st, err := cs.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 10*window)
+	rand.Read(data)
+	written := make(chan error, 1)
+	go func() {
+		_, err := st.Write(data)
+		written <- err
+	}()
+
+	//The writer stops once the window of the reader is full
+	rst, err := ss.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	rst.mu.Lock()
+	buffered := rst.buffered
+	rst.mu.Unlock()
+	if buffered != window {
+		t.Fatal("buffered", buffered)
+	}
+	select {
+	case err := <-written:
+		t.Fatal("write not blocked", err)
+	default:
+	}
+
+	got := make([]byte, len(data))
+	rst.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(rst, got); err != nil || !bytes.Equal(got, data) {
+		t.Fatal(err)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+
+	//A write deadline stops a blocked writer
+	st.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := st.Write(data); n != window || err == nil {
+		t.Fatal(n, err)
+	}
+}
+
+func TestDatagram(t *testing.T) {
+	cs, ss := newPipeSessions(t, &Config{Datagram: true, MaxFrameSize: 1000, StreamWindow: 3000})
+	a, err := cs.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Write(make([]byte, 1001)); err == nil {
+		t.Fatal("datagram longer than the max frame written")
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := a.Write(bytes.Repeat([]byte{byte(i)}, 1000)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	//The frames beyond the window are dropped, one frame per Read
+	ra, err := ss.AcceptStream()
+	if err != nil || ra.ID() != a.ID() {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 10)
+	for i := 0; i < 3; i++ {
+		ra.SetReadDeadline(time.Now().Add(time.Second))
+		if n, err := ra.Read(buf); err != nil || n != 10 || buf[0] != byte(i) {
+			t.Fatal(i, n, err)
+		}
+	}
+	ra.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := ra.Read(buf); err == nil {
+		t.Fatal("frame beyond the window delivered")
+	}
+}
+
+func TestSessionOverPtcp(t *testing.T) {
+	pa, pb := ptcp.NewPipe()
+	cfg := ptcp.ConnConfig{Reliable: true}
+	sa, err := ptcp.NewStack(&ptcp.Config{Link: pa, LocalIP: "10.0.0.1", Conn: cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sa.Close()
+	sb, err := ptcp.NewStack(&ptcp.Config{Link: pb, LocalIP: "10.0.0.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sb.Close()
+	ln, err := sb.Listen("ptcp", "10.0.0.2:7000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if s, err := ln.Accept(); err == nil {
+			defer s.Close()
+			io.Copy(io.Discard, s)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := sa.DialContext(ctx, "ptcp", "10.0.0.2:7000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	//The listener doesn't grant the reliable mode
+	if _, err = NewSession(c, true, nil); err == nil {
+		t.Fatal("reliable session over an unreliable ptcp conn")
+	}
+	s, err := NewSession(c, true, &Config{Datagram: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.OpenStream(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+}
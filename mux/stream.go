@@ -0,0 +1,285 @@
+package mux
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+//Returned when a deadline is exceeded, it implements net.Error
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "i/o timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+//Stream is a logical conn of a session, it implements net.Conn
+type Stream struct {
+	session *Session
+	id      uint32
+
+	mu sync.Mutex
+	//Received payloads not read yet, and their total size
+	frames   [][]byte
+	buffered int
+	//Bytes read since the stream was opened, and the count last announced to the peer
+	consumed  uint32
+	announced uint32
+	//Bytes sent since the stream was opened, read by the peer and its receive window.
+	//Only used in reliable mode.
+	sent         uint32
+	peerConsumed uint32
+	peerWindow   uint32
+
+	localClosed  bool
+	remoteClosed bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	//Signaled when the state changes
+	readEvent  chan struct{}
+	writeEvent chan struct{}
+}
+
+func newStream(s *Session, id uint32) *Stream {
+	return &Stream{
+		session: s,
+		id:      id,
+		//Until the peer announces its window
+		peerWindow: uint32(s.cfg.StreamWindow),
+		readEvent:  make(chan struct{}, 1),
+		writeEvent: make(chan struct{}, 1),
+	}
+}
+
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+//Wake up the blocked Read and Write
+func (st *Stream) notify() {
+	for _, ch := range []chan struct{}{st.readEvent, st.writeEvent} {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+//Block until the event, the deadline or the end of the session
+func (st *Stream) wait(event chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return &timeoutError{}
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-event:
+		return nil
+	case <-timeout:
+		return &timeoutError{}
+	case <-st.session.done:
+		return nil
+	}
+}
+
+//In datagram mode a frame which doesn't fit in the window is dropped
+func (st *Stream) push(data []byte) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.remoteClosed || len(data) == 0 {
+		return
+	}
+	if st.session.cfg.Datagram && st.buffered+len(data) > st.session.cfg.StreamWindow {
+		return
+	}
+	st.frames = append(st.frames, data)
+	st.buffered += len(data)
+	st.notify()
+}
+
+func (st *Stream) updateWindow(consumed uint32, window uint32) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	//The updates of a reliable session are ordered, except the first one sent by the accepting side
+	if int32(consumed-st.peerConsumed) >= 0 {
+		st.peerConsumed = consumed
+	}
+	st.peerWindow = window
+	st.notify()
+}
+
+func (st *Stream) remoteClose() {
+	st.mu.Lock()
+	st.remoteClosed = true
+	closed := st.localClosed
+	st.mu.Unlock()
+
+	st.notify()
+	if closed {
+		st.session.removeStream(st.id)
+	}
+}
+
+//Read is a byte stream in reliable mode. In datagram mode it returns one frame, the bytes that don't fit in b are dropped.
+func (st *Stream) Read(b []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if len(st.frames) > 0 {
+			f := st.frames[0]
+			n := copy(b, f)
+			read := n
+			if st.session.cfg.Datagram || n == len(f) {
+				st.frames, read = st.frames[1:], len(f)
+			} else {
+				st.frames[0] = f[n:]
+			}
+			st.buffered -= read
+			st.consumed += uint32(read)
+
+			//The window is announced again once half of it is read
+			update := !st.session.cfg.Datagram && int(st.consumed-st.announced) >= st.session.cfg.StreamWindow/2
+			if update {
+				st.announced = st.consumed
+			}
+			consumed := st.consumed
+			st.mu.Unlock()
+
+			if update {
+				st.session.writeFrame(CMDUPD, st.id, u32bytes(consumed, uint32(st.session.cfg.StreamWindow)))
+			}
+			return n, nil
+		}
+
+		if st.remoteClosed || st.session.IsClosed() {
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		if err := st.wait(st.readEvent, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+//Write blocks while the peer's window is full in reliable mode.
+//In datagram mode b is sent in one frame, it must not be longer than MaxFrameSize or the max payload of the conn.
+func (st *Stream) Write(b []byte) (int, error) {
+	maxFrame := st.session.maxFrameSize()
+	if st.session.cfg.Datagram {
+		if len(b) > maxFrame {
+			return 0, fmt.Errorf("datagram too long: %v > %v", len(b), maxFrame)
+		}
+		if err := st.checkWrite(); err != nil {
+			return 0, err
+		}
+		if err := st.session.writeFrame(CMDPSH, st.id, b); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	written := 0
+	for len(b) > 0 {
+		if err := st.checkWrite(); err != nil {
+			return written, err
+		}
+
+		st.mu.Lock()
+		room := int(st.peerWindow) - int(st.sent-st.peerConsumed)
+		if room <= 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+			if err := st.wait(st.writeEvent, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+
+		n := len(b)
+		if n > maxFrame {
+			n = maxFrame
+		}
+		if n > room {
+			n = room
+		}
+		st.sent += uint32(n)
+		st.mu.Unlock()
+
+		if err := st.session.writeFrame(CMDPSH, st.id, b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (st *Stream) checkWrite() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.localClosed || st.session.IsClosed() {
+		return io.ErrClosedPipe
+	}
+	if !st.writeDeadline.IsZero() && !time.Now().Before(st.writeDeadline) {
+		return &timeoutError{}
+	}
+	return nil
+}
+
+//Close the sending side, the stream is forgotten once both sides are closed
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.localClosed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	closed := st.remoteClosed
+	st.mu.Unlock()
+
+	st.notify()
+	if closed {
+		st.session.removeStream(st.id)
+	}
+	return st.session.writeFrame(CMDFIN, st.id, nil)
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	return st.session.conn.LocalAddr()
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.session.conn.RemoteAddr()
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	st.notify()
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	st.notify()
+	return nil
+}
@@ -6,6 +6,8 @@ import (
 	"io"
 	"os"
 	"strings"
+	"sync"
+	"syscall"
 )
 
 var ARPPATH = "/proc/net/arp"
@@ -21,16 +23,20 @@ func (ai *ArpItem) String() string {
 }
 
 type Arp struct {
+	mu   sync.RWMutex
 	arps map[uint32]*ArpItem
 }
 
 func NewArp() (*Arp, error) {
 	r := &Arp{}
-	err := r.Load(ARPPATH)
+	err := r.Reload()
 	return r, err
 }
 
 func (r *Arp) String() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
 	res := "{"
 	for _, item := range r.arps {
 		res += item.String()
@@ -52,7 +58,7 @@ func (r *Arp) Load(fname string) error {
 		return err
 	}
 
-	r.arps = map[uint32]*ArpItem{}
+	arps := map[uint32]*ArpItem{}
 
 	for {
 		line, _, err := reader.ReadLine()
@@ -77,17 +83,50 @@ func (r *Arp) Load(fname string) error {
 
 		dev := ss[5]
 
-		r.arps[ip] = &ArpItem{
+		arps[ip] = &ArpItem{
 			Ip:     ip,
 			Device: dev,
 			HwAddr: hw,
 		}
 
 	}
+
+	r.mu.Lock()
+	r.arps = arps
+	r.mu.Unlock()
+	return nil
+}
+
+//Reload the table from netlink, or from ARPPATH if netlink is not available
+func (r *Arp) Reload() error {
+	items, err := dumpNeighs(syscall.AF_INET)
+	if err != nil {
+		return r.Load(ARPPATH)
+	}
+
+	arps := map[uint32]*ArpItem{}
+	for _, item := range items {
+		ip, err := b2ip(item.ip.To4())
+		if err != nil {
+			continue
+		}
+		arps[ip] = &ArpItem{
+			Ip:     ip,
+			Device: item.device,
+			HwAddr: item.hwAddr,
+		}
+	}
+
+	r.mu.Lock()
+	r.arps = arps
+	r.mu.Unlock()
 	return nil
 }
 
 func (r *Arp) GetHwAddr(ip uint32) ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
 	if v, ok := r.arps[ip]; ok {
 		return v.HwAddr, nil
 	}
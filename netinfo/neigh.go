@@ -0,0 +1,85 @@
+package netinfo
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+)
+
+//Neighbour attributes and states of linux/neighbour.h
+const (
+	NDA_DST    = 1
+	NDA_LLADDR = 2
+
+	NUD_INCOMPLETE = 0x01
+	NUD_FAILED     = 0x20
+)
+
+//ndmsg: family(1) pad(3) ifindex(4) state(2) flags(1) type(1)
+const SizeofNdMsg = 12
+
+type NeighItem struct {
+	Ip     net.IP
+	Device string
+	HwAddr []byte
+}
+
+func (ni *NeighItem) String() string {
+	return fmt.Sprintf("{ip:%v, dev:%v, hw:%v}", ni.Ip, ni.Device, net.HardwareAddr(ni.HwAddr))
+}
+
+//Neigh is the ipv6 neighbour table. Linux has no /proc file for it, so it's dumped by netlink.
+type Neigh struct {
+	mu     sync.RWMutex
+	neighs map[string]*NeighItem
+}
+
+func NewNeigh() (*Neigh, error) {
+	r := &Neigh{}
+	err := r.Reload()
+	return r, err
+}
+
+func (r *Neigh) String() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	res := "{"
+	for _, item := range r.neighs {
+		res += item.String()
+	}
+	res += "}"
+	return res
+}
+
+func (r *Neigh) Reload() error {
+	items, err := dumpNeighs(syscall.AF_INET6)
+	if err != nil {
+		return err
+	}
+
+	neighs := map[string]*NeighItem{}
+	for _, item := range items {
+		neighs[item.ip.String()] = &NeighItem{
+			Ip:     item.ip,
+			Device: item.device,
+			HwAddr: item.hwAddr,
+		}
+	}
+
+	r.mu.Lock()
+	r.neighs = neighs
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *Neigh) GetHwAddr(ip net.IP) ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if v, ok := r.neighs[ip.String()]; ok {
+		return v.HwAddr, nil
+	}
+	return nil, fmt.Errorf("hw of ip not found")
+}
@@ -0,0 +1,194 @@
+package netinfo
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+//Route attributes of linux/rtnetlink.h missing in syscall
+const (
+	RTA_MULTIPATH = 9
+	RTA_TABLE     = 15
+)
+
+//Route entry of the main table dumped by netlink
+type nlRoute struct {
+	dst       net.IP
+	prefixLen int
+	//nil if the destination is on-link
+	gateway net.IP
+	metric  uint32
+	device  string
+}
+
+//Neighbour entry dumped by netlink
+type nlNeigh struct {
+	ip     net.IP
+	device string
+	hwAddr []byte
+}
+
+//Unicast routes of the main table of this family
+func dumpRoutes(family int) ([]*nlRoute, error) {
+	tab, err := syscall.NetlinkRIB(syscall.RTM_GETROUTE, family)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs, err := syscall.ParseNetlinkMessage(tab)
+	if err != nil {
+		return nil, err
+	}
+
+	routes := []*nlRoute{}
+	for i := range msgs {
+		m := &msgs[i]
+		if m.Header.Type != syscall.RTM_NEWROUTE || len(m.Data) < syscall.SizeofRtMsg {
+			continue
+		}
+
+		rtm := (*syscall.RtMsg)(unsafe.Pointer(&m.Data[0]))
+		if int(rtm.Family) != family || rtm.Type != syscall.RTN_UNICAST {
+			continue
+		}
+
+		attrs, err := syscall.ParseNetlinkRouteAttr(m)
+		if err != nil {
+			continue
+		}
+
+		table := uint32(rtm.Table)
+		route := &nlRoute{
+			prefixLen: int(rtm.Dst_len),
+		}
+		index := 0
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case syscall.RTA_DST:
+				route.dst = net.IP(attr.Value)
+			case syscall.RTA_GATEWAY:
+				route.gateway = net.IP(attr.Value)
+			case syscall.RTA_OIF:
+				index = int(nativeUint32(attr.Value))
+			case syscall.RTA_PRIORITY:
+				route.metric = nativeUint32(attr.Value)
+			case RTA_TABLE:
+				table = nativeUint32(attr.Value)
+			case RTA_MULTIPATH:
+				//Only the first next hop is used
+				route.gateway, index = firstNexthop(attr.Value)
+			}
+		}
+		if table != syscall.RT_TABLE_MAIN {
+			continue
+		}
+
+		if route.dst == nil {
+			if family == syscall.AF_INET {
+				route.dst = net.IPv4zero.To4()
+			} else {
+				route.dst = net.IPv6zero
+			}
+		}
+		route.device = deviceName(index)
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+//rtnexthop: len(2) flags(1) hops(1) ifindex(4), followed by its attributes
+func firstNexthop(b []byte) (net.IP, int) {
+	if len(b) < 8 {
+		return nil, 0
+	}
+	l := int(*(*uint16)(unsafe.Pointer(&b[0])))
+	if l < 8 || l > len(b) {
+		return nil, 0
+	}
+	index := int(nativeUint32(b[4:8]))
+	for _, attr := range parseRouteAttrs(b[8:l]) {
+		if attr.Attr.Type == syscall.RTA_GATEWAY {
+			return net.IP(attr.Value), index
+		}
+	}
+	return nil, index
+}
+
+//Resolved neighbours of this family
+func dumpNeighs(family int) ([]*nlNeigh, error) {
+	tab, err := syscall.NetlinkRIB(syscall.RTM_GETNEIGH, family)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs, err := syscall.ParseNetlinkMessage(tab)
+	if err != nil {
+		return nil, err
+	}
+
+	neighs := []*nlNeigh{}
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWNEIGH || len(m.Data) < SizeofNdMsg {
+			continue
+		}
+
+		index := int(nativeUint32(m.Data[4:8]))
+		state := *(*uint16)(unsafe.Pointer(&m.Data[8]))
+		if int(m.Data[0]) != family || state&(NUD_INCOMPLETE|NUD_FAILED) != 0 {
+			continue
+		}
+
+		neigh := &nlNeigh{}
+		for _, attr := range parseRouteAttrs(m.Data[SizeofNdMsg:]) {
+			switch attr.Attr.Type {
+			case NDA_DST:
+				neigh.ip = net.IP(attr.Value)
+			case NDA_LLADDR:
+				neigh.hwAddr = attr.Value
+			}
+		}
+		if neigh.ip == nil || len(neigh.hwAddr) != 6 {
+			continue
+		}
+
+		neigh.device = deviceName(index)
+		neighs = append(neighs, neigh)
+	}
+	return neighs, nil
+}
+
+//syscall.ParseNetlinkRouteAttr doesn't know the neighbour messages
+func parseRouteAttrs(b []byte) []syscall.NetlinkRouteAttr {
+	attrs := []syscall.NetlinkRouteAttr{}
+	for len(b) >= syscall.SizeofRtAttr {
+		a := (*syscall.RtAttr)(unsafe.Pointer(&b[0]))
+		if int(a.Len) < syscall.SizeofRtAttr || int(a.Len) > len(b) {
+			break
+		}
+		attrs = append(attrs, syscall.NetlinkRouteAttr{
+			Attr:  *a,
+			Value: b[syscall.SizeofRtAttr:a.Len],
+		})
+		l := (int(a.Len) + syscall.RTA_ALIGNTO - 1) &^ (syscall.RTA_ALIGNTO - 1)
+		if l > len(b) {
+			break
+		}
+		b = b[l:]
+	}
+	return attrs
+}
+
+func nativeUint32(b []byte) uint32 {
+	if len(b) < 4 {
+		return 0
+	}
+	return *(*uint32)(unsafe.Pointer(&b[0]))
+}
+
+func deviceName(index int) string {
+	if iface, err := net.InterfaceByIndex(index); err == nil {
+		return iface.Name
+	}
+	return ""
+}
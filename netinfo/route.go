@@ -5,7 +5,10 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 )
 
 var ROUTEPATH = "/proc/net/route"
@@ -14,24 +17,29 @@ type RouteItem struct {
 	Dest    uint32
 	Gateway uint32
 	Mask    uint32
+	Metric  uint32
 	Device  string
 }
 
 func (ri *RouteItem) String() string {
-	return fmt.Sprintf("{Dest:%v, GateWay:%v, Mask:%v, Device:%v}", ip2s(ri.Dest), ip2s(ri.Gateway), ip2s(ri.Mask), ri.Device)
+	return fmt.Sprintf("{Dest:%v, GateWay:%v, Mask:%v, Metric:%v, Device:%v}", ip2s(ri.Dest), ip2s(ri.Gateway), ip2s(ri.Mask), ri.Metric, ri.Device)
 }
 
 type Route struct {
+	mu     sync.RWMutex
 	routes []*RouteItem
 }
 
 func NewRoute() (*Route, error) {
 	r := &Route{}
-	err := r.Load(ROUTEPATH)
+	err := r.Reload()
 	return r, err
 }
 
 func (r *Route) String() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
 	res := "["
 	for _, v := range r.routes {
 		res += v.String()
@@ -53,7 +61,7 @@ func (r *Route) Load(fname string) error {
 		return err
 	}
 
-	r.routes = []*RouteItem{}
+	routes := []*RouteItem{}
 
 	for {
 		line, _, err := reader.ReadLine()
@@ -62,24 +70,80 @@ func (r *Route) Load(fname string) error {
 		}
 
 		ss := strings.Fields(string(line))
+		if len(ss) < 8 {
+			continue
+		}
 		dev, dst, gateway, mask := ss[0], iprs2ip(ss[1]), iprs2ip(ss[2]), iprs2ip(ss[7])
-		r.routes = append(r.routes, &RouteItem{
+		metric, _ := strconv.ParseUint(ss[6], 10, 32)
+		routes = append(routes, &RouteItem{
 			Dest:    dst,
 			Gateway: gateway,
 			Mask:    mask,
+			Metric:  uint32(metric),
 			Device:  dev,
 		})
 
 	}
+
+	r.mu.Lock()
+	r.routes = routes
+	r.mu.Unlock()
+	return nil
+}
+
+//Reload the main table from netlink, or from ROUTEPATH if netlink is not available
+func (r *Route) Reload() error {
+	items, err := dumpRoutes(syscall.AF_INET)
+	if err != nil {
+		return r.Load(ROUTEPATH)
+	}
+
+	routes := []*RouteItem{}
+	for _, item := range items {
+		dst, err := b2ip(item.dst.To4())
+		if err != nil {
+			continue
+		}
+		gateway := uint32(0)
+		if item.gateway != nil {
+			if gateway, err = b2ip(item.gateway.To4()); err != nil {
+				continue
+			}
+		}
+		mask := ^uint32(0) << uint(32-item.prefixLen)
+		routes = append(routes, &RouteItem{
+			Dest:    dst & mask,
+			Gateway: gateway,
+			Mask:    mask,
+			Metric:  item.metric,
+			Device:  item.device,
+		})
+	}
+
+	r.mu.Lock()
+	r.routes = routes
+	r.mu.Unlock()
 	return nil
 }
 
+//Longest prefix match, then the lowest metric. The gateway is 0 if dst is on-link.
 func (r *Route) GetGateway(dst uint32) (uint32, error) {
-	ln := len(r.routes)
-	for i := ln - 1; i >= 0; i-- {
-		if dst&r.routes[i].Mask == r.routes[i].Dest {
-			return r.routes[i].Gateway, nil
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var best *RouteItem
+	for _, item := range r.routes {
+		if dst&item.Mask != item.Dest {
+			continue
+		}
+		if best == nil || item.Mask > best.Mask ||
+			(item.Mask == best.Mask && item.Metric < best.Metric) {
+			best = item
 		}
 	}
-	return 0, fmt.Errorf("can't find route")
+
+	if best == nil {
+		return 0, fmt.Errorf("can't find route")
+	}
+	return best.Gateway, nil
 }
@@ -0,0 +1,174 @@
+package netinfo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+var ROUTE6PATH = "/proc/net/ipv6_route"
+
+//Route flags of /proc/net/ipv6_route
+const (
+	RTF_GATEWAY = 0x0002
+	RTF_REJECT  = 0x0200
+)
+
+type Route6Item struct {
+	Dest      net.IP
+	PrefixLen int
+	//nil if the destination is on-link
+	Gateway net.IP
+	Metric  uint32
+	Device  string
+}
+
+func (ri *Route6Item) String() string {
+	return fmt.Sprintf("{Dest:%v/%v, GateWay:%v, Metric:%v, Device:%v}", ri.Dest, ri.PrefixLen, ri.Gateway, ri.Metric, ri.Device)
+}
+
+type Route6 struct {
+	mu     sync.RWMutex
+	routes []*Route6Item
+}
+
+func NewRoute6() (*Route6, error) {
+	r := &Route6{}
+	err := r.Reload()
+	return r, err
+}
+
+func (r *Route6) String() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	res := "["
+	for _, v := range r.routes {
+		res += v.String()
+	}
+	res += "]"
+	return res
+}
+
+//Line: dest prefixlen src srcprefixlen nexthop metric refcnt use flags device
+func (r *Route6) Load(fname string) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+	reader := bufio.NewReader(f)
+
+	routes := []*Route6Item{}
+
+	for {
+		line, _, err := reader.ReadLine()
+		if err == io.EOF {
+			break
+		}
+
+		ss := strings.Fields(string(line))
+		if len(ss) < 10 {
+			continue
+		}
+
+		dst, err := hex2ip6(ss[0])
+		if err != nil {
+			continue
+		}
+		prefixLen, err := strconv.ParseUint(ss[1], 16, 8)
+		if err != nil || prefixLen > 128 {
+			continue
+		}
+		gateway, err := hex2ip6(ss[4])
+		if err != nil {
+			continue
+		}
+		metric, err := strconv.ParseUint(ss[5], 16, 32)
+		if err != nil {
+			continue
+		}
+		flags, err := strconv.ParseUint(ss[8], 16, 32)
+		if err != nil || flags&RTF_REJECT != 0 {
+			continue
+		}
+		if flags&RTF_GATEWAY == 0 {
+			gateway = nil
+		}
+
+		routes = append(routes, &Route6Item{
+			Dest:      dst,
+			PrefixLen: int(prefixLen),
+			Gateway:   gateway,
+			Metric:    uint32(metric),
+			Device:    ss[9],
+		})
+	}
+
+	r.mu.Lock()
+	r.routes = routes
+	r.mu.Unlock()
+	return nil
+}
+
+//Reload the main table from netlink, or from ROUTE6PATH if netlink is not available
+func (r *Route6) Reload() error {
+	items, err := dumpRoutes(syscall.AF_INET6)
+	if err != nil {
+		return r.Load(ROUTE6PATH)
+	}
+
+	routes := []*Route6Item{}
+	for _, item := range items {
+		if item.dst.To16() == nil {
+			continue
+		}
+		routes = append(routes, &Route6Item{
+			Dest:      item.dst.Mask(net.CIDRMask(item.prefixLen, 128)),
+			PrefixLen: item.prefixLen,
+			Gateway:   item.gateway,
+			Metric:    item.metric,
+			Device:    item.device,
+		})
+	}
+
+	r.mu.Lock()
+	r.routes = routes
+	r.mu.Unlock()
+	return nil
+}
+
+//Longest prefix match, then the lowest metric. The gateway is nil if dst is on-link.
+func (r *Route6) GetGateway(dst net.IP) (net.IP, error) {
+	dst = dst.To16()
+	if dst == nil {
+		return nil, fmt.Errorf("ip %v error", dst)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var best *Route6Item
+	for _, item := range r.routes {
+		mask := net.CIDRMask(item.PrefixLen, 128)
+		if !dst.Mask(mask).Equal(item.Dest) {
+			continue
+		}
+		if best == nil || item.PrefixLen > best.PrefixLen ||
+			(item.PrefixLen == best.PrefixLen && item.Metric < best.Metric) {
+			best = item
+		}
+	}
+
+	if best == nil {
+		return nil, fmt.Errorf("can't find route")
+	}
+	return best.Gateway, nil
+}
@@ -1,7 +1,9 @@
 package netinfo
 
 import (
+	"encoding/hex"
 	"fmt"
+	"net"
 	"strconv"
 	"strings"
 )
@@ -64,3 +66,12 @@ func iprs2ip(s string) uint32 {
 	r, _ := strconv.ParseUint(s, 16, 32)
 	return uint32(r)
 }
+
+//20010db8000000000000000000000001 -> 2001:db8::1
+func hex2ip6(s string) (net.IP, error) {
+	bs, err := hex.DecodeString(s)
+	if err != nil || len(bs) != net.IPv6len {
+		return nil, fmt.Errorf("ip %v error", s)
+	}
+	return net.IP(bs), nil
+}
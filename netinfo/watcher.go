@@ -0,0 +1,127 @@
+package netinfo
+
+import (
+	"sync"
+	"syscall"
+	"time"
+)
+
+//Multicast groups of linux/rtnetlink.h
+const (
+	RTMGRP_NEIGH      = 0x4
+	RTMGRP_IPV4_ROUTE = 0x40
+	RTMGRP_IPV6_ROUTE = 0x400
+)
+
+//Min interval in ms between two reloads of a table, the netlink events often come in bursts
+var WATCHINTERVAL = 100
+
+//Watcher keeps the tables current by reloading them when the kernel reports a route or neighbour change.
+//Any table can be nil.
+type Watcher struct {
+	fd     int
+	route  *Route
+	arp    *Arp
+	route6 *Route6
+	neigh  *Neigh
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewWatcher(route *Route, arp *Arp, route6 *Route6, neigh *Neigh) (*Watcher, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: RTMGRP_IPV4_ROUTE | RTMGRP_IPV6_ROUTE | RTMGRP_NEIGH,
+	}
+	if err = syscall.Bind(fd, addr); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	tv := syscall.NsecToTimeval(int64(WATCHINTERVAL) * 1000000)
+	if err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	w := &Watcher{
+		fd:     fd,
+		route:  route,
+		arp:    arp,
+		route6: route6,
+		neigh:  neigh,
+		done:   make(chan struct{}),
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *Watcher) run() {
+	defer syscall.Close(w.fd)
+
+	buf := make([]byte, syscall.Getpagesize()*4)
+	var dirtyRoute, dirtyRoute6, dirtyArp, dirtyNeigh bool
+	last := time.Time{}
+	for {
+		select {
+		case <-w.done:
+			return
+		default:
+		}
+
+		n, _, err := syscall.Recvfrom(w.fd, buf, 0)
+		if err == syscall.ENOBUFS {
+			//Events were lost
+			dirtyRoute, dirtyRoute6, dirtyArp, dirtyNeigh = true, true, true, true
+
+		} else if err == nil {
+			msgs, _ := syscall.ParseNetlinkMessage(buf[:n])
+			for _, m := range msgs {
+				if len(m.Data) == 0 {
+					continue
+				}
+				family := int(m.Data[0])
+				switch m.Header.Type {
+				case syscall.RTM_NEWROUTE, syscall.RTM_DELROUTE:
+					dirtyRoute = dirtyRoute || family == syscall.AF_INET
+					dirtyRoute6 = dirtyRoute6 || family == syscall.AF_INET6
+				case syscall.RTM_NEWNEIGH, syscall.RTM_DELNEIGH:
+					dirtyArp = dirtyArp || family == syscall.AF_INET
+					dirtyNeigh = dirtyNeigh || family == syscall.AF_INET6
+				}
+			}
+		}
+
+		if time.Since(last) < time.Millisecond*time.Duration(WATCHINTERVAL) {
+			continue
+		}
+		last = time.Now()
+
+		if dirtyRoute && w.route != nil {
+			w.route.Reload()
+		}
+		if dirtyRoute6 && w.route6 != nil {
+			w.route6.Reload()
+		}
+		if dirtyArp && w.arp != nil {
+			w.arp.Reload()
+		}
+		if dirtyNeigh && w.neigh != nil {
+			w.neigh.Reload()
+		}
+		dirtyRoute, dirtyRoute6, dirtyArp, dirtyNeigh = false, false, false, false
+	}
+}
+
+func (w *Watcher) Close() error {
+	w.closeOnce.Do(func() {
+		close(w.done)
+	})
+	return nil
+}
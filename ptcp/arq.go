@@ -0,0 +1,303 @@
+package ptcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+//Default max number of unacknowledged packets in reliable mode
+var RELIABLEWINDOW = 128
+
+//Default max retransmissions of a packet
+var MAXRETRANSMIT = 8
+
+//Retransmission timeout bounds in ms
+var RTOMIN = 200
+var RTOMAX = 5000
+var RTOINIT = 1000
+
+//Interval in ms of the retransmission check
+var ARQINTERVAL = 10
+
+//Max SACK blocks in one ACK, limited by the 40 bytes of TCP options
+var MAXSACKBLOCKS = 4
+
+//A packet is retransmitted without waiting for the RTO after this many ACKs of later packets
+var DUPACKTHRESHOLD = 3
+
+//sendBuffer keeps the unacknowledged packets of a reliable conn.
+//The RTO is estimated as in RFC 6298, with exponential backoff on each retransmission.
+type sendBuffer struct {
+	mu            sync.Mutex
+	window        int
+	maxRetransmit int
+	packets       map[uint32]*sentPacket
+	//Sequence number after the last added packet
+	next          uint32
+	srtt          time.Duration
+	rttvar        time.Duration
+	rto           time.Duration
+	retransmitted uint64
+	//Signaled when packets are acknowledged
+	room chan struct{}
+}
+
+type sentPacket struct {
+	packet  string
+	sent    time.Time
+	retries int
+	//ACKs of later packets since the last transmission
+	dupAcks int
+}
+
+//[left, right) range of received sequence numbers
+type sackBlock struct {
+	left  uint32
+	right uint32
+}
+
+func newSendBuffer(window int, maxRetransmit int) *sendBuffer {
+	return &sendBuffer{
+		window:        window,
+		maxRetransmit: maxRetransmit,
+		packets:       map[uint32]*sentPacket{},
+		rto:           time.Millisecond * time.Duration(RTOINIT),
+		room:          make(chan struct{}, 1),
+	}
+}
+
+//Packets between the oldest unacknowledged one and the next one, the receiver holds at most window of them
+func (sb *sendBuffer) span() int {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	if len(sb.packets) == 0 {
+		return 0
+	}
+	oldest := sb.next
+	for seq := range sb.packets {
+		if seqLess(seq, oldest) {
+			oldest = seq
+		}
+	}
+	return int(sb.next - oldest)
+}
+
+//Block until the window has room for a new packet
+func (sb *sendBuffer) wait(cancel <-chan struct{}, done <-chan struct{}) error {
+	for {
+		if sb.span() < sb.window {
+			return nil
+		}
+
+		select {
+		case <-sb.room:
+		case <-cancel:
+			return &timeoutError{}
+		case <-done:
+			return io.EOF
+		}
+	}
+}
+
+func (sb *sendBuffer) add(seq uint32, packet string) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	sb.packets[seq] = &sentPacket{
+		packet: packet,
+		sent:   time.Now(),
+	}
+	sb.next = seq + 1
+}
+
+//Returns the packets to retransmit immediately
+func (sb *sendBuffer) onAck(ack uint32, blocks []sackBlock) []string {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	now := time.Now()
+	highest := ack
+	for _, b := range blocks {
+		if seqLess(highest, b.right) {
+			highest = b.right
+		}
+	}
+
+	var sample *sentPacket
+	res := []string{}
+	for seq, p := range sb.packets {
+		acked := seqLess(seq, ack)
+		for _, b := range blocks {
+			acked = acked || (!seqLess(seq, b.left) && seqLess(seq, b.right))
+		}
+
+		if !acked {
+			//Fast retransmission of the holes
+			if seqLess(seq, highest) {
+				p.dupAcks++
+				if p.dupAcks >= DUPACKTHRESHOLD && now.Sub(p.sent) > sb.srtt && p.retries < sb.maxRetransmit {
+					p.retries++
+					p.sent, p.dupAcks = now, 0
+					sb.retransmitted++
+					res = append(res, p.packet)
+				}
+			}
+			continue
+		}
+
+		//Karn's algorithm: no sample from retransmitted packets
+		if p.retries == 0 && (sample == nil || p.sent.After(sample.sent)) {
+			sample = p
+		}
+		delete(sb.packets, seq)
+	}
+
+	if sample != nil {
+		sb.updateRTO(now.Sub(sample.sent))
+	}
+
+	select {
+	case sb.room <- struct{}{}:
+	default:
+	}
+	return res
+}
+
+func (sb *sendBuffer) updateRTO(rtt time.Duration) {
+	if sb.srtt == 0 {
+		sb.srtt, sb.rttvar = rtt, rtt/2
+
+	} else {
+		diff := sb.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		sb.rttvar = (3*sb.rttvar + diff) / 4
+		sb.srtt = (7*sb.srtt + rtt) / 8
+	}
+
+	sb.rto = sb.srtt + 4*sb.rttvar
+	if lo := time.Millisecond * time.Duration(RTOMIN); sb.rto < lo {
+		sb.rto = lo
+	}
+	if hi := time.Millisecond * time.Duration(RTOMAX); sb.rto > hi {
+		sb.rto = hi
+	}
+}
+
+//Packets whose retransmission timer expired. Error if one of them exhausted its retries.
+func (sb *sendBuffer) expired(now time.Time) ([]string, error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	res := []string{}
+	for seq, p := range sb.packets {
+		rto := sb.rto << uint(p.retries)
+		if hi := time.Millisecond * time.Duration(RTOMAX); rto > hi {
+			rto = hi
+		}
+		if now.Sub(p.sent) < rto {
+			continue
+		}
+		if p.retries >= sb.maxRetransmit {
+			return nil, fmt.Errorf("packet %v not acknowledged after %v retransmissions", seq, p.retries)
+		}
+		p.retries++
+		p.sent = now
+		sb.retransmitted++
+		res = append(res, p.packet)
+	}
+	return res, nil
+}
+
+func (sb *sendBuffer) pending() int {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return len(sb.packets)
+}
+
+//Block until all the packets are acknowledged, they are given up after the timeout
+func (sb *sendBuffer) waitEmpty(timeout time.Duration, done <-chan struct{}) {
+	after := time.NewTimer(timeout)
+	defer after.Stop()
+	for sb.pending() > 0 {
+		select {
+		case <-sb.room:
+		case <-after.C:
+			sb.clear()
+		case <-done:
+			sb.clear()
+		}
+	}
+}
+
+func (sb *sendBuffer) clear() {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	sb.packets = map[uint32]*sentPacket{}
+}
+
+func (sb *sendBuffer) getRetransmitted() uint64 {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.retransmitted
+}
+
+//SACK option value -> blocks
+func parseSack(v []byte) []sackBlock {
+	blocks := []sackBlock{}
+	for ; len(v) >= 8; v = v[8:] {
+		blocks = append(blocks, sackBlock{
+			left:  binary.BigEndian.Uint32(v[0:]),
+			right: binary.BigEndian.Uint32(v[4:]),
+		})
+	}
+	return blocks
+}
+
+func marshalSack(blocks []sackBlock) []byte {
+	v := make([]byte, 8*len(blocks))
+	for i, b := range blocks {
+		binary.BigEndian.PutUint32(v[8*i:], b.left)
+		binary.BigEndian.PutUint32(v[8*i+4:], b.right)
+	}
+	return v
+}
+
+//Cumulative ack and the blocks received after the first missing packet.
+//As in RFC 2018, the first block contains the latest received packet,
+//so the sender learns about every packet even if there are more blocks than fit in one ACK.
+func (w *recvWindow) ackState(latest uint32) (uint32, []sackBlock) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	seqs := make([]uint32, 0, len(w.pending))
+	for seq := range w.pending {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqLess(seqs[i], seqs[j]) })
+
+	blocks := []sackBlock{}
+	for _, seq := range seqs {
+		if n := len(blocks); n > 0 && blocks[n-1].right == seq {
+			blocks[n-1].right++
+			continue
+		}
+		blocks = append(blocks, sackBlock{left: seq, right: seq + 1})
+	}
+
+	for i, b := range blocks {
+		if !seqLess(latest, b.left) && seqLess(latest, b.right) {
+			blocks[0], blocks[i] = blocks[i], blocks[0]
+			break
+		}
+	}
+	if len(blocks) > MAXSACKBLOCKS {
+		blocks = blocks[:MAXSACKBLOCKS]
+	}
+	return w.next, blocks
+}
@@ -0,0 +1,142 @@
+package ptcp
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+//lossyLink drops the written packets with probability loss
+type lossyLink struct {
+	Link
+	loss float64
+	mu   sync.Mutex
+	r    *rand.Rand
+}
+
+func (l *lossyLink) Write(b []byte) error {
+	l.mu.Lock()
+	drop := l.r.Float64() < l.loss
+	l.mu.Unlock()
+	if drop {
+		return nil
+	}
+	return l.Link.Write(b)
+}
+
+//Stacks on a Pipe losing packets in both directions, deterministic
+func newLossyStacks(t testing.TB, loss float64, ca ConnConfig, cb ConnConfig) (*Stack, *Stack) {
+	a, b := NewPipe()
+	la := &lossyLink{Link: a, loss: loss, r: rand.New(rand.NewSource(1))}
+	lb := &lossyLink{Link: b, loss: loss, r: rand.New(rand.NewSource(2))}
+	return newStacks(t, la, lb, ca, cb)
+}
+
+func TestSendBufferSack(t *testing.T) {
+	sb := newSendBuffer(8, MAXRETRANSMIT)
+	for seq := uint32(1); seq <= 5; seq++ {
+		sb.add(seq, fmt.Sprint(seq))
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	//1 acked, 4 and 5 selectively acked: 2 and 3 are holes
+	res := sb.onAck(2, []sackBlock{{left: 4, right: 6}})
+	if len(res) != 0 || sb.pending() != 2 {
+		t.Fatal(res, sb.pending())
+	}
+	for i := 1; i < DUPACKTHRESHOLD-1; i++ {
+		if res = sb.onAck(2, []sackBlock{{left: 4, right: 6}}); len(res) != 0 {
+			t.Fatal(i, res)
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	res = sb.onAck(2, []sackBlock{{left: 4, right: 6}})
+	if len(res) != 2 || sb.getRetransmitted() != 2 {
+		t.Fatal("no fast retransmission", res)
+	}
+	sb.onAck(6, nil)
+	if sb.pending() != 0 {
+		t.Fatal(sb.pending())
+	}
+}
+
+func TestSendBufferRTO(t *testing.T) {
+	sb := newSendBuffer(8, 1)
+	sb.rto = 20 * time.Millisecond
+	sb.add(1, "1")
+	now := time.Now()
+	if res, err := sb.expired(now); err != nil || len(res) != 0 {
+		t.Fatal(res, err)
+	}
+	now = now.Add(25 * time.Millisecond)
+	if res, err := sb.expired(now); err != nil || len(res) != 1 {
+		t.Fatal(res, err)
+	}
+	//Backoff: the next timeout is twice the RTO
+	if res, err := sb.expired(now.Add(30 * time.Millisecond)); err != nil || len(res) != 0 {
+		t.Fatal(res, err)
+	}
+	if _, err := sb.expired(now.Add(45 * time.Millisecond)); err == nil {
+		t.Fatal("retransmitted more than the max")
+	}
+}
+
+func TestAckState(t *testing.T) {
+	w := newRecvWindow(1, 16, time.Second)
+	w.reliable = true
+	for _, seq := range []uint32{1, 3, 4, 7, 9, 10} {
+		w.push(seq, fmt.Sprint(seq))
+	}
+	//The block of the latest packet comes first
+	ack, blocks := w.ackState(7)
+	if ack != 2 || fmt.Sprint(blocks) != "[{7 8} {3 5} {9 11}]" {
+		t.Fatal(ack, blocks)
+	}
+	if parsed := parseSack(marshalSack(blocks)); fmt.Sprint(parsed) != fmt.Sprint(blocks) {
+		t.Fatal(parsed)
+	}
+}
+
+func TestReliable(t *testing.T) {
+	cfg := ConnConfig{Reliable: true}
+	sa, sb := newLossyStacks(t, 0.2, cfg, cfg)
+	c, s := connectPair(t, sa, sb, 7100)
+	if c.snd == nil || s.snd == nil {
+		t.Fatal("not reliable")
+	}
+
+	const N = 500
+	go func() {
+		for i := 0; i < N; i++ {
+			if _, err := c.Write([]byte(fmt.Sprint(i))); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	buf := make([]byte, 100)
+	s.SetReadDeadline(time.Now().Add(20 * time.Second))
+	for i := 0; i < N; i++ {
+		n, err := s.Read(buf)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if string(buf[:n]) != fmt.Sprint(i) {
+			t.Fatalf("got %s want %d", buf[:n], i)
+		}
+	}
+	if c.Stats().Retransmitted == 0 {
+		t.Fatal("nothing retransmitted")
+	}
+}
+
+func TestReliableFallback(t *testing.T) {
+	sa, sb := newPipeStacks(t, ConnConfig{Reliable: true}, ConnConfig{})
+	c, s := connectPair(t, sa, sb, 7101)
+	if c.snd != nil || s.snd != nil {
+		t.Fatal("reliable mode not granted by the listener")
+	}
+	exchange(t, c, s, 3)
+}
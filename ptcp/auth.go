@@ -0,0 +1,85 @@
+package ptcp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+//Max difference in seconds between the clocks of the dialer and the listener
+var AUTHMAXSKEW = 30
+
+const (
+	AUTHNONCELEN = 16
+	AUTHMACLEN   = 16
+	//Value of the auth TLV: nonce + unix time (8) + mac
+	AUTHLEN = AUTHNONCELEN + 8 + AUTHMACLEN
+)
+
+//Append the auth TLV to the hello payload of a SYN from src to dst.
+//It must be the last TLV, the mac covers the ones before it.
+func signHello(payload []byte, key []byte, src string, dst string) ([]byte, error) {
+	v := make([]byte, AUTHLEN)
+	if _, err := rand.Read(v[:AUTHNONCELEN]); err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint64(v[AUTHNONCELEN:], uint64(time.Now().Unix()))
+	copy(v[AUTHNONCELEN+8:], authMac(key, payload, v[:AUTHNONCELEN+8], src, dst))
+	return appendTLV(payload, HELLOAUTH, v), nil
+}
+
+func authMac(key []byte, signed []byte, nonceTime []byte, src string, dst string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(nonceTime)
+	mac.Write([]byte(src))
+	mac.Write([]byte{0})
+	mac.Write([]byte(dst))
+	mac.Write([]byte{0})
+	mac.Write(signed)
+	return mac.Sum(nil)[:AUTHMACLEN]
+}
+
+//authChecker validates the signed SYNs of a listener and remembers their nonces to refuse the replays
+type authChecker struct {
+	key    []byte
+	nonces *cache.Cache
+}
+
+func newAuthChecker(key []byte) *authChecker {
+	keep := time.Duration(2*AUTHMAXSKEW) * time.Second
+	return &authChecker{
+		key:    key,
+		nonces: cache.New(keep, keep),
+	}
+}
+
+//Without replay, a retransmitted SYN is accepted again. It's used with SYN cookies, which keep no state per SYN anyway.
+func (a *authChecker) check(h *hello, src string, dst string, replay bool) error {
+	if len(h.auth) != AUTHLEN {
+		return fmt.Errorf("unsigned syn")
+	}
+
+	mac := authMac(a.key, h.signed, h.auth[:AUTHNONCELEN+8], src, dst)
+	if !hmac.Equal(mac, h.auth[AUTHNONCELEN+8:]) {
+		return fmt.Errorf("invalid syn signature")
+	}
+
+	ts := int64(binary.BigEndian.Uint64(h.auth[AUTHNONCELEN:]))
+	if skew := time.Now().Unix() - ts; skew > int64(AUTHMAXSKEW) || skew < -int64(AUTHMAXSKEW) {
+		return fmt.Errorf("syn timestamp out of range")
+	}
+
+	if !replay {
+		return nil
+	}
+	//A nonce is remembered longer than its timestamp is valid
+	if err := a.nonces.Add(string(h.auth[:AUTHNONCELEN]), true, cache.DefaultExpiration); err != nil {
+		return fmt.Errorf("replayed syn")
+	}
+	return nil
+}
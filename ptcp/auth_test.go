@@ -0,0 +1,106 @@
+package ptcp
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+)
+
+//Dial port of sb from sa, the listener keeps accepting until the end of the test
+func dialListener(t testing.TB, sa *Stack, sb *Stack, port int, timeout time.Duration) error {
+	addr := fmt.Sprintf("10.0.0.2:%d", port)
+	ln, err := sb.Listen("ptcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			if _, err := ln.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	c, err := sa.DialContext(ctx, "ptcp", addr)
+	if err == nil {
+		c.Close()
+	}
+	return err
+}
+
+func TestAuthDial(t *testing.T) {
+	key := []byte("token")
+	sa, sb := newPipeStacks(t, ConnConfig{AuthKey: key}, ConnConfig{AuthKey: key})
+	c, s := connectPair(t, sa, sb, 7500)
+	exchange(t, c, s, 1)
+
+	//The listener drops the SYNs signed with another key and the unsigned ones
+	sc, sd := newPipeStacks(t, ConnConfig{AuthKey: []byte("bad")}, ConnConfig{AuthKey: key})
+	if err := dialListener(t, sc, sd, 7501, time.Second); err == nil {
+		t.Fatal("bad key accepted")
+	}
+	se, sf := newPipeStacks(t, ConnConfig{}, ConnConfig{AuthKey: key})
+	if err := dialListener(t, se, sf, 7502, time.Second); err == nil {
+		t.Fatal("unsigned syn accepted")
+	}
+}
+
+func TestAuthCheck(t *testing.T) {
+	key := []byte("token")
+	src, dst := "10.0.0.1:1000", "10.0.0.2:2000"
+	h := &hello{reliable: true, window: 64}
+	signed := func() []byte {
+		p, err := signHello(h.marshal(), key, src, dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	check := func(p []byte, src string, dst string) error {
+		ph, err := parseHello(p)
+		if err != nil {
+			return err
+		}
+		return newAuthChecker(key).check(ph, src, dst, false)
+	}
+
+	a := newAuthChecker(key)
+	ph, err := parseHello(signed())
+	if err != nil || !ph.reliable {
+		t.Fatal(err)
+	}
+	if err = a.check(ph, src, dst, true); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.check(ph, src, dst, true); err == nil {
+		t.Fatal("replay accepted")
+	}
+	if err = a.check(ph, src, dst, false); err != nil {
+		t.Fatal("retransmission refused without replay check", err)
+	}
+
+	if check(signed(), "10.0.0.1:1001", dst) == nil {
+		t.Fatal("other 4-tuple accepted")
+	}
+	p := signed()
+	p[2] ^= 1
+	if check(p, src, dst) == nil {
+		t.Fatal("tampered option accepted")
+	}
+	if check(h.marshal(), src, dst) == nil {
+		t.Fatal("unsigned syn accepted")
+	}
+
+	//Timestamp out of the skew, signed again so only the time is wrong
+	p = signed()
+	v := p[len(p)-AUTHLEN:]
+	binary.BigEndian.PutUint64(v[AUTHNONCELEN:], uint64(time.Now().Unix()-int64(AUTHMAXSKEW)-5))
+	copy(v[AUTHNONCELEN+8:], authMac(key, p[:len(p)-AUTHLEN-2], v[:AUTHNONCELEN+8], src, dst))
+	if check(p, src, dst) == nil {
+		t.Fatal("expired syn accepted")
+	}
+}
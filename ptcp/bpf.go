@@ -0,0 +1,276 @@
+package ptcp
+
+import (
+	"fmt"
+	"sort"
+	"syscall"
+)
+
+//Max instructions of a classic BPF program, BPF_MAXINSNS of the kernel
+const BPFMAXINSNS = 4096
+
+//Returned by the filter for the admitted frames, the whole frame is kept
+const BPFACCEPT = 0x40000
+
+//portFilter is implemented by the links which can drop in the kernel the frames the stack doesn't want
+type portFilter interface {
+	//Admit the TCP packets to these local ports, and the ARP, ICMP "too big" and fragment packets
+	SetPorts(ports []uint16) error
+}
+
+//bpfProgram is a classic BPF program with symbolic jumps, resolved by assemble
+type bpfProgram struct {
+	insns  []bpfInsn
+	labels map[string]int
+}
+
+//The jumps go to the labels jt/jf, or skip jtSkip/jfSkip instructions if the label is empty
+type bpfInsn struct {
+	code           uint16
+	k              uint32
+	jt, jf         string
+	jtSkip, jfSkip int
+	ja             string
+}
+
+func (p *bpfProgram) label(name string) {
+	p.labels[name] = len(p.insns)
+}
+
+func (p *bpfProgram) stmt(code uint16, k uint32) {
+	p.insns = append(p.insns, bpfInsn{code: code, k: k})
+}
+
+//An empty label goes to the next instruction
+func (p *bpfProgram) jump(code uint16, k uint32, jt string, jf string) {
+	p.insns = append(p.insns, bpfInsn{code: code, k: k, jt: jt, jf: jf})
+}
+
+func (p *bpfProgram) skip(code uint16, k uint32, jt int, jf int) {
+	p.insns = append(p.insns, bpfInsn{code: code, k: k, jtSkip: jt, jfSkip: jf})
+}
+
+func (p *bpfProgram) ja(label string) {
+	p.insns = append(p.insns, bpfInsn{code: syscall.BPF_JMP | syscall.BPF_JA, ja: label})
+}
+
+func (p *bpfProgram) assemble() ([]syscall.SockFilter, error) {
+	if len(p.insns) > BPFMAXINSNS {
+		return nil, fmt.Errorf("bpf program too long: %v", len(p.insns))
+	}
+	offset := func(i int, label string, skip int) (int, error) {
+		if label == "" {
+			return skip, nil
+		}
+		pos, ok := p.labels[label]
+		if !ok || pos <= i {
+			return 0, fmt.Errorf("invalid bpf label %v", label)
+		}
+		return pos - i - 1, nil
+	}
+
+	filter := make([]syscall.SockFilter, len(p.insns))
+	for i, insn := range p.insns {
+		f := syscall.SockFilter{Code: insn.code, K: insn.k}
+		if insn.ja != "" {
+			off, err := offset(i, insn.ja, 0)
+			if err != nil {
+				return nil, err
+			}
+			f.K = uint32(off)
+		} else if insn.code&0x07 == syscall.BPF_JMP {
+			jt, err := offset(i, insn.jt, insn.jtSkip)
+			if err != nil {
+				return nil, err
+			}
+			jf, err := offset(i, insn.jf, insn.jfSkip)
+			if err != nil {
+				return nil, err
+			}
+			if jt > 255 || jf > 255 {
+				return nil, fmt.Errorf("bpf jump too long")
+			}
+			f.Jt, f.Jf = uint8(jt), uint8(jf)
+		}
+		filter[i] = f
+	}
+	return filter, nil
+}
+
+//Ports -> sorted ranges of consecutive ports
+func portRanges(ports []uint16) [][2]uint16 {
+	sorted := append([]uint16{}, ports...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	ranges := [][2]uint16{}
+	for _, port := range sorted {
+		if n := len(ranges); n > 0 && (port == ranges[n-1][1] || port == ranges[n-1][1]+1) {
+			ranges[n-1][1] = port
+			continue
+		}
+		ranges = append(ranges, [2]uint16{port, port})
+	}
+	return ranges
+}
+
+//Filter of the Ethernet frames for the local ports. With too many port ranges for one program,
+//all the TCP packets are admitted.
+func portFilterProgram(ports []uint16) ([]syscall.SockFilter, error) {
+	const (
+		ld   = syscall.BPF_LD | syscall.BPF_ABS
+		ldx  = syscall.BPF_LDX | syscall.BPF_B | syscall.BPF_MSH
+		ldi  = syscall.BPF_LD | syscall.BPF_IND
+		jeq  = syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K
+		jset = syscall.BPF_JMP | syscall.BPF_JSET | syscall.BPF_K
+		ret  = syscall.BPF_RET | syscall.BPF_K
+	)
+
+	p := &bpfProgram{labels: map[string]int{}}
+	p.stmt(ld|syscall.BPF_H, 12)
+	p.jump(jeq, syscall.ETH_P_ARP, "accept", "")
+	p.jump(jeq, syscall.ETH_P_IPV6, "ipv6", "")
+	p.jump(jeq, syscall.ETH_P_IP, "", "drop")
+
+	//ipv4: TCP, or ICMP destination unreachable
+	p.stmt(ld|syscall.BPF_B, 23)
+	p.jump(jeq, syscall.IPPROTO_TCP, "tcp4", "")
+	p.jump(jeq, syscall.IPPROTO_ICMP, "", "drop")
+	p.stmt(ldx, 14)
+	p.stmt(ldi|syscall.BPF_B, 14)
+	p.jump(jeq, 3, "accept", "drop")
+	p.label("tcp4")
+	//The fragments after the first one have no TCP header
+	p.stmt(ld|syscall.BPF_H, 20)
+	p.jump(jset, 0x1fff, "accept", "")
+	p.stmt(ldx, 14)
+	p.stmt(ldi|syscall.BPF_H, 14+2)
+	p.ja("ports")
+
+	//ipv6: TCP, fragments, or ICMPv6 packet too big
+	p.label("ipv6")
+	p.stmt(ld|syscall.BPF_B, 14+6)
+	p.jump(jeq, syscall.IPPROTO_TCP, "tcp6", "")
+	p.jump(jeq, 44, "accept", "")
+	p.jump(jeq, 58, "", "drop")
+	p.stmt(ld|syscall.BPF_B, 14+40)
+	p.jump(jeq, 2, "accept", "drop")
+	p.label("tcp6")
+	p.stmt(ld|syscall.BPF_H, 14+40+2)
+	p.ja("ports")
+
+	p.label("accept")
+	p.stmt(ret, BPFACCEPT)
+	p.label("drop")
+	p.stmt(ret, 0)
+
+	p.label("ports")
+	p.ports(ports)
+	return p.assemble()
+}
+
+//Filter of the packets of a raw IP socket for the local ports. The ipv4 packets start at the IP header,
+//the ipv6 ones at the TCP header.
+func l3PortFilterProgram(ports []uint16, ipv6 bool) ([]syscall.SockFilter, error) {
+	p := &bpfProgram{labels: map[string]int{}}
+	if ipv6 {
+		p.stmt(syscall.BPF_LD|syscall.BPF_ABS|syscall.BPF_H, 2)
+	} else {
+		p.stmt(syscall.BPF_LDX|syscall.BPF_B|syscall.BPF_MSH, 0)
+		p.stmt(syscall.BPF_LD|syscall.BPF_IND|syscall.BPF_H, 2)
+	}
+	p.ports(ports)
+	return p.assemble()
+}
+
+//Accept the packets whose destination port in A is one of ports, drop the others.
+//Each range returns by itself, so the jumps stay short.
+func (p *bpfProgram) ports(ports []uint16) {
+	const (
+		jeq = syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K
+		jge = syscall.BPF_JMP | syscall.BPF_JGE | syscall.BPF_K
+		jgt = syscall.BPF_JMP | syscall.BPF_JGT | syscall.BPF_K
+		ret = syscall.BPF_RET | syscall.BPF_K
+	)
+	ranges := portRanges(ports)
+	if len(p.insns)+3*len(ranges)+1 > BPFMAXINSNS {
+		ranges = [][2]uint16{{0, 65535}}
+	}
+	for _, r := range ranges {
+		if r[0] == r[1] {
+			p.skip(jeq, uint32(r[0]), 0, 1)
+		} else {
+			p.skip(jge, uint32(r[0]), 0, 2)
+			p.skip(jgt, uint32(r[1]), 1, 0)
+		}
+		p.stmt(ret, BPFACCEPT)
+	}
+	p.stmt(ret, 0)
+}
+
+//Count a listener or conn on the port of addr, the filter is updated if the port is new
+func (s *Stack) addFilterPort(addr string) {
+	if _, ok := s.link.(portFilter); !ok {
+		return
+	}
+	_, port, err := splitAddr(addr)
+	if err != nil {
+		return
+	}
+	s.filterMu.Lock()
+	defer s.filterMu.Unlock()
+	s.portRefs[port]++
+	if s.portRefs[port] == 1 {
+		s.setFilter()
+	}
+}
+
+//Release a port counted by addFilterPort, the filter is updated if it was the last user
+func (s *Stack) removeFilterPort(addr string) {
+	if _, ok := s.link.(portFilter); !ok {
+		return
+	}
+	_, port, err := splitAddr(addr)
+	if err != nil {
+		return
+	}
+	s.filterMu.Lock()
+	defer s.filterMu.Unlock()
+	if s.portRefs[port] == 0 {
+		return
+	}
+	s.portRefs[port]--
+	if s.portRefs[port] == 0 {
+		delete(s.portRefs, port)
+		s.setFilter()
+	}
+}
+
+//Update the filter of the link with the counted ports. s.filterMu is held.
+func (s *Stack) setFilter() {
+	f, ok := s.link.(portFilter)
+	if !ok {
+		return
+	}
+	ports := make([]uint16, 0, len(s.portRefs))
+	for port := range s.portRefs {
+		ports = append(ports, port)
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i] < ports[j] })
+	if s.filterPorts != nil && equalPorts(ports, s.filterPorts) {
+		return
+	}
+	if err := f.SetPorts(ports); err == nil {
+		s.filterPorts = ports
+	}
+}
+
+func equalPorts(a []uint16, b []uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
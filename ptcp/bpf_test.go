@@ -0,0 +1,207 @@
+package ptcp
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+//filterLink records the port lists set by the stack
+type filterLink struct {
+	Link
+	mu  sync.Mutex
+	set [][]uint16
+}
+
+func (l *filterLink) SetPorts(ports []uint16) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.set = append(l.set, ports)
+	return nil
+}
+
+func (l *filterLink) updates() [][]uint16 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([][]uint16{}, l.set...)
+}
+
+func ethFrame(ethType uint16, ip []byte) []byte {
+	f := make([]byte, 14+len(ip))
+	binary.BigEndian.PutUint16(f[12:], ethType)
+	copy(f[14:], ip)
+	return f
+}
+
+func TestPortRanges(t *testing.T) {
+	ranges := portRanges([]uint16{5000, 80, 1001, 1000, 1002, 65535, 1002})
+	if fmt.Sprint(ranges) != "[[80 80] [1000 1002] [5000 5000] [65535 65535]]" {
+		t.Fatal(ranges)
+	}
+	if ranges = portRanges(nil); len(ranges) != 0 {
+		t.Fatal(ranges)
+	}
+}
+
+func TestBpfAssemble(t *testing.T) {
+	p := &bpfProgram{labels: map[string]int{}}
+	p.jump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, 1, "accept", "")
+	p.ja("drop")
+	p.label("accept")
+	p.stmt(syscall.BPF_RET|syscall.BPF_K, BPFACCEPT)
+	p.label("drop")
+	p.stmt(syscall.BPF_RET|syscall.BPF_K, 0)
+	filter, err := p.assemble()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter[0].Jt != 1 || filter[0].Jf != 0 || filter[1].K != 1 {
+		t.Fatal(filter)
+	}
+
+	//The jumps only go forward
+	p = &bpfProgram{labels: map[string]int{}}
+	p.label("back")
+	p.ja("back")
+	if _, err = p.assemble(); err == nil {
+		t.Fatal("backward jump assembled")
+	}
+
+	//Too many ranges are replaced by all the ports
+	many := []uint16{}
+	for i := 0; i < 3000; i++ {
+		many = append(many, uint16(i*3))
+	}
+	if f, err := portFilterProgram(many); err != nil || len(f) > BPFMAXINSNS {
+		t.Fatal(err)
+	}
+}
+
+func TestPortFilterProgram(t *testing.T) {
+	filter, err := portFilterProgram([]uint16{80, 1000, 1001, 1002, 5000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+	if err := syscall.AttachLsf(fds[1], filter); err != nil {
+		t.Fatal(err)
+	}
+	tv := syscall.NsecToTimeval(int64(50 * time.Millisecond))
+	syscall.SetsockoptTimeval(fds[1], syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv)
+
+	tcp4 := func(port int) []byte {
+		p := buildPacket("10.0.0.1:5", fmt.Sprintf("10.0.0.2:%d", port), 1, 1, 0x10, []byte("x"))
+		return ethFrame(syscall.ETH_P_IP, p)
+	}
+	tcp6 := func(port int) []byte {
+		p := buildPacket("[fd00::1]:5", fmt.Sprintf("[fd00::2]:%d", port), 1, 1, 0x10, []byte("x"))
+		return ethFrame(syscall.ETH_P_IPV6, p)
+	}
+	udp := tcp4(80)
+	udp[14+9] = syscall.IPPROTO_UDP
+	unreach := tcp4(99)
+	unreach[14+9], unreach[14+20] = syscall.IPPROTO_ICMP, 3
+	echo := tcp4(99)
+	echo[14+9], echo[14+20] = syscall.IPPROTO_ICMP, 8
+	frag := tcp4(99)
+	binary.BigEndian.PutUint16(frag[14+6:], 10)
+	//ipv4 header with options
+	opts := tcp4(1001)
+	opts = append(append(append([]byte{}, opts[:14+20]...), 1, 1, 1, 1), opts[14+20:]...)
+	opts[14] = 0x46
+	tooBig6 := tcp6(99)
+	tooBig6[14+6], tooBig6[14+40] = syscall.IPPROTO_ICMPV6, 2
+	solicit6 := tcp6(99)
+	solicit6[14+6], solicit6[14+40] = syscall.IPPROTO_ICMPV6, 135
+
+	cases := []struct {
+		name  string
+		frame []byte
+		want  bool
+	}{
+		{"arp", ethFrame(syscall.ETH_P_ARP, make([]byte, 28)), true},
+		{"tcp4 80", tcp4(80), true},
+		{"tcp4 81", tcp4(81), false},
+		{"tcp4 999", tcp4(999), false},
+		{"tcp4 1001", tcp4(1001), true},
+		{"tcp4 1003", tcp4(1003), false},
+		{"tcp4 5000", tcp4(5000), true},
+		{"tcp4 with options 1001", opts, true},
+		{"tcp6 1002", tcp6(1002), true},
+		{"tcp6 22", tcp6(22), false},
+		{"udp", udp, false},
+		{"icmp unreachable", unreach, true},
+		{"icmp echo", echo, false},
+		{"fragment", frag, true},
+		{"icmpv6 too big", tooBig6, true},
+		{"icmpv6 solicitation", solicit6, false},
+		{"other ethertype", ethFrame(0x88b5, make([]byte, 40)), false},
+	}
+	buf := make([]byte, 2000)
+	for _, c := range cases {
+		syscall.Write(fds[0], c.frame)
+		n, err := syscall.Read(fds[1], buf)
+		if got := err == nil && n == len(c.frame); got != c.want {
+			t.Error(c.name, got, n, err)
+		}
+	}
+}
+
+func TestFilterPorts(t *testing.T) {
+	a, b := NewPipe()
+	fa := &filterLink{Link: a}
+	sa, sb := newStacks(t, fa, b, ConnConfig{}, ConnConfig{})
+	if u := fa.updates(); fmt.Sprint(u) != "[[]]" {
+		t.Fatal("initial filter", u)
+	}
+
+	ln, err := sa.Listen("ptcp", "10.0.0.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			if _, err := ln.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+	//The accepted conns share the port of the listener, the filter isn't rebuilt for them
+	for i := 0; i < 3; i++ {
+		if _, err := sb.Dial("ptcp", "10.0.0.1:80"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, time.Second, func() bool { return countConns(sa) == 3 })
+	if u := fa.updates(); fmt.Sprint(u) != "[[] [80]]" {
+		t.Fatal(u)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if _, err := sa.DialContext(ctx, "ptcp", "10.0.0.2:90"); err == nil {
+		t.Fatal("dialed without listener")
+	}
+	ln.Close()
+	sa.router.Range(func(key interface{}, value interface{}) bool {
+		value.(*Conn).Close()
+		return true
+	})
+	//The port of the failed dial comes and goes, 80 goes with its last conn
+	waitFor(t, 5*time.Second, func() bool {
+		u := fa.updates()
+		return len(u) > 0 && len(u[len(u)-1]) == 0
+	})
+	if u := fa.updates(); len(u) != 5 {
+		t.Fatal(u)
+	}
+}
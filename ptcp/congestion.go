@@ -0,0 +1,394 @@
+package ptcp
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+)
+
+//A receiver sends a feedback every CCFEEDBACKPACKETS data packets, or after CCFEEDBACKINTERVAL ms
+var CCFEEDBACKPACKETS = 2
+var CCFEEDBACKINTERVAL = 20
+
+//Pacing rate in bytes/s before the first measurement
+var CCINITRATE = 256 * 1024
+
+//RTT in ms before the first measurement
+var CCINITRTT = 100
+
+//The bottleneck bandwidth is the max delivery rate of the last CCBWROUNDS round trips
+var CCBWROUNDS = 10
+
+//Seconds before the min RTT is measured again
+var CCRTTWINDOW = 10
+
+//Min congestion window in bytes
+var CCMINCWND = 4 * 1500
+
+//Max time in ms a full congestion window blocks the sender, in case the feedbacks are lost
+var CCMAXSTALL = 200
+
+//Max sent packets waiting for a feedback, the older ones are forgotten
+var CCMAXSENT = 4096
+
+//Packets are sent at once if their pacing delay is shorter, timers are not precise enough
+var PACINGQUANTUM = time.Millisecond
+
+//The time lost by a late timer is made up for up to PACINGBURST, the idle time isn't
+var PACINGBURST = 10 * time.Millisecond
+
+//Feedback option layout: payload bytes received (4) + highest sequence number received (4)
+const CCOPTIONLEN = 8
+
+//Modes of the congestion control
+const (
+	//Double the rate every round trip until the bandwidth stops growing
+	CCSTARTUP = iota
+	//Empty the queue built during the startup
+	CCDRAIN
+	//Cycle the rate around the bandwidth to probe for more
+	CCPROBE
+)
+
+var ccStartupGain = 2.885
+var ccProbeGains = []float64{1.25, 0.75, 1, 1, 1, 1, 1, 1}
+
+//congestion is a BBR-like congestion control. The receiver reports the bytes it got and its highest
+//sequence number in the ACKs, the sender derives the delivery rate, the RTT and the bytes in flight,
+//and paces the data packets at a multiple of the bottleneck bandwidth.
+type congestion struct {
+	mu sync.Mutex
+
+	//Sender side, in payload bytes
+	sent       []ccSent
+	sentBytes  uint32
+	inflight   uint32
+	samples    []ccSample
+	btlBw      float64
+	minRtt     time.Duration
+	minRttTime time.Time
+	//Feedback starting the current delivery rate sample, and the send time of its highest packet
+	fbBytes    uint32
+	fbTime     time.Time
+	fbSendTime time.Time
+	//Send time of the highest packet of the last feedback
+	lastSendTime time.Time
+	//The sender waited for the window or the pacing since the last sample, so the sample isn't limited by the application
+	busy bool
+
+	mode       int
+	roundStart time.Time
+	fullBw     float64
+	fullRounds int
+	cycle      int
+	//Signaled by the feedbacks
+	fbEvent chan struct{}
+
+	//Receiver side
+	rcvBytes     uint32
+	rcvHighest   uint32
+	rcvPackets   int
+	lastFeedback time.Time
+}
+
+type ccSent struct {
+	seq uint32
+	//Bytes sent up to this packet
+	bytes uint32
+	time  time.Time
+}
+
+type ccSample struct {
+	time time.Time
+	bw   float64
+}
+
+func newCongestion() *congestion {
+	return &congestion{
+		roundStart: time.Now(),
+		fbEvent:    make(chan struct{}, 1),
+	}
+}
+
+func (cc *congestion) onSend(seq uint32, n int) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.sentBytes += uint32(n)
+	cc.inflight += uint32(n)
+	if len(cc.sent) >= CCMAXSENT {
+		cc.sent = cc.sent[1:]
+	}
+	cc.sent = append(cc.sent, ccSent{seq: seq, bytes: cc.sentBytes, time: time.Now()})
+}
+
+//The packets up to highest are delivered or lost
+func (cc *congestion) onFeedback(received uint32, highest uint32) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	now := time.Now()
+
+	i := 0
+	for ; i < len(cc.sent) && !seqLess(highest, cc.sent[i].seq); i++ {
+	}
+	if i > 0 {
+		last := cc.sent[i-1]
+		cc.lastSendTime = last.time
+		if last.seq == highest {
+			cc.updateRtt(now.Sub(last.time), now)
+		}
+		cc.inflight = cc.sentBytes - last.bytes
+		cc.sent = cc.sent[i:]
+	}
+
+	if cc.fbTime.IsZero() {
+		cc.fbBytes, cc.fbTime, cc.fbSendTime = received, now, cc.lastSendTime
+
+	} else if dt := now.Sub(cc.fbTime); dt > 0 && dt >= cc.rtt()/4 {
+		//As in BBR, the feedbacks bunched on the way back don't make the rate larger than the send rate
+		if sendDt := cc.lastSendTime.Sub(cc.fbSendTime); sendDt > dt {
+			dt = sendDt
+		}
+		bw := float64(received-cc.fbBytes) / dt.Seconds()
+		if cc.busy || bw > cc.btlBw {
+			cc.updateBw(bw, now)
+		}
+		cc.fbBytes, cc.fbTime, cc.fbSendTime, cc.busy = received, now, cc.lastSendTime, false
+	}
+
+	cc.updateMode(now)
+	select {
+	case cc.fbEvent <- struct{}{}:
+	default:
+	}
+}
+
+func (cc *congestion) updateRtt(rtt time.Duration, now time.Time) {
+	if cc.minRtt == 0 || rtt < cc.minRtt || now.Sub(cc.minRttTime) > time.Second*time.Duration(CCRTTWINDOW) {
+		cc.minRtt, cc.minRttTime = rtt, now
+	}
+}
+
+//Max filter of the delivery rate samples
+func (cc *congestion) updateBw(bw float64, now time.Time) {
+	window := cc.rtt() * time.Duration(CCBWROUNDS)
+	samples := []ccSample{}
+	for _, s := range cc.samples {
+		if now.Sub(s.time) < window {
+			samples = append(samples, s)
+		}
+	}
+	cc.samples = append(samples, ccSample{time: now, bw: bw})
+
+	cc.btlBw = 0
+	for _, s := range cc.samples {
+		if s.bw > cc.btlBw {
+			cc.btlBw = s.bw
+		}
+	}
+}
+
+//One step of the mode machine every round trip
+func (cc *congestion) updateMode(now time.Time) {
+	if now.Sub(cc.roundStart) < cc.rtt() {
+		return
+	}
+	cc.roundStart = now
+
+	switch cc.mode {
+	case CCSTARTUP:
+		if cc.btlBw >= cc.fullBw*1.25 {
+			cc.fullBw, cc.fullRounds = cc.btlBw, 0
+		} else if cc.fullRounds++; cc.fullRounds >= 3 {
+			cc.mode = CCDRAIN
+		}
+	case CCDRAIN:
+		if float64(cc.inflight) <= cc.bdp() {
+			cc.mode, cc.cycle = CCPROBE, 0
+		}
+	case CCPROBE:
+		cc.cycle = (cc.cycle + 1) % len(ccProbeGains)
+	}
+}
+
+func (cc *congestion) rtt() time.Duration {
+	if cc.minRtt == 0 {
+		return time.Millisecond * time.Duration(CCINITRTT)
+	}
+	return cc.minRtt
+}
+
+//At least the min window per round trip
+func (cc *congestion) bandwidth() float64 {
+	if cc.btlBw == 0 {
+		return float64(CCINITRATE)
+	}
+	if min := float64(CCMINCWND) / cc.rtt().Seconds(); cc.btlBw < min {
+		return min
+	}
+	return cc.btlBw
+}
+
+//Bandwidth-delay product in bytes
+func (cc *congestion) bdp() float64 {
+	return cc.bandwidth() * cc.rtt().Seconds()
+}
+
+//Pacing rate in bytes/s
+func (cc *congestion) pacingRate() float64 {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	switch cc.mode {
+	case CCSTARTUP:
+		return cc.bandwidth() * ccStartupGain
+	case CCDRAIN:
+		return cc.bandwidth() / ccStartupGain
+	default:
+		return cc.bandwidth() * ccProbeGains[cc.cycle]
+	}
+}
+
+//Max bytes in flight, cc.mu is held
+func (cc *congestion) cwnd() float64 {
+	gain := 2.0
+	if cc.mode == CCSTARTUP {
+		gain = ccStartupGain
+	}
+	if w := gain * cc.bdp(); w > float64(CCMINCWND) {
+		return w
+	}
+	return float64(CCMINCWND)
+}
+
+//Block while the congestion window is full
+func (cc *congestion) wait(cancel <-chan struct{}, done <-chan struct{}) error {
+	stall := time.NewTimer(time.Millisecond * time.Duration(CCMAXSTALL))
+	defer stall.Stop()
+	for {
+		cc.mu.Lock()
+		full := float64(cc.inflight) >= cc.cwnd()
+		if full {
+			cc.busy = true
+		}
+		cc.mu.Unlock()
+		if !full {
+			return nil
+		}
+
+		select {
+		case <-cc.fbEvent:
+		case <-stall.C:
+			return nil
+		case <-cancel:
+			return &timeoutError{}
+		case <-done:
+			return io.EOF
+		}
+	}
+}
+
+func (cc *congestion) setBusy() {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.busy = true
+}
+
+//Count a received data packet, returns true if a feedback is due
+func (cc *congestion) received(seq uint32, n int) bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.rcvBytes == 0 || seqLess(cc.rcvHighest, seq) {
+		cc.rcvHighest = seq
+	}
+	cc.rcvBytes += uint32(n)
+	cc.rcvPackets++
+	return cc.rcvPackets >= CCFEEDBACKPACKETS || time.Since(cc.lastFeedback) >= time.Millisecond*time.Duration(CCFEEDBACKINTERVAL)
+}
+
+//Value of the feedback option
+func (cc *congestion) feedback() []byte {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.lastFeedback, cc.rcvPackets = time.Now(), 0
+	v := make([]byte, CCOPTIONLEN)
+	binary.BigEndian.PutUint32(v, cc.rcvBytes)
+	binary.BigEndian.PutUint32(v[4:], cc.rcvHighest)
+	return v
+}
+
+func (cc *congestion) getStats() (float64, time.Duration) {
+	rate := cc.pacingRate()
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return rate, cc.minRtt
+}
+
+//rateLimiter spaces the packets at a rate in bytes/s
+type rateLimiter struct {
+	mu   sync.Mutex
+	next time.Time
+}
+
+//Delay before n bytes may be sent
+func (r *rateLimiter) reserve(n int, rate float64) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if earliest := now.Add(-PACINGBURST); r.next.Before(earliest) {
+		r.next = earliest
+	}
+	delay := r.next.Sub(now)
+	r.next = r.next.Add(time.Duration(float64(n) / rate * float64(time.Second)))
+	return delay
+}
+
+//Block until the packet of n payload bytes fits in the congestion window and the rate limits
+func (conn *Conn) pace(n int, cancel <-chan struct{}) error {
+	if conn.cc != nil {
+		if err := conn.cc.wait(cancel, conn.done); err != nil {
+			return err
+		}
+	}
+
+	var delay time.Duration
+	rate := float64(conn.cfg.MaxRate)
+	if conn.cc != nil {
+		if r := conn.cc.pacingRate(); rate == 0 || r < rate {
+			rate = r
+		}
+	}
+	if rate > 0 {
+		delay = conn.limiter.reserve(n, rate)
+	}
+	if rate := conn.stack.cfg.MaxRate; rate > 0 {
+		if d := conn.stack.limiter.reserve(n, float64(rate)); d > delay {
+			delay = d
+		}
+	}
+	if delay < PACINGQUANTUM {
+		return nil
+	}
+
+	if conn.cc != nil {
+		conn.cc.setBusy()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-cancel:
+		return &timeoutError{}
+	case <-conn.done:
+		return io.EOF
+	}
+}
+
+//Options of the pure ACKs: the congestion feedback
+func (conn *Conn) ackOptions() []byte {
+	options := []byte{}
+	if conn.cc != nil {
+		options = appendExpOption(options, EXPRATE, conn.cc.feedback())
+	}
+	return options
+}
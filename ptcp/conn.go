@@ -1,9 +1,12 @@
 package ptcp
 
 import (
+	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/xitongsys/ethernet-go/header"
@@ -12,6 +15,9 @@ import (
 var CONNCHANBUFSIZE = 1024
 var CONNTIMEOUT = 60
 
+//Default time in ms an out-of-order packet waits for the missing ones
+var REORDERTIMEOUT = 100
+
 const (
 	CONNECTING = iota
 	CONNECTED
@@ -19,108 +25,697 @@ const (
 	CLOSED
 )
 
+//Options of a conn
+type ConnConfig struct {
+	//Use the sequence numbers to drop duplicated and late packets.
+	//Both sides must enable it, older peers send every packet with the same sequence number.
+	Sequencing bool
+	//Max number of packets held back to restore the order, 0 disables reordering
+	ReorderWindow int
+	//Max time in ms a packet is held back, REORDERTIMEOUT if 0
+	ReorderTimeout int
+
+	//Retransmit the lost data packets. It's negotiated in the handshake,
+	//the conn stays unreliable if the peer doesn't enable it.
+	Reliable bool
+	//Max number of unacknowledged packets in reliable mode, RELIABLEWINDOW if 0
+	SendWindow int
+	//Max retransmissions of a packet before the conn is closed, MAXRETRANSMIT if 0
+	MaxRetransmit int
+
+	//Send FECParity Reed-Solomon parity packets after every FECData data packets,
+	//so the receiver rebuilds lost packets without a round trip. It's negotiated in the handshake
+	//and implies Sequencing with a reorder window of at least two groups.
+	FECData   int
+	FECParity int
+
+	//Encrypt the payloads with AES-256-GCM, the keys come from an X25519 exchange in the handshake.
+	//It implies Sequencing. A listener with Encrypt refuses the cleartext dialers, a dialer with Encrypt the cleartext listeners.
+	Encrypt bool
+	//Mixed in the keys of the encrypted conns, so the peer is authenticated. Both sides must have the same PSK,
+	//otherwise every packet is dropped. Without PSK the exchange is open to a man in the middle.
+	PSK []byte
+
+	//If set, the dialer signs its SYN with HMAC-SHA256 over a nonce, the time, the addresses and the options.
+	//A listener with AuthKey silently drops the SYNs without a valid signature, the expired and the replayed ones.
+	AuthKey []byte
+
+	//Listener only. Answer the SYNs with SYN cookies, so no state is kept until the final ACK.
+	//The dialers must echo their SYN options in the final ACK, which older dialers don't do.
+	SynCookies bool
+	//Listener only. Max pending handshakes without SynCookies, LISTENERMAXPENDING if 0. The other SYNs are dropped
+	MaxPending int
+	//Listener only. Max SYN-ACKs re-sent per second without SynCookies, LISTENERRESENDRATE if 0
+	ResendRate int
+
+	//Make the segments look like a TCP flow: random ISNs, seq/ack counting the payload bytes,
+	//MSS, SACK permitted, window scale and timestamps options in the SYNs and plausible windows.
+	//It's negotiated in the handshake, both sides must enable it.
+	Mimicry bool
+
+	//Read returns the payloads as a byte stream: the rest of a packet larger than the buffer
+	//is returned by the next Reads. Otherwise each Read returns one packet and drops the bytes
+	//that don't fit, see ReadMsg. It's local, the peer's mode doesn't matter. See also SetStream.
+	Stream bool
+
+	//Pace the data packets with a BBR-like congestion control, driven by the feedback of the receiver
+	//in its ACKs. It's negotiated in the handshake, both sides must enable it.
+	Congestion bool
+	//Max payload bytes per second sent by the conn, 0 for no limit. It's local, not negotiated.
+	MaxRate int
+
+	//Max TCP payload announced to the peer, for the links whose path has a lower MTU than the interface.
+	//The MSS of the link if 0. The conn uses the min of both sides, lowered by the ICMP messages of the path.
+	MSS int
+	//Write sends the buffers longer than MaxPayload in several packets, the peer should read in Stream mode.
+	//Otherwise Write returns a PayloadSizeError.
+	Split bool
+}
+
+//Fill the defaults
+func (cfg ConnConfig) normalize() ConnConfig {
+	if cfg.ReorderTimeout <= 0 {
+		cfg.ReorderTimeout = REORDERTIMEOUT
+	}
+	if cfg.SendWindow <= 0 {
+		cfg.SendWindow = RELIABLEWINDOW
+	}
+	//Packets are delivered in one batch, they must fit in InputChan
+	if cfg.SendWindow > CONNCHANBUFSIZE/2 {
+		cfg.SendWindow = CONNCHANBUFSIZE / 2
+	}
+	if cfg.MaxRetransmit <= 0 {
+		cfg.MaxRetransmit = MAXRETRANSMIT
+	}
+	if cfg.MaxPending <= 0 {
+		cfg.MaxPending = LISTENERMAXPENDING
+	}
+	if cfg.ResendRate <= 0 {
+		cfg.ResendRate = LISTENERRESENDRATE
+	}
+	return cfg
+}
+
 type Conn struct {
+	stack         *Stack
+	cfg           ConnConfig
 	localAddress  *Addr
 	remoteAddress *Addr
 	InputChan     chan string
 	OutputChan    chan string
-	State         int
-	LastUpdate    time.Time
+	//CONNECTING to CLOSED, see State. The negotiated fields are set before it's CONNECTED.
+	state int32
+	//Unix time in ns of the last ACK received
+	lastUpdate int64
+
+	readDeadline  *deadline
+	writeDeadline *deadline
+	done          chan struct{}
+	closeOnce     sync.Once
+
+	//Sequence number of the next data packet
+	sndNxt uint32
+	//Sequence number of the SYN, the data packets start after it
+	sndIsn uint32
+	recv   *recvWindow
+	//Unacknowledged packets, only in reliable mode
+	snd *sendBuffer
+	//The dialed conns own their local port and RST filter entry, the accepted ones use their listener's
+	dialed bool
+	//Final ACK of the dialer, sent again if the SYN-ACK is repeated
+	finalAck string
+	//Set once the dialer gets a packet of the listener after the final ACK
+	answered int32
+	//Only in FEC mode
+	fecEnc *fecEncoder
+	fecDec *fecDecoder
+	//Held from the seq allocation to the FEC encoder, so the groups follow the seq order
+	fecMu sync.Mutex
+	//Only in encrypted mode
+	aead       *connAead
+	authFailed uint64
+	//Only in mimicry mode
+	mimic *mimicState
+
+	//Serializes the reads. Rest of the packet partially read in stream mode
+	readMu   sync.Mutex
+	leftover []byte
+	stream   uint32
+	//Only for the conns of a PacketConn
+	packetConn *PacketConn
+	//Only in congestion mode
+	cc      *congestion
+	limiter rateLimiter
+	pmtu    pathMTU
 }
 
-func NewConn(localAddr string, remoteAddr string, state int) *Conn {
+func NewConn(stack *Stack, cfg *ConnConfig, localAddr string, remoteAddr string, state int) *Conn {
+	conn := newConn(stack, cfg, localAddr, remoteAddr, state, make(chan string, CONNCHANBUFSIZE), stack.output)
+	go conn.keepAlive()
+	return conn
+}
+
+//Conn without its keepalive goroutine, on the given channels
+func newConn(stack *Stack, cfg *ConnConfig, localAddr string, remoteAddr string, state int, input chan string, output chan string) *Conn {
 	conn := &Conn{
+		stack:         stack,
+		cfg:           cfg.normalize(),
 		localAddress:  NewAddr(localAddr),
 		remoteAddress: NewAddr(remoteAddr),
-		InputChan:     make(chan string, CONNCHANBUFSIZE),
-		OutputChan:    make(chan string, CONNCHANBUFSIZE),
-		State:         state,
-		LastUpdate:    time.Now(),
+		InputChan:     input,
+		OutputChan:    output,
+		state:         int32(state),
+		lastUpdate:    time.Now().UnixNano(),
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+		done:          make(chan struct{}),
+		sndNxt:        1,
 	}
-	go conn.keepAlive()
+	conn.recv = newRecvWindow(1, conn.cfg.ReorderWindow, time.Millisecond*time.Duration(conn.cfg.ReorderTimeout))
+	conn.SetStream(conn.cfg.Stream)
 	return conn
 }
 
+//Apply the options negotiated in the handshake, before the conn is CONNECTED.
+//rcvNxt is the sequence number of the first data packet from the peer.
+func (conn *Conn) establish(h *hello, rcvNxt uint32) error {
+	remote := conn.RemoteAddr().String()
+	mss := conn.stack.mss(&conn.cfg, remote)
+	if h.mss > 0 && h.mss < mss {
+		mss = h.mss
+	}
+	conn.pmtu.init(mss + ipHeaderLen(remote) + TCPHEADERLEN)
+
+	if h.sendKey != nil {
+		aead, err := newConnAead(h.sendKey, h.recvKey)
+		if err != nil {
+			return err
+		}
+		conn.aead = aead
+		conn.cfg.Sequencing, conn.cfg.Encrypt = true, true
+
+	} else {
+		conn.cfg.Encrypt = false
+	}
+
+	if h.fecData > 0 {
+		conn.cfg.Sequencing = true
+		if w := 2 * (h.fecData + h.fecParity); conn.cfg.ReorderWindow < w {
+			conn.cfg.ReorderWindow = w
+		}
+		conn.fecEnc = newFecEncoder(h.fecData, h.fecParity)
+		conn.fecDec = newFecDecoder()
+		go conn.flushFec()
+
+	} else {
+		conn.cfg.FECData, conn.cfg.FECParity = 0, 0
+	}
+
+	if h.mimic {
+		conn.mimic = newMimicState(conn.sndIsn, rcvNxt-1)
+
+	} else {
+		conn.cfg.Mimicry = false
+	}
+
+	if h.congestion {
+		conn.cc = newCongestion()
+
+	} else {
+		conn.cfg.Congestion = false
+	}
+
+	conn.recv = newRecvWindow(rcvNxt, conn.cfg.ReorderWindow, conn.recv.timeout)
+	if h.reliable {
+		conn.cfg.Sequencing = true
+		conn.snd = newSendBuffer(h.window, conn.cfg.MaxRetransmit)
+		conn.recv.size, conn.recv.reliable = h.window, true
+		go conn.retransmit()
+
+	} else {
+		conn.cfg.Reliable = false
+		if conn.cfg.Sequencing && conn.cfg.ReorderWindow > 0 {
+			go conn.flushReorder()
+		}
+	}
+	return nil
+}
+
+//CONNECTING, CONNECTED, CLOSING or CLOSED
+func (conn *Conn) State() int {
+	return int(atomic.LoadInt32(&conn.state))
+}
+
+func (conn *Conn) setState(state int) {
+	atomic.StoreInt32(&conn.state, int32(state))
+}
+
+//Whether the reliable mode was granted in the handshake
+func (conn *Conn) Reliable() bool {
+	return conn.snd != nil
+}
+
+func (conn *Conn) Stats() ConnStats {
+	stats := conn.recv.getStats()
+	if conn.snd != nil {
+		stats.Retransmitted = conn.snd.getRetransmitted()
+	}
+	if conn.fecDec != nil {
+		stats.Recovered = conn.fecDec.getRecovered()
+	}
+	stats.AuthFailed = atomic.LoadUint64(&conn.authFailed)
+	if conn.cc != nil {
+		rate, rtt := conn.cc.getStats()
+		stats.PacingRate, stats.MinRTT = uint64(rate), rtt
+	}
+	return stats
+}
+
+//Called by the stack for every packet of the conn
+func (conn *Conn) input(packet string, sg *segment) {
+	state := conn.State()
+	if state == CONNECTING {
+		//The dialer reads the SYN-ACK from InputChan, the conn isn't established yet
+		trySend(conn.InputChan, packet)
+		return
+	}
+
+	if conn.mimic != nil {
+		conn.mimic.input(sg)
+	}
+
+	if sg.flags == header.FIN {
+		if conn.packetConn != nil {
+			conn.packetConn.closeConn(conn, header.FIN|header.ACK)
+			return
+		}
+		go conn.CloseResponse()
+
+	} else if sg.flags&header.ACK > 0 {
+		conn.UpdateTime()
+		if option, ok := sg.expOption(EXPRATE); ok && conn.cc != nil && len(option) == CCOPTIONLEN {
+			conn.cc.onFeedback(binary.BigEndian.Uint32(option), binary.BigEndian.Uint32(option[4:]))
+		}
+		if conn.snd != nil {
+			sack, _ := sg.option(TCPOPTSACK)
+			for _, p := range conn.snd.onAck(sg.ack, parseSack(sack)) {
+				trySend(conn.OutputChan, p)
+			}
+		}
+	}
+
+	if state != CONNECTED {
+		//The closing handshakes read the control packets from InputChan
+		trySend(conn.InputChan, packet)
+		return
+	}
+
+	//The listener didn't get the final ACK
+	if sg.flags&header.SYN != 0 {
+		if conn.finalAck != "" {
+			trySend(conn.OutputChan, conn.finalAck)
+		}
+		return
+	}
+	atomic.StoreInt32(&conn.answered, 1)
+
+	//Data packets always have PSH, the final ACK echoing the SYN options doesn't
+	if len(sg.data) == 0 || sg.flags&header.PSH == 0 {
+		return
+	}
+
+	if conn.fecDec == nil {
+		conn.inputData(packet, sg.seq, sg.data)
+		return
+	}
+
+	if option, ok := sg.expOption(EXPFEC); ok {
+		conn.inputRecovered(conn.fecDec.addParity(option, sg.data))
+		return
+	}
+	recovered := conn.fecDec.addData(sg.seq, sg.data)
+	conn.inputData(packet, sg.seq, sg.data)
+	conn.inputRecovered(recovered)
+}
+
+func (conn *Conn) inputData(packet string, seq uint32, data []byte) {
+	if conn.aead != nil {
+		//The forged packets are dropped before they touch the sequence state
+		plaintext, err := conn.aead.open(seq, data)
+		if err != nil {
+			atomic.AddUint64(&conn.authFailed, 1)
+			return
+		}
+		packet = string(buildPacket(conn.RemoteAddr().String(), conn.LocalAddr().String(), seq, 0, header.PSH|header.ACK, plaintext))
+	}
+
+	//The reliable conns send the feedback in the ACK of every packet
+	if conn.cc != nil && conn.cc.received(seq, len(data)) && conn.snd == nil {
+		conn.sendPureAck()
+	}
+
+	if !conn.cfg.Sequencing {
+		trySend(conn.InputChan, packet)
+		return
+	}
+
+	if conn.snd != nil && cap(conn.InputChan)-len(conn.InputChan) < conn.recv.size {
+		//Not enough room to deliver a whole window, the packet will be retransmitted
+		return
+	}
+
+	for _, p := range conn.recv.push(seq, packet) {
+		trySend(conn.InputChan, p)
+	}
+
+	if conn.snd != nil {
+		conn.sendAck(seq)
+	}
+}
+
+//Data packets rebuilt by FEC are handled as if they were received
+func (conn *Conn) inputRecovered(recovered []fecRecovered) {
+	for _, r := range recovered {
+		packet := buildPacket(conn.RemoteAddr().String(), conn.LocalAddr().String(), r.seq, 0, header.PSH|header.ACK, r.payload)
+		conn.inputData(string(packet), r.seq, r.payload)
+	}
+}
+
+//ACK with the SACK blocks, sent for every data packet in reliable mode
+func (conn *Conn) sendAck(latest uint32) {
+	ack, blocks := conn.recv.ackState(latest)
+	options := conn.ackOptions()
+	//The blocks share the option space with the others
+	room := TCPOPTMAXLEN - len(options) - 2
+	if conn.mimic != nil {
+		room -= TIMESTAMPOPTLEN
+	}
+	if n := room / 8; len(blocks) > n {
+		blocks = blocks[:n]
+	}
+	if len(blocks) > 0 {
+		options = appendOption(options, TCPOPTSACK, marshalSack(blocks))
+	}
+	packet := conn.packet(atomic.LoadUint32(&conn.sndNxt), ack, header.ACK, options, []byte{})
+	trySend(conn.OutputChan, string(packet))
+}
+
+func (conn *Conn) retransmit() {
+	ticker := time.NewTicker(time.Millisecond * time.Duration(ARQINTERVAL))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-conn.done:
+			return
+		case <-ticker.C:
+		}
+
+		packets, err := conn.snd.expired(time.Now())
+		if err != nil {
+			conn.snd.clear()
+			go conn.Close()
+			return
+		}
+		for _, p := range packets {
+			trySend(conn.OutputChan, p)
+		}
+	}
+}
+
+//Send the parity packets of the groups which are not completed in time
+func (conn *Conn) flushFec() {
+	ticker := time.NewTicker(time.Millisecond * time.Duration(FECFLUSHINTERVAL) / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-conn.done:
+			return
+		case <-ticker.C:
+		}
+
+		parity, err := conn.fecEnc.flush(time.Now())
+		if err == nil {
+			conn.sendParity(parity)
+		}
+	}
+}
+
+func (conn *Conn) sendParity(parity []fecParity) {
+	for _, p := range parity {
+		options := appendExpOption([]byte{}, EXPFEC, p.option)
+		packet := conn.packet(atomic.LoadUint32(&conn.sndNxt), conn.recv.nextSeq(), header.PSH|header.ACK, options, p.payload)
+		trySend(conn.OutputChan, string(packet))
+	}
+}
+
+//Deliver the held back packets whose missing predecessors never came
+func (conn *Conn) flushReorder() {
+	ticker := time.NewTicker(conn.recv.timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-conn.done:
+			return
+		case <-ticker.C:
+		}
+
+		for _, p := range conn.recv.flush() {
+			trySend(conn.InputChan, p)
+		}
+	}
+}
+
 func (conn *Conn) UpdateTime() {
-	conn.LastUpdate = time.Now()
+	atomic.StoreInt64(&conn.lastUpdate, time.Now().UnixNano())
+}
+
+//Time since the last ACK
+func (conn *Conn) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&conn.lastUpdate)))
 }
 
 func (conn *Conn) IsTimeout() bool {
-	now := time.Now()
-	return now.Sub(conn.LastUpdate) > time.Second*time.Duration(CONNTIMEOUT)
+	return conn.idle() > time.Second*time.Duration(CONNTIMEOUT)
+}
+
+//Pure ACKs don't consume a sequence number
+func (conn *Conn) sendPureAck() {
+	packet := conn.packet(atomic.LoadUint32(&conn.sndNxt), conn.recv.nextSeq(), header.ACK, conn.ackOptions(), []byte{})
+	trySend(conn.OutputChan, string(packet))
 }
 
 func (conn *Conn) keepAlive() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 	for {
-		if conn.State == CLOSED || conn.State == CLOSING {
+		if state := conn.State(); state == CLOSED || state == CLOSING {
 			return
 
-		} else if conn.State == CONNECTED {
-			ipHeader, tcpHeader := header.BuildTcpHeader(conn.LocalAddr().String(), conn.RemoteAddr().String())
-			tcpHeader.Flags = header.ACK
-			tcpHeader.Ack = 1
-			tcpHeader.Seq = 1
+		} else if state == CONNECTED {
+			conn.sendPureAck()
+		}
 
-			packet := header.BuildTcpPacket(ipHeader, tcpHeader, []byte{})
-			conn.OutputChan <- string(packet)
+		select {
+		case <-conn.done:
+			return
+		case <-conn.stack.done:
+			return
+		case <-ticker.C:
 		}
-		time.Sleep(time.Second)
 	}
 }
 
-//Block
+//Block until data arrives or the read deadline is exceeded.
+//In stream mode it returns the rest of the last packet first, otherwise it's ReadMsg without the truncation flag.
 func (conn *Conn) Read(b []byte) (n int, err error) {
+	if atomic.LoadUint32(&conn.stream) == 0 {
+		n, _, err = conn.ReadMsg(b)
+		return n, err
+	}
+
 	defer func() {
 		if r := recover(); r != nil {
-			n, err = -1, io.EOF
+			n, err = 0, io.EOF
 		}
 	}()
-	if conn.State != CONNECTED {
-		return -1, io.EOF
-	}
+	conn.readMu.Lock()
+	defer conn.readMu.Unlock()
 
-	for {
-		s, ok := <-conn.InputChan
-		if !ok {
-			return -1, io.EOF
+	if len(conn.leftover) == 0 {
+		data, err := conn.readPayload()
+		if err != nil {
+			return 0, err
 		}
+		conn.leftover = data
+	}
+	n = copy(b, conn.leftover)
+	conn.leftover = conn.leftover[n:]
+	return n, nil
+}
 
-		_, _, _, _, data, _ := header.Get([]byte(s))
-		ls, ln := len(data), len(b)
-		if ls < 0 {
-			continue
+//ReadMsg blocks until a packet arrives or the read deadline is exceeded and copies its payload to b.
+//truncated is true if the payload is larger than b, the rest is dropped.
+func (conn *Conn) ReadMsg(b []byte) (n int, truncated bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			n, truncated, err = 0, false, io.EOF
 		}
+	}()
+	conn.readMu.Lock()
+	defer conn.readMu.Unlock()
+
+	//The rest of a packet partially read in stream mode
+	data := conn.leftover
+	conn.leftover = nil
+	if len(data) == 0 {
+		if data, err = conn.readPayload(); err != nil {
+			return 0, false, err
+		}
+	}
+	n = copy(b, data)
+	return n, n < len(data), nil
+}
+
+//Switch the Read semantics of the conn, see ConnConfig.Stream
+func (conn *Conn) SetStream(stream bool) {
+	v := uint32(0)
+	if stream {
+		v = 1
+	}
+	atomic.StoreUint32(&conn.stream, v)
+}
 
-		l := ls
-		if ln < ls {
-			l = ln
+//Payload of the next data packet
+func (conn *Conn) readPayload() ([]byte, error) {
+	if conn.State() != CONNECTED {
+		return nil, io.EOF
+	}
+
+	for {
+		var s string
+		select {
+		case s = <-conn.InputChan:
+		case <-conn.done:
+			return nil, io.EOF
+		case <-conn.readDeadline.wait():
+			return nil, &timeoutError{}
 		}
-		for i := 0; i < l; i++ {
-			b[i] = data[i]
+
+		sg, err := parseSegment([]byte(s))
+		//Keepalive, or handshake packet queued before the conn was established. The data packets always have PSH.
+		if err != nil || len(sg.data) == 0 || sg.flags&(header.SYN|header.RST|header.FIN) != 0 || sg.flags&header.PSH == 0 {
+			continue
 		}
-		return ls, nil
+		return sg.data, nil
 	}
 }
 
-//Block
+//Block until the packet is queued or the write deadline is exceeded
 func (conn *Conn) Write(b []byte) (n int, err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			n, err = -1, io.EOF
+			n, err = 0, io.EOF
 		}
 	}()
-	if conn.State != CONNECTED {
-		return -1, io.EOF
+	//The OutputChan is the stack's, it stays open after the conn is closed
+	if conn.State() != CONNECTED || isClosedChan(conn.done) {
+		return 0, io.EOF
+	}
+
+	cancel := conn.writeDeadline.wait()
+	if isClosedChan(cancel) {
+		return 0, &timeoutError{}
+	}
+
+	max := conn.MaxPayload()
+	if len(b) <= max {
+		if err := conn.writePacket(b, cancel); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if !conn.cfg.Split {
+		return 0, &PayloadSizeError{Size: len(b), Max: max}
+	}
+
+	for n < len(b) {
+		end := n + max
+		if end > len(b) {
+			end = len(b)
+		}
+		if err := conn.writePacket(b[n:end], cancel); err != nil {
+			return n, err
+		}
+		n = end
+	}
+	return n, nil
+}
+
+//Send b in one data packet
+func (conn *Conn) writePacket(b []byte, cancel <-chan struct{}) error {
+	if conn.snd != nil {
+		if err := conn.snd.wait(cancel, conn.done); err != nil {
+			return err
+		}
 	}
 
-	ipHeader, tcpHeader := header.BuildTcpHeader(conn.LocalAddr().String(), conn.RemoteAddr().String())
-	tcpHeader.Flags = 0x18
-	tcpHeader.Ack = 1
-	tcpHeader.Seq = 1
+	if err := conn.pace(len(b), cancel); err != nil {
+		return err
+	}
+
+	if conn.fecEnc != nil {
+		conn.fecMu.Lock()
+	}
+	seq, err := conn.nextSndSeq()
+	if err != nil {
+		if conn.fecEnc != nil {
+			conn.fecMu.Unlock()
+		}
+		return err
+	}
+	payload := b
+	if conn.aead != nil {
+		payload = conn.aead.seal(seq, b)
+	}
+	//The packet is in its group even if the send is cancelled below, the receiver may rebuild it
+	var parity []fecParity
+	if conn.fecEnc != nil {
+		if p, err := conn.fecEnc.add(seq, payload); err == nil {
+			parity = p
+		}
+		conn.fecMu.Unlock()
+	}
+	packet := conn.packet(seq, conn.recv.nextSeq(), header.PSH|header.ACK, nil, payload)
+	if conn.cc != nil {
+		conn.cc.onSend(seq, len(payload))
+	}
+	if conn.snd != nil {
+		conn.snd.add(seq, string(packet))
+	}
+	select {
+	case conn.OutputChan <- string(packet):
+	case <-cancel:
+		err = &timeoutError{}
+	}
+	//Even after a cancelled send, they protect the other packets of the group
+	conn.sendParity(parity)
+	return err
+}
 
-	packet := header.BuildTcpPacket(ipHeader, tcpHeader, b)
-	conn.OutputChan <- string(packet)
-	return len(b), nil
+//Sequence number of the next data packet. It never wraps in encrypted mode, since it's the nonce.
+func (conn *Conn) nextSndSeq() (uint32, error) {
+	if conn.aead == nil {
+		return atomic.AddUint32(&conn.sndNxt, 1) - 1, nil
+	}
+	for {
+		seq := atomic.LoadUint32(&conn.sndNxt)
+		if seq == conn.sndIsn {
+			return 0, fmt.Errorf("sequence numbers exhausted, the conn must be reopened")
+		}
+		if atomic.CompareAndSwapUint32(&conn.sndNxt, seq, seq+1) {
+			return seq, nil
+		}
+	}
 }
 
 //NoBlock
@@ -133,16 +728,7 @@ func (conn *Conn) ReadWithHeader(b []byte) (n int, err error) {
 
 	select {
 	case s := <-conn.InputChan:
-		data := []byte(s)
-		ls, ln := len(data), len(b)
-		l := ls
-		if ln < ls {
-			l = ln
-		}
-		for i := 0; i < l; i++ {
-			b[i] = data[i]
-		}
-		return ls, nil
+		return copy(b, s), nil
 	default:
 		return 0, fmt.Errorf("failed")
 	}
@@ -155,6 +741,9 @@ func (conn *Conn) WriteWithHeader(b []byte) (n int, err error) {
 			n, err = -1, io.EOF
 		}
 	}()
+	if isClosedChan(conn.done) {
+		return -1, io.EOF
+	}
 
 	select {
 	case conn.OutputChan <- string(b):
@@ -165,20 +754,20 @@ func (conn *Conn) WriteWithHeader(b []byte) (n int, err error) {
 }
 
 func (conn *Conn) CloseRequest() (err error) {
-	if conn.State != CONNECTED {
+	if conn.State() != CONNECTED {
 		return nil
 	}
 
-	defer func() {
-		conn.State = CLOSED
-	}()
+	//Give the unacknowledged packets a chance to be delivered
+	if conn.snd != nil {
+		conn.snd.waitEmpty(time.Millisecond*time.Duration(RTOMAX), conn.done)
+	}
 
-	conn.State = CLOSING
-	ipHeader, tcpHeader := header.BuildTcpHeader(conn.LocalAddr().String(), conn.RemoteAddr().String())
-	tcpHeader.Seq = 1
-	tcpHeader.Ack = 1
-	tcpHeader.Flags = header.FIN
-	packet := header.BuildTcpPacket(ipHeader, tcpHeader, []byte{})
+	if !atomic.CompareAndSwapInt32(&conn.state, CONNECTED, CLOSING) {
+		return nil
+	}
+	defer conn.setState(CLOSED)
+	packet := conn.packet(1, 1, header.FIN, nil, []byte{})
 
 	done := make(chan int)
 	go func() {
@@ -198,8 +787,7 @@ func (conn *Conn) CloseRequest() (err error) {
 	timeOut := false
 	for !timeOut {
 		if n, err := conn.ReadWithHeader(buf); n > 0 && err == nil {
-			_, _, _, tcpHeader, _, _ := header.Get(buf[:n])
-			if tcpHeader.Flags == (header.ACK|header.FIN) && tcpHeader.Ack == 1 {
+			if sg, err := conn.parseControl(buf[:n]); err == nil && sg.flags == (header.ACK|header.FIN) && sg.ack == 1 {
 				close(done)
 				break
 			}
@@ -217,32 +805,24 @@ func (conn *Conn) CloseRequest() (err error) {
 		return err
 	}
 
-	ipHeader, tcpHeader = header.BuildTcpHeader(conn.LocalAddr().String(), conn.RemoteAddr().String())
-	tcpHeader.Seq = 1
-	tcpHeader.Ack = 1
-	tcpHeader.Flags = header.ACK
-	packet = header.BuildTcpPacket(ipHeader, tcpHeader, []byte{})
-	conn.WriteWithHeader(packet)
+	//packet may still be read by the FIN sender
+	ack := conn.packet(1, 1, header.ACK, nil, []byte{})
+	conn.WriteWithHeader(ack)
 
 	return nil
 }
 
 func (conn *Conn) CloseResponse() (err error) {
-	if conn.State != CONNECTED {
+	if !atomic.CompareAndSwapInt32(&conn.state, CONNECTED, CLOSING) {
 		return nil
 	}
 
 	defer func() {
-		conn.State = CLOSED
+		conn.setState(CLOSED)
 		conn.Close()
 	}()
-	conn.State = CLOSING
 
-	ipHeader, tcpHeader := header.BuildTcpHeader(conn.LocalAddr().String(), conn.RemoteAddr().String())
-	tcpHeader.Seq = 1
-	tcpHeader.Ack = 1
-	tcpHeader.Flags = header.FIN | header.ACK
-	packet := header.BuildTcpPacket(ipHeader, tcpHeader, []byte{})
+	packet := conn.packet(1, 1, header.FIN|header.ACK, nil, []byte{})
 
 	done := make(chan int)
 	go func() {
@@ -262,8 +842,7 @@ func (conn *Conn) CloseResponse() (err error) {
 	timeOut := false
 	for !timeOut {
 		if n, err := conn.ReadWithHeader(buf); n > 0 && err == nil {
-			_, _, _, tcpHeader, _, _ := header.Get(buf[:n])
-			if tcpHeader.Flags == header.ACK && tcpHeader.Ack == 1 {
+			if sg, err := conn.parseControl(buf[:n]); err == nil && sg.flags == header.ACK && sg.ack == 1 {
 				close(done)
 				break
 			}
@@ -280,22 +859,22 @@ func (conn *Conn) CloseResponse() (err error) {
 }
 
 func (conn *Conn) Close() error {
-	conn.CloseRequest()
-	key := conn.LocalAddr().String() + ":" + conn.RemoteAddr().String()
-	ptcpServer.CloseConn(key)
+	if conn.packetConn != nil {
+		conn.packetConn.closeConn(conn, header.FIN)
+		return nil
+	}
 
-	go func() {
-		defer func() {
-			recover()
-		}()
-		close(conn.InputChan)
-	}()
-	go func() {
-		defer func() {
-			recover()
-		}()
-		close(conn.OutputChan)
-	}()
+	conn.CloseRequest()
+	conn.closeOnce.Do(func() {
+		close(conn.done)
+		if conn.dialed {
+			conn.stack.removeRSTFilter(conn.LocalAddr().String(), conn.RemoteAddr().String())
+			conn.stack.ports.release(conn.LocalAddr().String())
+		}
+	})
+	key := connKey(conn.LocalAddr().String(), conn.RemoteAddr().String())
+	conn.stack.CloseConn(key)
+	//InputChan stays open, the stack may still be sending to it. The readers wait on done.
 	return nil
 }
 
@@ -308,13 +887,17 @@ func (conn *Conn) RemoteAddr() net.Addr {
 }
 
 func (conn *Conn) SetDeadline(t time.Time) error {
+	conn.readDeadline.set(t)
+	conn.writeDeadline.set(t)
 	return nil
 }
 
 func (conn *Conn) SetReadDeadline(t time.Time) error {
+	conn.readDeadline.set(t)
 	return nil
 }
 
 func (conn *Conn) SetWriteDeadline(t time.Time) error {
+	conn.writeDeadline.set(t)
 	return nil
 }
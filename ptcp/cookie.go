@@ -0,0 +1,83 @@
+package ptcp
+
+import (
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+)
+
+//Length in seconds of the time slots of the SYN cookies, a cookie is valid during its slot and the next one
+var COOKIESLOT = 64
+
+//The cookie is the ISN of the listener: slot (5 bits) + mac (27 bits)
+const (
+	COOKIESLOTBITS = 5
+	COOKIEMACMASK  = 1<<(32-COOKIESLOTBITS) - 1
+)
+
+//cookieJar makes and checks the SYN cookies of a listener, so it keeps no state per SYN.
+//The dialer echoes its SYN payload in the final ACK, the cookie covers it with the addresses.
+type cookieJar struct {
+	secret []byte
+}
+
+func newCookieJar() (*cookieJar, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return &cookieJar{
+		secret: secret,
+	}, nil
+}
+
+func (cj *cookieJar) slot(now time.Time) uint32 {
+	return uint32(now.Unix() / int64(COOKIESLOT))
+}
+
+func (cj *cookieJar) mac(label string, slot uint32, src string, dst string, syn []byte) []byte {
+	mac := hmac.New(sha256.New, cj.secret)
+	mac.Write([]byte(label))
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, slot)
+	mac.Write(b)
+	mac.Write([]byte(src))
+	mac.Write([]byte{0})
+	mac.Write([]byte(dst))
+	mac.Write([]byte{0})
+	mac.Write(syn)
+	return mac.Sum(nil)
+}
+
+func (cj *cookieJar) cookie(slot uint32, src string, dst string, syn []byte) uint32 {
+	m := binary.BigEndian.Uint32(cj.mac("cookie", slot, src, dst, syn))
+	return slot<<(32-COOKIESLOTBITS) | m&COOKIEMACMASK
+}
+
+func (cj *cookieJar) make(now time.Time, src string, dst string, syn []byte) uint32 {
+	return cj.cookie(cj.slot(now), src, dst, syn)
+}
+
+func (cj *cookieJar) check(now time.Time, cookie uint32, src string, dst string, syn []byte) bool {
+	cur := cj.slot(now)
+	for _, slot := range []uint32{cur, cur - 1} {
+		if slot&(1<<COOKIESLOTBITS-1) == cookie>>(32-COOKIESLOTBITS) {
+			return hmac.Equal(u32bytes(cj.cookie(slot, src, dst, syn)), u32bytes(cookie))
+		}
+	}
+	return false
+}
+
+//X25519 key of the listener for an encrypted conn, derived from the cookie so it's the same on the final ACK
+func (cj *cookieJar) privateKey(cookie uint32, src string, dst string, syn []byte) (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().NewPrivateKey(cj.mac("x25519", cookie, src, dst, syn))
+}
+
+func u32bytes(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
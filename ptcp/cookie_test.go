@@ -0,0 +1,155 @@
+package ptcp
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xitongsys/ethernet-go/header"
+)
+
+//Handshakes pending in the listener of c
+func pendingRequests(c *Conn) int {
+	v, ok := c.stack.routerListener.Load(c.LocalAddr().String())
+	if !ok {
+		return 0
+	}
+	return v.(*Listener).requestCache.ItemCount()
+}
+
+func TestSynCookies(t *testing.T) {
+	key := []byte("token")
+	//Lost SYN-ACKs make the dialer resend its SYN, which must get the same cookie and keys.
+	//Lost final ACKs are repeated by the dialer, the listener has no state to resend its SYN-ACK.
+	for _, loss := range []float64{0, 0.2} {
+		ccfg := ConnConfig{Encrypt: true, AuthKey: key, Reliable: true}
+		lcfg := ConnConfig{Encrypt: true, AuthKey: key, Reliable: true, SynCookies: true}
+		sa, sb := newLossyStacks(t, loss, ccfg, lcfg)
+		for i := 0; i < 5; i++ {
+			c, s := connectPair(t, sa, sb, 7600+10*int(loss*10)+i)
+			if c.aead == nil || s.snd == nil {
+				t.Fatal("options not granted with cookies")
+			}
+			if pendingRequests(s) != 0 {
+				t.Fatal("state kept by the listener")
+			}
+			exchange(t, c, s, 2)
+			exchange(t, s, c, 2)
+		}
+	}
+}
+
+func TestCookieLostFinalAck(t *testing.T) {
+	sa, sb, ma := newMangleStacks(t, ConnConfig{}, ConnConfig{SynCookies: true})
+	//Drop the first final ACK of the dialer
+	dropped := false
+	ma.set(func(packet []byte) [][]byte {
+		if sg, err := parseSegment(packet); err == nil && sg.flags == header.ACK && len(sg.data) > 0 && !dropped {
+			dropped = true
+			return nil
+		}
+		return [][]byte{packet}
+	})
+	c, s := connectPair(t, sa, sb, 7620)
+	if !dropped {
+		t.Fatal("final ACK not sent")
+	}
+	exchange(t, c, s, 2)
+	exchange(t, s, c, 2)
+}
+
+func TestCookieJar(t *testing.T) {
+	cj, err := newCookieJar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	syn := []byte("syn")
+	cookie := cj.make(now, "a", "b", syn)
+	if !cj.check(now, cookie, "a", "b", syn) || !cj.check(now.Add(time.Duration(COOKIESLOT)*time.Second), cookie, "a", "b", syn) {
+		t.Fatal("valid cookie refused")
+	}
+	if cj.check(now.Add(time.Duration(2*COOKIESLOT)*time.Second), cookie, "a", "b", syn) {
+		t.Fatal("expired cookie accepted")
+	}
+	if cj.check(now, cookie, "a", "c", syn) || cj.check(now, cookie, "a", "b", []byte("other")) || cj.check(now, cookie+1, "a", "b", syn) {
+		t.Fatal("invalid cookie accepted")
+	}
+}
+
+func TestFinalAckCheck(t *testing.T) {
+	a, b := NewPipe()
+	sb, err := NewStack(&Config{Link: b, LocalIP: "10.0.0.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sb.Close() })
+	ln, err := sb.Listen("ptcp", "10.0.0.2:81")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+
+	//The SYN-ACK has the ISN 0 without mimicry
+	a.Write(buildPacket("10.0.0.9:3000", "10.0.0.2:81", 0, 0, header.SYN, nil))
+	requests := ln.(*Listener).requestCache
+	waitFor(t, time.Second, func() bool { return requests.ItemCount() == 1 })
+	a.Write(buildPacket("10.0.0.9:3000", "10.0.0.2:81", 1, 5, header.ACK, nil))
+	select {
+	case <-accepted:
+		t.Fatal("ACK of another ISN accepted")
+	case <-time.After(100 * time.Millisecond):
+	}
+	a.Write(buildPacket("10.0.0.9:3000", "10.0.0.2:81", 1, 1, header.ACK, nil))
+	select {
+	case c := <-accepted:
+		if c == nil || c.RemoteAddr().String() != "10.0.0.9:3000" {
+			t.Fatal(c)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("final ACK refused")
+	}
+}
+
+func TestMaxPending(t *testing.T) {
+	a, b := NewPipe()
+	sb, err := NewStack(&Config{Link: b, LocalIP: "10.0.0.2", Conn: ConnConfig{MaxPending: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sb.Close() })
+	ln, err := sb.Listen("ptcp", "10.0.0.2:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	//The SYNs are handled by Accept, the handshakes are never completed
+	go ln.Accept()
+
+	for i := 0; i < 10; i++ {
+		a.Write(buildPacket(fmt.Sprintf("10.0.0.9:%d", 1000+i), "10.0.0.2:80", 0, 0, header.SYN, nil))
+	}
+	requests := ln.(*Listener).requestCache
+	waitFor(t, time.Second, func() bool { return requests.ItemCount() == 2 })
+	time.Sleep(100 * time.Millisecond)
+	if n := requests.ItemCount(); n != 2 {
+		t.Fatal("pending handshakes", n)
+	}
+
+	//The expired handshakes don't count, even before the janitor removes them
+	for src, item := range requests.Items() {
+		requests.Set(src, item.Object, time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	a.Write(buildPacket("10.0.0.9:2000", "10.0.0.2:80", 0, 0, header.SYN, nil))
+	waitFor(t, time.Second, func() bool {
+		_, ok := requests.Get("10.0.0.9:2000")
+		return ok
+	})
+}
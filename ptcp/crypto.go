@@ -0,0 +1,103 @@
+package ptcp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	AEADKEYLEN = 32
+	//Overhead of the encrypted payloads
+	AEADTAGLEN = 16
+)
+
+//connAead encrypts the payloads of a conn with AES-256-GCM, one key per direction.
+//The nonce is the sequence number of the packet, which is never reused in a direction.
+type connAead struct {
+	send cipher.AEAD
+	recv cipher.AEAD
+}
+
+func newConnAead(sendKey []byte, recvKey []byte) (*connAead, error) {
+	send, err := newGcm(sendKey)
+	if err != nil {
+		return nil, err
+	}
+	recv, err := newGcm(recvKey)
+	if err != nil {
+		return nil, err
+	}
+	return &connAead{
+		send: send,
+		recv: recv,
+	}, nil
+}
+
+func newGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func aeadNonce(seq uint32) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint32(nonce[8:], seq)
+	return nonce
+}
+
+func (a *connAead) seal(seq uint32, plaintext []byte) []byte {
+	return a.send.Seal(nil, aeadNonce(seq), plaintext, nil)
+}
+
+func (a *connAead) open(seq uint32, ciphertext []byte) ([]byte, error) {
+	return a.recv.Open(nil, aeadNonce(seq), ciphertext, nil)
+}
+
+//Keys of both directions: dialer -> listener, listener -> dialer.
+//The X25519 shared secret is mixed with the psk, so only the peers knowing the psk get the keys.
+func deriveKeys(shared []byte, psk []byte, dialerKey []byte, listenerKey []byte) ([]byte, []byte) {
+	ikm := append(append([]byte{}, shared...), psk...)
+	salt := append(append([]byte{}, dialerKey...), listenerKey...)
+	prk := hkdfExtract(salt, ikm)
+	return hkdfExpand(prk, []byte("ptcp dialer"), AEADKEYLEN), hkdfExpand(prk, []byte("ptcp listener"), AEADKEYLEN)
+}
+
+//HKDF of RFC 5869 with SHA-256
+func hkdfExtract(salt []byte, ikm []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	return mac.Sum(nil)
+}
+
+func hkdfExpand(prk []byte, info []byte, n int) []byte {
+	res, prev := []byte{}, []byte{}
+	for i := byte(1); len(res) < n; i++ {
+		mac := hmac.New(sha256.New, prk)
+		mac.Write(prev)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		prev = mac.Sum(nil)
+		res = append(res, prev...)
+	}
+	return res[:n]
+}
+
+func newX25519Key() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+func x25519Shared(priv *ecdh.PrivateKey, peerKey []byte) ([]byte, error) {
+	pub, err := ecdh.X25519().NewPublicKey(peerKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer key: %v", err)
+	}
+	return priv.ECDH(pub)
+}
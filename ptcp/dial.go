@@ -1,8 +1,10 @@
 package ptcp
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/xitongsys/ethernet-go/header"
@@ -13,21 +15,75 @@ const (
 	RETRYINTERVAL = 500
 )
 
-func Dial(proto string, remoteAddr string) (net.Conn, error) {
-	localAddr, err := GetLocalAddr(remoteAddr)
+func DialContext(ctx context.Context, proto string, remoteAddr string) (net.Conn, error) {
+	if defaultStack == nil {
+		return nil, fmt.Errorf("ptcp not initialized")
+	}
+	return defaultStack.DialContext(ctx, proto, remoteAddr)
+}
+
+func (s *Stack) Dial(proto string, remoteAddr string) (net.Conn, error) {
+	return s.DialContext(context.Background(), proto, remoteAddr)
+}
+
+func (s *Stack) DialContext(ctx context.Context, proto string, remoteAddr string) (net.Conn, error) {
+	return s.DialWithConfig(ctx, proto, remoteAddr, &s.cfg.Conn)
+}
+
+//DialWithConfig returns when the handshake is done, the ctx is done or the retries are exhausted
+func (s *Stack) DialWithConfig(ctx context.Context, proto string, remoteAddr string, cfg *ConnConfig) (net.Conn, error) {
+	if s.isClosed() {
+		return nil, fmt.Errorf("stack closed")
+	}
+
+	remoteAddr, err := normalizeAddr(remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	localAddr, err := s.localAddr(remoteAddr)
 	if err != nil {
 		return nil, err
 	}
 
-	conn := NewConn(localAddr.String(), remoteAddr, CONNECTING)
-	ptcpServer.CreateConn(localAddr.String(), remoteAddr, conn)
+	if err := s.addRSTFilter(localAddr, remoteAddr); err != nil {
+		s.ports.release(localAddr)
+		return nil, err
+	}
+
+	//Registered before the SYN so it gets the SYN-ACK, its keepalives start once it's established
+	conn := newConn(s, cfg, localAddr, remoteAddr, CONNECTING, make(chan string, CONNCHANBUFSIZE), s.output)
+	conn.dialed = true
+	if conn.cfg.Mimicry {
+		isn, err := randomIsn()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.sndIsn, conn.sndNxt = isn, isn+1
+	}
+	s.CreateConn(localAddr, remoteAddr, conn)
 
-	ipHeader, tcpHeader := header.BuildTcpHeader(localAddr.String(), remoteAddr)
-	tcpHeader.Seq = 0
-	tcpHeader.Flags = header.SYN
-	packet := header.BuildTcpPacket(ipHeader, tcpHeader, []byte{})
+	local, err := newHello(&conn.cfg, s.mss(&conn.cfg, remoteAddr))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	payload := local.marshal()
+	if conn.cfg.AuthKey != nil {
+		if payload, err = signHello(payload, conn.cfg.AuthKey, localAddr, remoteAddr); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	var options []byte
+	if conn.cfg.Mimicry {
+		options = synOptions(local.mss, conn.sndIsn, 0)
+	}
+	packet := buildPacketWithOptions(localAddr, remoteAddr, conn.sndIsn, 0, header.SYN, options, payload)
 
 	done := make(chan int)
+	defer close(done)
 	go func() {
 		for i := 0; i < RETRYTIME; i++ {
 			select {
@@ -41,41 +97,76 @@ func Dial(proto string, remoteAddr string) (net.Conn, error) {
 		}
 	}()
 
-	after := time.After(time.Millisecond * RETRYINTERVAL * RETRYTIME)
-	buf := make([]byte, BUFFERSIZE)
-	timeOut := false
-	for !timeOut {
-		if n, err := conn.ReadWithHeader(buf); n > 0 && err == nil {
-			_, _, _, tcpHeader, _, _ := header.Get(buf[:n])
-			if tcpHeader.Flags == (header.SYN|header.ACK) && tcpHeader.Ack == 1 {
-				close(done)
-				break
-			}
+	after := time.NewTimer(time.Millisecond * RETRYINTERVAL * RETRYTIME)
+	defer after.Stop()
+	for established := false; !established; {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-after.C:
+			err = &timeoutError{}
+		case <-s.done:
+			err = fmt.Errorf("stack closed")
+		case <-conn.done:
+			err = fmt.Errorf("conn closed")
+		case data := <-conn.InputChan:
+			established, err = conn.dialResponse(local, []byte(data), payload)
+		}
+
+		if err != nil {
+			conn.Close()
+			return nil, err
 		}
+	}
+
+	n, err := conn.WriteWithHeader([]byte(conn.finalAck))
+	if err != nil || n != len(conn.finalAck) {
+		//No FIN, the peer never got the final ACK
+		conn.setState(CLOSED)
+		conn.Close()
+		return nil, fmt.Errorf("packet loss (expect=%v, real=%v) or %v", len(conn.finalAck), n, err)
+	}
+	go conn.keepAlive()
+	go conn.repeatFinalAck()
+	return conn, nil
+}
 
+//Send the final ACK again until the listener answers, at most RETRYTIME times.
+//A listener using SYN cookies has no state to repeat its SYN-ACK, the dialer would stay half-open if it's lost.
+func (conn *Conn) repeatFinalAck() {
+	for i := 0; i < RETRYTIME; i++ {
 		select {
-		case <-after:
-			err = fmt.Errorf("timeout")
-			timeOut = true
-		default:
+		case <-conn.done:
+			return
+		case <-time.After(time.Millisecond * RETRYINTERVAL):
 		}
+		if atomic.LoadInt32(&conn.answered) != 0 {
+			return
+		}
+		conn.WriteWithHeader([]byte(conn.finalAck))
 	}
+}
 
+//Handle a packet received during the handshake, returns true once the SYN-ACK is accepted.
+//The conn is then CONNECTED before its final ACK is sent, so the packets which follow aren't taken for the handshake's.
+func (conn *Conn) dialResponse(local *hello, data []byte, syn []byte) (bool, error) {
+	sg, err := parseSegment(data)
+	if err != nil || sg.flags != (header.SYN|header.ACK) || sg.ack != conn.sndIsn+1 {
+		return false, nil
+	}
+	granted, err := parseHello(sg.data)
 	if err != nil {
-		return nil, err
+		return false, nil
 	}
 
-	//seq, ack := 1, tcpHeader.Seq+1
-	ipHeader, tcpHeader = header.BuildTcpHeader(localAddr.String(), remoteAddr)
-	tcpHeader.Seq = 1
-	tcpHeader.Ack = 1
-	tcpHeader.Flags = header.ACK
-	packet = header.BuildTcpPacket(ipHeader, tcpHeader, []byte{})
-
-	n, err := conn.WriteWithHeader(packet)
-	if err != nil || n != len(packet) {
-		return nil, fmt.Errorf("packet loss (expect=%v, real=%v) or %v", len(packet), n, err)
+	if err := local.complete(granted, &conn.cfg); err != nil {
+		return false, err
 	}
-	conn.State = CONNECTED
-	return conn, nil
+	if err := conn.establish(granted, sg.seq+1); err != nil {
+		return false, err
+	}
+	//The SYN options are echoed for the listeners using SYN cookies
+	conn.finalAck = string(conn.packet(conn.sndIsn+1, conn.recv.nextSeq(), header.ACK, nil, syn))
+	conn.setState(CONNECTED)
+	return true, nil
 }
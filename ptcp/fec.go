@@ -0,0 +1,328 @@
+package ptcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+//A partial group is completed with parity packets after this time in ms
+var FECFLUSHINTERVAL = 50
+
+//Number of recent data packets kept by the receiver to rebuild the lost ones
+var FECHISTORY = 1024
+
+//FEC option layout: base seq (4) + data count (1) + parity index (1) + parity count (1)
+const FECOPTIONLEN = 7
+
+//Reed-Solomon coders by data and parity count
+var fecCoders sync.Map
+
+func getFecCoder(data int, parity int) (reedsolomon.Encoder, error) {
+	key := data<<8 | parity
+	if v, ok := fecCoders.Load(key); ok {
+		return v.(reedsolomon.Encoder), nil
+	}
+	enc, err := reedsolomon.New(data, parity)
+	if err != nil {
+		return nil, err
+	}
+	fecCoders.Store(key, enc)
+	return enc, nil
+}
+
+//Payload -> shard: length (2) + payload, padded to size
+func toShard(payload []byte, size int) []byte {
+	shard := make([]byte, size)
+	binary.BigEndian.PutUint16(shard, uint16(len(payload)))
+	copy(shard[2:], payload)
+	return shard
+}
+
+func fromShard(shard []byte) ([]byte, error) {
+	if len(shard) < 2 {
+		return nil, fmt.Errorf("invalid shard")
+	}
+	n := int(binary.BigEndian.Uint16(shard))
+	if n+2 > len(shard) {
+		return nil, fmt.Errorf("invalid shard")
+	}
+	return shard[2 : 2+n], nil
+}
+
+//fecEncoder groups the sent data packets by data count and makes the parity payloads of each group.
+type fecEncoder struct {
+	mu       sync.Mutex
+	data     int
+	parity   int
+	base     uint32
+	payloads [][]byte
+	started  time.Time
+}
+
+//Parity payloads with their FEC option values
+type fecParity struct {
+	option  []byte
+	payload []byte
+}
+
+func newFecEncoder(data int, parity int) *fecEncoder {
+	return &fecEncoder{
+		data:   data,
+		parity: parity,
+	}
+}
+
+//Add a sent data packet, returns the parity packets if its group is complete
+func (e *fecEncoder) add(seq uint32, payload []byte) ([]fecParity, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.payloads) == 0 {
+		e.base, e.started = seq, time.Now()
+	}
+	buf := make([]byte, len(payload))
+	copy(buf, payload)
+	e.payloads = append(e.payloads, buf)
+
+	if len(e.payloads) < e.data {
+		return nil, nil
+	}
+	return e.encode()
+}
+
+//Parity packets of the partial group if it waited too long
+func (e *fecEncoder) flush(now time.Time) ([]fecParity, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.payloads) == 0 || now.Sub(e.started) < time.Millisecond*time.Duration(FECFLUSHINTERVAL) {
+		return nil, nil
+	}
+	return e.encode()
+}
+
+func (e *fecEncoder) encode() ([]fecParity, error) {
+	count := len(e.payloads)
+	defer func() {
+		e.payloads = e.payloads[:0]
+	}()
+
+	size := 0
+	for _, p := range e.payloads {
+		if len(p)+2 > size {
+			size = len(p) + 2
+		}
+	}
+
+	shards := make([][]byte, count+e.parity)
+	for i, p := range e.payloads {
+		shards[i] = toShard(p, size)
+	}
+	for i := count; i < len(shards); i++ {
+		shards[i] = make([]byte, size)
+	}
+
+	coder, err := getFecCoder(count, e.parity)
+	if err != nil {
+		return nil, err
+	}
+	if err := coder.Encode(shards); err != nil {
+		return nil, err
+	}
+
+	res := make([]fecParity, e.parity)
+	for i := range res {
+		option := make([]byte, FECOPTIONLEN)
+		binary.BigEndian.PutUint32(option, e.base)
+		option[4], option[5], option[6] = byte(count), byte(i), byte(e.parity)
+		res[i] = fecParity{
+			option:  option,
+			payload: shards[count+i],
+		}
+	}
+	return res, nil
+}
+
+//fecDecoder keeps the recent data packets and the parity packets, and rebuilds the lost data packets of a group
+//as soon as enough of its packets arrived.
+type fecDecoder struct {
+	mu      sync.Mutex
+	highest uint32
+	started bool
+	//Payloads of the recent data packets by seq
+	payloads map[uint32][]byte
+	//Groups waiting for recovery by base seq
+	groups    map[uint32]*fecGroup
+	recovered uint64
+}
+
+type fecGroup struct {
+	count  int
+	parity [][]byte
+}
+
+//Data packet rebuilt from the parity packets
+type fecRecovered struct {
+	seq     uint32
+	payload []byte
+}
+
+func newFecDecoder() *fecDecoder {
+	return &fecDecoder{
+		payloads: map[uint32][]byte{},
+		groups:   map[uint32]*fecGroup{},
+	}
+}
+
+func (d *fecDecoder) addData(seq uint32, payload []byte) []fecRecovered {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.payloads[seq]; ok {
+		return nil
+	}
+	buf := make([]byte, len(payload))
+	copy(buf, payload)
+	d.payloads[seq] = buf
+	d.update(seq)
+
+	for base, g := range d.groups {
+		if !seqLess(seq, base) && seqLess(seq, base+uint32(g.count)) {
+			return d.recover(base, g)
+		}
+	}
+	return nil
+}
+
+func (d *fecDecoder) addParity(option []byte, payload []byte) []fecRecovered {
+	if len(option) != FECOPTIONLEN {
+		return nil
+	}
+	base := binary.BigEndian.Uint32(option)
+	count, index, parity := int(option[4]), int(option[5]), int(option[6])
+	if count == 0 || parity == 0 || index >= parity {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	g, ok := d.groups[base]
+	if !ok {
+		if d.started && seqLess(base, d.highest-uint32(FECHISTORY)) {
+			return nil
+		}
+		g = &fecGroup{
+			count:  count,
+			parity: make([][]byte, parity),
+		}
+		d.groups[base] = g
+	}
+	if g.count != count || len(g.parity) != parity {
+		return nil
+	}
+
+	buf := make([]byte, len(payload))
+	copy(buf, payload)
+	g.parity[index] = buf
+	d.update(base + uint32(count) - 1)
+	return d.recover(base, g)
+}
+
+func (d *fecDecoder) recover(base uint32, g *fecGroup) []fecRecovered {
+	count, size := 0, 0
+	shards := make([][]byte, g.count+len(g.parity))
+	for i := 0; i < g.count; i++ {
+		if p, ok := d.payloads[base+uint32(i)]; ok {
+			shards[i] = p
+			count++
+		}
+	}
+	if count == g.count {
+		delete(d.groups, base)
+		return nil
+	}
+
+	for i, p := range g.parity {
+		if p != nil {
+			shards[g.count+i] = p
+			size = len(p)
+			count++
+		}
+	}
+	if count < g.count {
+		return nil
+	}
+
+	missing := []int{}
+	for i := 0; i < g.count; i++ {
+		if shards[i] == nil {
+			missing = append(missing, i)
+
+		} else if len(shards[i])+2 > size {
+			delete(d.groups, base)
+			return nil
+
+		} else {
+			shards[i] = toShard(shards[i], size)
+		}
+	}
+
+	delete(d.groups, base)
+	coder, err := getFecCoder(g.count, len(g.parity))
+	if err != nil {
+		return nil
+	}
+	if err := coder.ReconstructData(shards); err != nil {
+		return nil
+	}
+
+	res := []fecRecovered{}
+	for _, i := range missing {
+		payload, err := fromShard(shards[i])
+		if err != nil {
+			continue
+		}
+		seq := base + uint32(i)
+		d.payloads[seq] = payload
+		d.recovered++
+		res = append(res, fecRecovered{
+			seq:     seq,
+			payload: payload,
+		})
+	}
+	return res
+}
+
+//Track the highest seq and forget the old packets
+func (d *fecDecoder) update(seq uint32) {
+	if d.started && !seqLess(d.highest, seq) {
+		return
+	}
+	d.highest, d.started = seq, true
+	if len(d.payloads) <= FECHISTORY {
+		return
+	}
+
+	limit := d.highest - uint32(FECHISTORY)
+	for s := range d.payloads {
+		if seqLess(s, limit) {
+			delete(d.payloads, s)
+		}
+	}
+	for base := range d.groups {
+		if seqLess(base, limit) {
+			delete(d.groups, base)
+		}
+	}
+}
+
+func (d *fecDecoder) getRecovered() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.recovered
+}
@@ -0,0 +1,148 @@
+package ptcp
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFecRecover(t *testing.T) {
+	enc := newFecEncoder(4, 2)
+	payloads := map[uint32][]byte{}
+	var parity []fecParity
+	for seq := uint32(10); seq < 14; seq++ {
+		payloads[seq] = []byte(fmt.Sprint("payload ", seq, string(make([]byte, seq))))
+		p, err := enc.add(seq, payloads[seq])
+		if err != nil {
+			t.Fatal(err)
+		}
+		parity = p
+	}
+	if len(parity) != 2 {
+		t.Fatal(parity)
+	}
+
+	//11 and 13 lost
+	dec := newFecDecoder()
+	dec.addData(10, payloads[10])
+	dec.addData(12, payloads[12])
+	if res := dec.addParity(parity[0].option, parity[0].payload); len(res) != 0 {
+		t.Fatal("rebuilt without enough shards", res)
+	}
+	res := dec.addParity(parity[1].option, parity[1].payload)
+	if len(res) != 2 || dec.getRecovered() != 2 {
+		t.Fatal(res)
+	}
+	for _, r := range res {
+		if string(r.payload) != string(payloads[r.seq]) {
+			t.Fatal(r.seq, r.payload)
+		}
+	}
+}
+
+func TestFecFlush(t *testing.T) {
+	enc := newFecEncoder(4, 1)
+	enc.add(1, []byte("a"))
+	enc.add(2, []byte("bb"))
+	if p, _ := enc.flush(time.Now()); p != nil {
+		t.Fatal("flushed too early")
+	}
+	p, err := enc.flush(time.Now().Add(time.Duration(FECFLUSHINTERVAL) * time.Millisecond))
+	if err != nil || len(p) != 1 || p[0].option[4] != 2 {
+		t.Fatal(p, err)
+	}
+
+	dec := newFecDecoder()
+	dec.addData(1, []byte("a"))
+	if res := dec.addParity(p[0].option, p[0].payload); len(res) != 1 || string(res[0].payload) != "bb" {
+		t.Fatal(res)
+	}
+}
+
+func TestFEC(t *testing.T) {
+	cfg := ConnConfig{FECData: 10, FECParity: 3}
+	sa, sb := newLossyStacks(t, 0.05, cfg, cfg)
+	c, s := connectPair(t, sa, sb, 7200)
+	if c.fecEnc == nil || s.fecDec == nil {
+		t.Fatal("no fec")
+	}
+
+	//Concurrent writers, every delivered packet must be one of the sent ones
+	const W, N = 4, 250
+	sent := map[string]bool{}
+	for w := 0; w < W; w++ {
+		for i := 0; i < N; i++ {
+			sent[fmt.Sprintf("packet-%d-%d-%s", w, i, string(make([]byte, i%50)))] = true
+		}
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < W; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < N; i++ {
+				c.Write([]byte(fmt.Sprintf("packet-%d-%d-%s", w, i, string(make([]byte, i%50)))))
+				if i%25 == 0 {
+					time.Sleep(time.Millisecond)
+				}
+			}
+		}(w)
+	}
+	defer wg.Wait()
+
+	buf := make([]byte, 200)
+	got := map[string]bool{}
+	for {
+		s.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		n, err := s.Read(buf)
+		if err != nil {
+			break
+		}
+		msg := string(buf[:n])
+		if !sent[msg] || got[msg] {
+			t.Fatalf("invalid packet %q", msg)
+		}
+		got[msg] = true
+	}
+	if st := s.Stats(); st.Recovered == 0 || len(got) < W*N*98/100 {
+		t.Fatal("fec not effective", len(got), st)
+	}
+}
+
+func TestFECCancelledWrites(t *testing.T) {
+	cfg := ConnConfig{FECData: 4, FECParity: 2}
+	sa, sb := newLossyStacks(t, 0.1, cfg, cfg)
+	c, s := connectPair(t, sa, sb, 7201)
+
+	//The send of about half of them is cancelled, they still take a seq
+	cancelled := make(chan struct{})
+	close(cancelled)
+	const N = 400
+	go func() {
+		for i := 0; i < N; i++ {
+			c.writePacket([]byte(fmt.Sprintf("packet-%d", i)), cancelled)
+			if i%20 == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+
+	buf := make([]byte, 200)
+	last := -1
+	for {
+		s.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		n, err := s.Read(buf)
+		if err != nil {
+			break
+		}
+		var i int
+		if _, err := fmt.Sscanf(string(buf[:n]), "packet-%d", &i); err != nil || i <= last || i >= N {
+			t.Fatalf("invalid packet %q after %v", buf[:n], last)
+		}
+		last = i
+	}
+	if s.Stats().Recovered == 0 {
+		t.Fatal("nothing recovered", s.Stats())
+	}
+}
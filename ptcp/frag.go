@@ -0,0 +1,229 @@
+package ptcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Seconds before an incomplete fragmented packet is dropped
+var FRAGTIMEOUT = 30
+
+//Max packets being reassembled, the new fragments are dropped beyond
+var FRAGMAXPENDING = 64
+
+//Max payload bytes buffered for all the packets being reassembled, the new fragments are dropped beyond.
+//A packet holds at most 65535 bytes, its fragments can't overlap.
+var FRAGMAXBYTES = 1 << 20
+
+//ipv6 fragment header: next header (1) + reserved (1) + offset and more flag (2) + identification (4)
+const IPV6FRAGHEADERLEN = 8
+
+//Split an IP packet in fragments of at most mtu bytes. The packets queued for retransmission
+//before the path MTU was lowered are still delivered this way.
+func fragment(packet []byte, mtu int) ([][]byte, error) {
+	if len(packet) == 0 {
+		return nil, fmt.Errorf("empty packet")
+	}
+	if packet[0]>>4 == 6 {
+		return fragment6(packet, mtu)
+	}
+
+	ihl := int(packet[0]&0x0f) * 4
+	size := (mtu - ihl) &^ 7
+	if size <= 0 || ihl < IPV4HEADERLEN || len(packet) < ihl {
+		return nil, fmt.Errorf("can't fragment in %v bytes", mtu)
+	}
+	payload := packet[ihl:]
+	frags := [][]byte{}
+	for off := 0; off < len(payload); off += size {
+		end := off + size
+		flags := uint16(0x2000)
+		if end >= len(payload) {
+			end, flags = len(payload), 0
+		}
+		f := make([]byte, ihl+end-off)
+		copy(f, packet[:ihl])
+		copy(f[ihl:], payload[off:end])
+		binary.BigEndian.PutUint16(f[2:], uint16(len(f)))
+		binary.BigEndian.PutUint16(f[6:], flags|uint16(off/8))
+		f[10], f[11] = 0, 0
+		binary.BigEndian.PutUint16(f[10:], checksum(f[:ihl], 0))
+		frags = append(frags, f)
+	}
+	return frags, nil
+}
+
+//The fake TCP packets have no extension header, the fragment header follows the fixed one
+func fragment6(packet []byte, mtu int) ([][]byte, error) {
+	size := (mtu - IPV6HEADERLEN - IPV6FRAGHEADERLEN) &^ 7
+	if size <= 0 || len(packet) < IPV6HEADERLEN {
+		return nil, fmt.Errorf("can't fragment in %v bytes", mtu)
+	}
+	id := atomic.AddUint32(&ipId, 1)
+	payload := packet[IPV6HEADERLEN:]
+	frags := [][]byte{}
+	for off := 0; off < len(payload); off += size {
+		end := off + size
+		more := uint16(1)
+		if end >= len(payload) {
+			end, more = len(payload), 0
+		}
+		f := make([]byte, IPV6HEADERLEN+IPV6FRAGHEADERLEN+end-off)
+		copy(f, packet[:IPV6HEADERLEN])
+		binary.BigEndian.PutUint16(f[4:], uint16(len(f)-IPV6HEADERLEN))
+		f[6] = 44
+		fh := f[IPV6HEADERLEN:]
+		fh[0] = packet[6]
+		binary.BigEndian.PutUint16(fh[2:], uint16(off)|more)
+		binary.BigEndian.PutUint32(fh[4:], id)
+		copy(f[IPV6HEADERLEN+IPV6FRAGHEADERLEN:], payload[off:end])
+		frags = append(frags, f)
+	}
+	return frags, nil
+}
+
+//Offset in bytes, more fragments flag, identification and payload of a TCP fragment. ok is false if it isn't one.
+func parseFragment(packet []byte) (header []byte, offset int, more bool, id string, payload []byte, ok bool) {
+	if len(packet) >= IPV4HEADERLEN && packet[0]>>4 == 4 {
+		ihl := int(packet[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(packet[2:]))
+		flags := binary.BigEndian.Uint16(packet[6:])
+		if packet[9] != 6 || flags&0x3fff == 0 || ihl < IPV4HEADERLEN || total < ihl || total > len(packet) {
+			return
+		}
+		//src, dst, identification
+		id = string(packet[12:20]) + string(packet[4:6])
+		return packet[:ihl], int(flags&0x1fff) * 8, flags&0x2000 != 0, id, packet[ihl:total], true
+	}
+
+	if len(packet) >= IPV6HEADERLEN+IPV6FRAGHEADERLEN && packet[0]>>4 == 6 {
+		total := IPV6HEADERLEN + int(binary.BigEndian.Uint16(packet[4:]))
+		fh := packet[IPV6HEADERLEN:]
+		if packet[6] != 44 || fh[0] != 6 || total > len(packet) || total < IPV6HEADERLEN+IPV6FRAGHEADERLEN {
+			return
+		}
+		v := binary.BigEndian.Uint16(fh[2:])
+		id = string(packet[8:40]) + string(fh[4:8])
+		return packet[:IPV6HEADERLEN], int(v &^ 7), v&1 != 0, id, packet[IPV6HEADERLEN+IPV6FRAGHEADERLEN : total], true
+	}
+	return
+}
+
+//reassembler rebuilds the fragmented TCP packets, the kernel doesn't do it for the packet sockets
+type reassembler struct {
+	mu      sync.Mutex
+	packets map[string]*fragPacket
+	//Payload bytes of all the packets
+	size int
+}
+
+type fragPacket struct {
+	header []byte
+	parts  map[int][]byte
+	//Payload bytes received
+	size int
+	//Payload length, -1 until the last fragment comes
+	total  int
+	expire time.Time
+}
+
+func newReassembler() *reassembler {
+	return &reassembler{packets: map[string]*fragPacket{}}
+}
+
+//Returns the whole packet once its last missing fragment is added, nil before.
+//Like the kernel, the whole packet is dropped if a fragment overlaps another one or its end.
+func (r *reassembler) add(packet []byte) []byte {
+	header, offset, more, id, payload, ok := parseFragment(packet)
+	end := offset + len(payload)
+	if !ok || len(payload) == 0 || end > 65535 || (more && len(payload)%8 != 0) {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for k, v := range r.packets {
+		if now.After(v.expire) {
+			r.drop(k)
+		}
+	}
+	if r.size+len(payload) > FRAGMAXBYTES {
+		return nil
+	}
+	p, ok := r.packets[id]
+	if !ok {
+		if len(r.packets) >= FRAGMAXPENDING {
+			return nil
+		}
+		p = &fragPacket{parts: map[int][]byte{}, total: -1, expire: now.Add(time.Second * time.Duration(FRAGTIMEOUT))}
+		r.packets[id] = p
+	}
+
+	if (p.total >= 0 && end > p.total) || (!more && p.total >= 0 && end != p.total) {
+		r.drop(id)
+		return nil
+	}
+	for off, part := range p.parts {
+		if (offset < off+len(part) && off < end) || (!more && off+len(part) > end) {
+			r.drop(id)
+			return nil
+		}
+	}
+
+	if offset == 0 {
+		p.header = append([]byte{}, header...)
+	}
+	p.parts[offset] = append([]byte{}, payload...)
+	p.size += len(payload)
+	r.size += len(payload)
+	if !more {
+		p.total = end
+	}
+	if p.header == nil || p.total < 0 {
+		return nil
+	}
+
+	offsets := make([]int, 0, len(p.parts))
+	for off := range p.parts {
+		offsets = append(offsets, off)
+	}
+	sort.Ints(offsets)
+	whole := append([]byte{}, p.header...)
+	for _, off := range offsets {
+		if off != len(whole)-len(p.header) {
+			return nil
+		}
+		whole = append(whole, p.parts[off]...)
+	}
+	if len(whole)-len(p.header) != p.total {
+		return nil
+	}
+	r.drop(id)
+
+	if whole[0]>>4 == 4 {
+		if len(whole) > 65535 {
+			return nil
+		}
+		binary.BigEndian.PutUint16(whole[2:], uint16(len(whole)))
+		whole[6], whole[7] = 0, 0
+		whole[10], whole[11] = 0, 0
+		binary.BigEndian.PutUint16(whole[10:], checksum(whole[:len(p.header)], 0))
+	} else {
+		binary.BigEndian.PutUint16(whole[4:], uint16(p.total))
+		whole[6] = 6
+	}
+	return whole
+}
+
+//Forget a packet and its fragments
+func (r *reassembler) drop(id string) {
+	if p, ok := r.packets[id]; ok {
+		r.size -= p.size
+		delete(r.packets, id)
+	}
+}
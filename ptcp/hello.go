@@ -0,0 +1,213 @@
+package ptcp
+
+import (
+	"crypto/ecdh"
+	"encoding/binary"
+	"fmt"
+)
+
+//Types of the TLVs carried in the payload of SYN and SYN-ACK
+const (
+	//Value: send window of the reliable mode (uint16)
+	HELLORELIABLE = 1
+	//Value: data count (1) + parity count (1) of the FEC groups
+	HELLOFEC = 2
+	//Value: X25519 public key (32), asks for encrypted payloads
+	HELLOKEY = 3
+	//Value: nonce + time + mac of the SYN, always the last TLV. See signHello
+	HELLOAUTH = 4
+	//No value, asks for the mimicry mode
+	HELLOMIMIC = 5
+	//No value, asks for the congestion feedback
+	HELLOCC = 6
+	//Value: max TCP payload the sender receives (uint16), the MSS of the link
+	HELLOMSS = 7
+)
+
+//hello holds the conn options negotiated during the handshake.
+//The dialer puts the options it wants in the SYN, the listener answers with the ones it grants in the SYN-ACK.
+//An empty payload means no option, which keeps the handshake compatible with older peers.
+type hello struct {
+	reliable   bool
+	window     int
+	fecData    int
+	fecParity  int
+	key        []byte
+	mimic      bool
+	congestion bool
+	//The dialer's MSS in the SYN, the min of both in the SYN-ACK. 0 if the peer doesn't send it
+	mss int
+	//Auth TLV and the payload it signs
+	auth   []byte
+	signed []byte
+
+	//Not sent. The private key of the local side, and the payload keys once both public keys are known
+	priv    *ecdh.PrivateKey
+	sendKey []byte
+	recvKey []byte
+}
+
+func (h *hello) marshal() []byte {
+	b := []byte{}
+	if h.reliable {
+		v := make([]byte, 2)
+		binary.BigEndian.PutUint16(v, uint16(h.window))
+		b = appendTLV(b, HELLORELIABLE, v)
+	}
+	if h.fecData > 0 {
+		b = appendTLV(b, HELLOFEC, []byte{byte(h.fecData), byte(h.fecParity)})
+	}
+	if h.key != nil {
+		b = appendTLV(b, HELLOKEY, h.key)
+	}
+	if h.mimic {
+		b = appendTLV(b, HELLOMIMIC, []byte{})
+	}
+	if h.congestion {
+		b = appendTLV(b, HELLOCC, []byte{})
+	}
+	if h.mss > 0 {
+		v := make([]byte, 2)
+		binary.BigEndian.PutUint16(v, uint16(h.mss))
+		b = appendTLV(b, HELLOMSS, v)
+	}
+	return b
+}
+
+func parseHello(b []byte) (*hello, error) {
+	h := &hello{}
+	payload := b
+	for len(b) > 0 {
+		if len(b) < 2 || int(b[1])+2 > len(b) {
+			return nil, fmt.Errorf("invalid hello")
+		}
+		t, v := b[0], b[2:2+int(b[1])]
+		b = b[2+int(b[1]):]
+
+		switch t {
+		case HELLORELIABLE:
+			//A window of 0 would block the writes forever
+			if len(v) != 2 || binary.BigEndian.Uint16(v) == 0 {
+				return nil, fmt.Errorf("invalid hello reliable option")
+			}
+			h.reliable, h.window = true, int(binary.BigEndian.Uint16(v))
+		case HELLOFEC:
+			if len(v) != 2 || v[0] == 0 || v[1] == 0 {
+				return nil, fmt.Errorf("invalid hello fec option")
+			}
+			h.fecData, h.fecParity = int(v[0]), int(v[1])
+		case HELLOKEY:
+			if len(v) != 32 {
+				return nil, fmt.Errorf("invalid hello key option")
+			}
+			h.key = v
+		case HELLOMIMIC:
+			h.mimic = true
+		case HELLOCC:
+			h.congestion = true
+		case HELLOMSS:
+			if len(v) != 2 || binary.BigEndian.Uint16(v) == 0 {
+				return nil, fmt.Errorf("invalid hello mss option")
+			}
+			h.mss = int(binary.BigEndian.Uint16(v))
+		case HELLOAUTH:
+			if len(b) != 0 {
+				return nil, fmt.Errorf("hello auth option is not the last one")
+			}
+			h.auth, h.signed = v, payload[:len(payload)-len(v)-2]
+		default:
+			//Unknown options are ignored, so newer dialers can talk to older listeners
+		}
+	}
+	return h, nil
+}
+
+//Options wanted by a dialer with this config and MSS
+func newHello(cfg *ConnConfig, mss int) (*hello, error) {
+	h := &hello{
+		mss:        mss,
+		reliable:   cfg.Reliable,
+		window:     cfg.SendWindow,
+		mimic:      cfg.Mimicry,
+		congestion: cfg.Congestion,
+	}
+	if cfg.FECData > 0 && cfg.FECParity > 0 {
+		h.fecData, h.fecParity = cfg.FECData, cfg.FECParity
+	}
+	if cfg.Encrypt {
+		priv, err := newX25519Key()
+		if err != nil {
+			return nil, err
+		}
+		h.priv, h.key = priv, priv.PublicKey().Bytes()
+	}
+	return h, nil
+}
+
+//Options granted by a listener with this config.
+//An encrypted conn is always granted, a listener with Encrypt refuses the others.
+//priv is the X25519 key of the listener, a new one is generated if it's nil. mss is the MSS of the listener.
+func (h *hello) accept(cfg *ConnConfig, priv *ecdh.PrivateKey, mss int) (*hello, error) {
+	res := &hello{mss: mss}
+	if h.mss > 0 && h.mss < mss {
+		res.mss = h.mss
+	}
+	if h.reliable && cfg.Reliable {
+		res.reliable, res.window = true, h.window
+		if cfg.SendWindow < res.window {
+			res.window = cfg.SendWindow
+		}
+	}
+	//The dialer chooses the group size
+	if h.fecData > 0 && cfg.FECData > 0 && cfg.FECParity > 0 {
+		res.fecData, res.fecParity = h.fecData, h.fecParity
+	}
+	res.mimic = h.mimic && cfg.Mimicry
+	res.congestion = h.congestion && cfg.Congestion
+
+	if h.key == nil {
+		if cfg.Encrypt {
+			return nil, fmt.Errorf("encryption required")
+		}
+		return res, nil
+	}
+
+	if priv == nil {
+		var err error
+		if priv, err = newX25519Key(); err != nil {
+			return nil, err
+		}
+	}
+	shared, err := x25519Shared(priv, h.key)
+	if err != nil {
+		return nil, err
+	}
+	res.key = priv.PublicKey().Bytes()
+	res.recvKey, res.sendKey = deriveKeys(shared, cfg.PSK, h.key, res.key)
+	return res, nil
+}
+
+//Check the options granted by the listener and derive the payload keys
+func (h *hello) complete(granted *hello, cfg *ConnConfig) error {
+	if h.priv == nil {
+		if granted.key != nil {
+			return fmt.Errorf("encryption not requested")
+		}
+		return nil
+	}
+	if granted.key == nil {
+		return fmt.Errorf("encryption refused by the listener")
+	}
+
+	shared, err := x25519Shared(h.priv, granted.key)
+	if err != nil {
+		return err
+	}
+	granted.sendKey, granted.recvKey = deriveKeys(shared, cfg.PSK, h.key, granted.key)
+	return nil
+}
+
+func appendTLV(b []byte, t byte, v []byte) []byte {
+	b = append(b, t, byte(len(v)))
+	return append(b, v...)
+}
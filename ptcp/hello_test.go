@@ -0,0 +1,59 @@
+package ptcp
+
+import (
+	"testing"
+)
+
+func TestHelloMarshal(t *testing.T) {
+	h := &hello{reliable: true, window: 64, fecData: 4, fecParity: 2, mimic: true, congestion: true, mss: 1400}
+	p, err := parseHello(h.marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.reliable || p.window != 64 || p.fecData != 4 || p.fecParity != 2 || !p.mimic || !p.congestion || p.mss != 1400 || p.key != nil {
+		t.Fatalf("%+v", p)
+	}
+
+	//Empty payload of the older peers, unknown options are skipped
+	for _, b := range [][]byte{{}, {99, 1, 0}} {
+		if p, err = parseHello(b); err != nil || p.reliable || p.mss != 0 {
+			t.Fatal(b, err)
+		}
+	}
+}
+
+func TestParseHelloInvalid(t *testing.T) {
+	for _, b := range [][]byte{
+		{HELLORELIABLE, 2, 0},
+		{HELLORELIABLE, 2, 0, 0},
+		{HELLORELIABLE, 1, 1},
+		{HELLOFEC, 2, 4, 0},
+		{HELLOKEY, 1, 0},
+		{HELLOMSS, 2, 0, 0},
+		{HELLOAUTH, 0, HELLOMIMIC, 0},
+		{HELLOMIMIC},
+	} {
+		if _, err := parseHello(b); err == nil {
+			t.Fatal("parsed", b)
+		}
+	}
+}
+
+func TestHelloAccept(t *testing.T) {
+	dialer, err := newHello(&ConnConfig{Reliable: true, SendWindow: 64, FECData: 4, FECParity: 2, Mimicry: true}, 1400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	granted, err := dialer.accept(&ConnConfig{Reliable: true, SendWindow: 32, FECData: 1, FECParity: 1}, nil, 1460)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//The smaller window and MSS, the dialer's FEC groups, no mimicry without the listener
+	if !granted.reliable || granted.window != 32 || granted.mss != 1400 || granted.fecData != 4 || granted.fecParity != 2 || granted.mimic {
+		t.Fatalf("%+v", granted)
+	}
+
+	if granted, err = dialer.accept(&ConnConfig{}, nil, 1000); err != nil || granted.reliable || granted.fecData != 0 || granted.mss != 1000 {
+		t.Fatalf("%+v %v", granted, err)
+	}
+}
@@ -0,0 +1,279 @@
+package ptcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+//Socket options missing in the syscall package: linux/icmp.h, and linux/in6.h since Linux 4.5
+const (
+	ICMP_FILTER  = 1
+	IPV6_HDRINCL = 36
+)
+
+//Sockets of L3Raw
+const (
+	l3TCP4 = iota
+	l3ICMP4
+	l3TCP6
+	l3ICMP6
+)
+
+//L3Raw is the Link of the raw IP sockets. The kernel routes the packets and resolves the next hops,
+//so it works on the interfaces without Ethernet framing: tun, WireGuard, PPP...
+//The TCP sockets carry the packets with IP_HDRINCL, the ICMP ones only get the "too big" messages for the path MTU.
+type L3Raw struct {
+	iface *net.Interface
+	//Indexed by l3TCP4...l3ICMP6, the ipv6 ones are -1 if ipv6 is disabled
+	fds [4]int
+	//Sockets with packets to read since the last poll
+	ready [4]bool
+	buf   []byte
+	oob   []byte
+}
+
+func NewL3Raw(interfaceName string) (*L3Raw, error) {
+	iface, err := net.InterfaceByName(interfaceName)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &L3Raw{
+		iface: iface,
+		fds:   [4]int{-1, -1, -1, -1},
+		buf:   make([]byte, RAWBUFSIZE),
+		oob:   make([]byte, syscall.CmsgSpace(syscall.SizeofInet6Pktinfo)),
+	}
+	if r.fds[l3TCP4], err = l3Socket(syscall.AF_INET, syscall.IPPROTO_TCP, interfaceName); err != nil {
+		r.Close()
+		return nil, err
+	}
+	if err = syscall.SetsockoptInt(r.fds[l3TCP4], syscall.IPPROTO_IP, syscall.IP_HDRINCL, 1); err != nil {
+		r.Close()
+		return nil, err
+	}
+	if r.fds[l3ICMP4], err = l3Socket(syscall.AF_INET, syscall.IPPROTO_ICMP, interfaceName); err != nil {
+		r.Close()
+		return nil, err
+	}
+	//Only the destination unreachable messages. The mask is converted at run time, the constant overflows an int on 32 bits
+	mask := ^uint32(1 << 3)
+	if err = syscall.SetsockoptInt(r.fds[l3ICMP4], syscall.SOL_RAW, ICMP_FILTER, int(int32(mask))); err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	if err = r.openIpv6(interfaceName); err != nil {
+		//Without ipv6, only the ipv4 sockets are used
+		for _, i := range []int{l3TCP6, l3ICMP6} {
+			if r.fds[i] >= 0 {
+				syscall.Close(r.fds[i])
+				r.fds[i] = -1
+			}
+		}
+	}
+	return r, nil
+}
+
+//The raw ipv6 sockets give the packets without their IP header, the destination comes in the IPV6_PKTINFO
+func (r *L3Raw) openIpv6(interfaceName string) error {
+	var err error
+	if r.fds[l3TCP6], err = l3Socket(syscall.AF_INET6, syscall.IPPROTO_TCP, interfaceName); err != nil {
+		return err
+	}
+	if err = syscall.SetsockoptInt(r.fds[l3TCP6], syscall.IPPROTO_IPV6, IPV6_HDRINCL, 1); err != nil {
+		return err
+	}
+	if r.fds[l3ICMP6], err = l3Socket(syscall.AF_INET6, syscall.IPPROTO_ICMPV6, interfaceName); err != nil {
+		return err
+	}
+	//Only the packet too big messages
+	filter := &syscall.ICMPv6Filter{}
+	for i := range filter.Data {
+		filter.Data[i] = 0xffffffff
+	}
+	filter.Data[0] &^= 1 << 2
+	if err = syscall.SetsockoptICMPv6Filter(r.fds[l3ICMP6], syscall.SOL_ICMPV6, syscall.ICMPV6_FILTER, filter); err != nil {
+		return err
+	}
+	for _, i := range []int{l3TCP6, l3ICMP6} {
+		if err = syscall.SetsockoptInt(r.fds[i], syscall.IPPROTO_IPV6, syscall.IPV6_RECVPKTINFO, 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func l3Socket(family int, proto int, interfaceName string) (int, error) {
+	fd, err := syscall.Socket(family, syscall.SOCK_RAW, proto)
+	if err != nil {
+		return -1, err
+	}
+	if err = syscall.BindToDevice(fd, interfaceName); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+//Next packet of the sockets, it waits at most RAWREADTIMEOUT ms
+func (r *L3Raw) Read() ([]byte, error) {
+	for polled := false; ; polled = true {
+		for i, fd := range r.fds {
+			if !r.ready[i] {
+				continue
+			}
+			packet, err := r.recv(i, fd)
+			if err == syscall.EAGAIN {
+				r.ready[i] = false
+				continue
+			}
+			return packet, err
+		}
+		if polled {
+			return nil, syscall.EAGAIN
+		}
+		if err := r.poll(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (r *L3Raw) recv(i int, fd int) ([]byte, error) {
+	if i == l3TCP4 || i == l3ICMP4 {
+		n, _, err := syscall.Recvfrom(fd, r.buf, syscall.MSG_DONTWAIT)
+		if err != nil {
+			return nil, err
+		}
+		return r.buf[:n], nil
+	}
+
+	//Room for the rebuilt header
+	n, oobn, _, from, err := syscall.Recvmsg(fd, r.buf[IPV6HEADERLEN:], r.oob, syscall.MSG_DONTWAIT)
+	if err != nil {
+		return nil, err
+	}
+	src, ok := from.(*syscall.SockaddrInet6)
+	if !ok || n > 65535 {
+		return nil, fmt.Errorf("invalid ipv6 packet")
+	}
+	msgs, err := syscall.ParseSocketControlMessage(r.oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	var dst []byte
+	for _, msg := range msgs {
+		if msg.Header.Level == syscall.IPPROTO_IPV6 && msg.Header.Type == syscall.IPV6_PKTINFO && len(msg.Data) >= net.IPv6len {
+			dst = msg.Data[:net.IPv6len]
+		}
+	}
+	if dst == nil {
+		return nil, fmt.Errorf("no destination of ipv6 packet")
+	}
+
+	packet := r.buf[:IPV6HEADERLEN+n]
+	for i := range packet[:IPV6HEADERLEN] {
+		packet[i] = 0
+	}
+	packet[0] = 0x60
+	binary.BigEndian.PutUint16(packet[4:], uint16(n))
+	packet[6], packet[7] = syscall.IPPROTO_TCP, 64
+	if i == l3ICMP6 {
+		packet[6] = syscall.IPPROTO_ICMPV6
+	}
+	copy(packet[8:24], src.Addr[:])
+	copy(packet[24:40], dst)
+	return packet, nil
+}
+
+//Mark the sockets with packets to read, none on timeout
+func (r *L3Raw) poll() error {
+	type pollFd struct {
+		fd      int32
+		events  int16
+		revents int16
+	}
+	pfds := make([]pollFd, 0, len(r.fds))
+	index := make([]int, 0, len(r.fds))
+	for i, fd := range r.fds {
+		if fd >= 0 {
+			pfds = append(pfds, pollFd{fd: int32(fd), events: POLLIN})
+			index = append(index, i)
+		}
+	}
+	ts := syscall.NsecToTimespec(int64(RAWREADTIMEOUT) * int64(time.Millisecond))
+	_, _, errno := syscall.Syscall6(syscall.SYS_PPOLL, uintptr(unsafe.Pointer(&pfds[0])), uintptr(len(pfds)), uintptr(unsafe.Pointer(&ts)), 0, 0, 0)
+	if errno != 0 && errno != syscall.EINTR {
+		return errno
+	}
+	for j, pfd := range pfds {
+		if pfd.revents&(POLLERR|POLLNVAL) != 0 {
+			return fmt.Errorf("raw socket poll failed")
+		}
+		r.ready[index[j]] = pfd.revents&POLLIN != 0
+	}
+	return nil
+}
+
+//The packet is routed by the kernel, its IP header is kept
+func (r *L3Raw) Write(data []byte) error {
+	_, dstIp, _, err := parseIp(data)
+	if err != nil {
+		return err
+	}
+	if ip4 := dstIp.To4(); ip4 != nil {
+		addr := &syscall.SockaddrInet4{}
+		copy(addr.Addr[:], ip4)
+		return syscall.Sendto(r.fds[l3TCP4], data, 0, addr)
+	}
+	if r.fds[l3TCP6] < 0 {
+		return fmt.Errorf("ipv6 not available on %v", r.iface.Name)
+	}
+	addr := &syscall.SockaddrInet6{}
+	copy(addr.Addr[:], dstIp.To16())
+	return syscall.Sendto(r.fds[l3TCP6], data, 0, addr)
+}
+
+//Attach a BPF filter to the TCP sockets which drops in the kernel the packets of the other ports
+func (r *L3Raw) SetPorts(ports []uint16) error {
+	for _, i := range []int{l3TCP4, l3TCP6} {
+		if r.fds[i] < 0 {
+			continue
+		}
+		filter, err := l3PortFilterProgram(ports, i == l3TCP6)
+		if err != nil {
+			return err
+		}
+		if err = syscall.AttachLsf(r.fds[i], filter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *L3Raw) MTU() int {
+	return r.iface.MTU
+}
+
+//nil for the interfaces without link-layer address
+func (r *L3Raw) HardwareAddr() net.HardwareAddr {
+	return r.iface.HardwareAddr
+}
+
+func (r *L3Raw) Close() error {
+	var err error
+	for i, fd := range r.fds {
+		if fd < 0 {
+			continue
+		}
+		if e := syscall.Close(fd); e != nil && err == nil {
+			err = e
+		}
+		r.fds[i] = -1
+	}
+	return err
+}
@@ -0,0 +1,24 @@
+package ptcp
+
+import (
+	"net"
+)
+
+//Link is the packet I/O backend of a Stack.
+//Read and Write carry whole IP packets, the backend does the link-layer framing.
+type Link interface {
+	//Block until a packet is received or the read times out
+	Read() ([]byte, error)
+	Write(data []byte) error
+	MTU() int
+	HardwareAddr() net.HardwareAddr
+	Close() error
+}
+
+//BatchLink is a Link which receives and sends several packets per syscall. The stack uses it instead of Read/Write.
+type BatchLink interface {
+	Link
+	//Block until at least one packet is received or the read times out. The packets are valid until the next read.
+	ReadBatch() ([][]byte, error)
+	WriteBatch(packets [][]byte) error
+}
@@ -0,0 +1,253 @@
+package ptcp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xitongsys/ptcp/netinfo"
+)
+
+//The benchmark server runs in the netns BENCHNS behind a veth pair, so that the packets
+//go through the real AF_PACKET sockets of both stacks
+const (
+	BENCHNS     = "ptcpbench"
+	BENCHIFACE  = "ptcpb0"
+	BENCHPEER   = "ptcpb1"
+	BENCHLOCAL  = "10.97.0.1"
+	BENCHREMOTE = "10.97.0.2"
+	//Interval of the received byte counts sent back by the server
+	BENCHREPORT = 20 * time.Millisecond
+	//Link type of benchFrameStack, the AF_PACKET socket read and written one frame per syscall
+	BENCHFRAME = -1
+)
+
+//frameLink hides the batch methods of a Raw, the stack falls back to Read/Write
+type frameLink struct{ Link }
+
+func (l frameLink) SetPorts(ports []uint16) error {
+	return l.Link.(portFilter).SetPorts(ports)
+}
+
+//Stack on a Raw of iface without ReadBatch/WriteBatch, one recvfrom/sendto per frame
+func benchFrameStack(iface string) (*Stack, error) {
+	arp, err := netinfo.NewArp()
+	if err != nil {
+		return nil, err
+	}
+	route, err := netinfo.NewRoute()
+	if err != nil {
+		return nil, err
+	}
+	route6, err := netinfo.NewRoute6()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	neigh, err := netinfo.NewNeigh()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := NewRaw(iface, route, arp, route6, neigh)
+	if err != nil {
+		return nil, err
+	}
+	return NewStack(&Config{Link: frameLink{raw}})
+}
+
+//Stack of one of the link types compared by BenchmarkLinkType
+func benchStack(iface string, linkType int) (*Stack, error) {
+	if linkType == BENCHFRAME {
+		return benchFrameStack(iface)
+	}
+	return NewStack(&Config{Interface: iface, LinkType: linkType})
+}
+
+//Serve ptcp on the interface, link type and address in PTCPBENCHSERVER.
+//Each conn gets back the count of bytes received on it every BENCHREPORT.
+//It's started by BenchmarkLinkType in BENCHNS and does nothing in a normal test run.
+func TestLinkBenchServer(t *testing.T) {
+	args := strings.Fields(os.Getenv("PTCPBENCHSERVER"))
+	if len(args) != 3 {
+		t.Skip("benchmark helper")
+	}
+	linkType, _ := strconv.Atoi(args[1])
+	s, err := benchStack(args[0], linkType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ln, err := s.Listen("ptcp", args[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Println("ready")
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go serveBenchConn(c)
+	}
+}
+
+func serveBenchConn(c net.Conn) {
+	defer c.Close()
+	var received uint64
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		msg := make([]byte, 8)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(BENCHREPORT):
+			}
+			binary.BigEndian.PutUint64(msg, atomic.LoadUint64(&received))
+			c.Write(msg)
+		}
+	}()
+	buf := make([]byte, 65535)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return
+		}
+		atomic.AddUint64(&received, uint64(n))
+	}
+}
+
+func benchRun(b *testing.B, cmd string, args ...string) {
+	if out, err := exec.Command(cmd, args...).CombinedOutput(); err != nil {
+		b.Skip(cmd, args, err, string(out))
+	}
+}
+
+//Veth pair BENCHIFACE-BENCHPEER with BENCHPEER in BENCHNS
+func benchNetns(b *testing.B) {
+	if os.Geteuid() != 0 {
+		b.Skip("needs root")
+	}
+	exec.Command("ip", "netns", "del", BENCHNS).Run()
+	benchRun(b, "ip", "netns", "add", BENCHNS)
+	b.Cleanup(func() { exec.Command("ip", "netns", "del", BENCHNS).Run() })
+	benchRun(b, "ip", "link", "add", BENCHIFACE, "type", "veth", "peer", "name", BENCHPEER, "netns", BENCHNS)
+	benchRun(b, "ip", "addr", "add", BENCHLOCAL+"/24", "dev", BENCHIFACE)
+	benchRun(b, "ip", "link", "set", BENCHIFACE, "up")
+	benchRun(b, "ip", "netns", "exec", BENCHNS, "ip", "addr", "add", BENCHREMOTE+"/24", "dev", BENCHPEER)
+	benchRun(b, "ip", "netns", "exec", BENCHNS, "ip", "link", "set", BENCHPEER, "up")
+}
+
+//Start TestLinkBenchServer in BENCHNS and wait until it listens
+func benchServer(b *testing.B, linkType int, addr string) {
+	cmd := exec.Command("ip", "netns", "exec", BENCHNS, os.Args[0], "-test.run=^TestLinkBenchServer$")
+	cmd.Env = append(os.Environ(), fmt.Sprintf("PTCPBENCHSERVER=%s %d %s", BENCHPEER, linkType, addr))
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	ready := make(chan bool, 1)
+	go func() {
+		sc := bufio.NewScanner(out)
+		for sc.Scan() {
+			if sc.Text() == "ready" {
+				ready <- true
+			}
+		}
+		ready <- false
+	}()
+	select {
+	case ok := <-ready:
+		if !ok {
+			b.Fatal("benchmark server failed")
+		}
+	case <-time.After(10 * time.Second):
+		b.Fatal("benchmark server timeout")
+	}
+}
+
+//Send b.N max payload packets on a new conn and report the rate of the bytes received by the server
+func benchSend(b *testing.B, s *Stack, addr string) {
+	c, err := s.Dial("ptcp", addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	conn := c.(*Conn)
+	defer conn.Close()
+
+	var received uint64
+	go func() {
+		msg := make([]byte, 8)
+		for {
+			n, err := conn.Read(msg)
+			if err != nil {
+				return
+			}
+			if n == 8 {
+				atomic.StoreUint64(&received, binary.BigEndian.Uint64(msg))
+			}
+		}
+	}()
+
+	buf := make([]byte, conn.MaxPayload())
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+	elapsed := time.Since(start)
+	b.StopTimer()
+
+	//The count is final once it stops changing
+	last := uint64(0)
+	for i := 0; i < 100; i++ {
+		time.Sleep(5 * BENCHREPORT)
+		cur := atomic.LoadUint64(&received)
+		if cur == last && cur > 0 {
+			break
+		}
+		last = cur
+	}
+	sent := float64(b.N * len(buf))
+	b.ReportMetric(float64(last)/elapsed.Seconds()/1e6, "recv-MB/s")
+	b.ReportMetric(100*(sent-float64(last))/sent, "%lost")
+}
+
+//Throughput counted by the bytes received on the other side, both ends use the same link:
+//frame: AF_PACKET socket, one recvfrom/sendto per frame (Raw.Read/Write)
+//packet: LINKPACKET, AF_PACKET socket with recvmmsg/sendmmsg (Raw.ReadBatch/WriteBatch)
+//ring: LINKRING, TPACKET_V3 mmap rings
+func BenchmarkLinkType(b *testing.B) {
+	benchNetns(b)
+	for i, lt := range []struct {
+		name string
+		typ  int
+	}{{"frame", BENCHFRAME}, {"packet", LINKPACKET}, {"ring", LINKRING}} {
+		addr := fmt.Sprintf("%s:%d", BENCHREMOTE, 12222+i)
+		benchServer(b, lt.typ, addr)
+		s, err := benchStack(BENCHIFACE, lt.typ)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(lt.name, func(b *testing.B) { benchSend(b, s, addr) })
+		s.Close()
+	}
+}
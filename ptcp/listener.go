@@ -1,7 +1,10 @@
 package ptcp
 
 import (
+	"context"
+	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/patrickmn/go-cache"
@@ -10,98 +13,322 @@ import (
 
 var LISTENERBUFSIZE = 1024
 
-func Listen(proto, addr string) (net.Listener, error) {
-	if _, err := net.Listen("tcp", addr); err != nil {
+//Default max pending handshakes of a listener without SYN cookies
+var LISTENERMAXPENDING = 1024
+
+//Default max SYN-ACKs re-sent per second by a listener
+var LISTENERRESENDRATE = 100
+
+//Interval in ms between two resends of the SYN-ACKs of the pending handshakes
+var LISTENERRESENDINTERVAL = 500
+
+func (s *Stack) Listen(proto, addr string) (net.Listener, error) {
+	return s.ListenWithConfig(proto, addr, &s.cfg.Conn)
+}
+
+//The options of the accepted conns are negotiated between cfg and the dialer's config
+func (s *Stack) ListenWithConfig(proto, addr string, cfg *ConnConfig) (net.Listener, error) {
+	if s.isClosed() {
+		return nil, fmt.Errorf("stack closed")
+	}
+
+	addr, err := normalizeAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.ports.reserve(addr); err != nil {
 		return nil, err
 	}
 
-	if listener, err := NewListener(addr); err == nil {
-		ptcpServer.CreateListener(addr, listener)
+	if err := s.addRSTFilter(addr, ""); err != nil {
+		s.ports.release(addr)
+		return nil, err
+	}
+
+	if listener, err := NewListener(s, cfg, addr); err == nil {
+		s.CreateListener(addr, listener)
 		return listener, err
 
 	} else {
+		s.removeRSTFilter(addr, "")
+		s.ports.release(addr)
 		return nil, err
 	}
 }
 
 type Listener struct {
+	stack      *Stack
+	cfg        ConnConfig
 	Address    string
 	InputChan  chan string
 	OutputChan chan string
 
 	requestCache *cache.Cache
+	//nil if the SYNs are not signed
+	auth *authChecker
+	//nil without SynCookies
+	cookies *cookieJar
+	//nil if the listener isn't the one of a PacketConn
+	packetConn *PacketConn
+	done       chan struct{}
+	closeOnce  sync.Once
 }
 
-func NewListener(addr string) (*Listener, error) {
+//A SYN answered by the listener, waiting for the final ACK
+type pendingRequest struct {
+	//Payload of the SYN, a retransmitted SYN gets the same response
+	syn      string
+	response string
+	hello    *hello
+	resends  int
+	//ISN of the SYN-ACK
+	isn uint32
+}
+
+func NewListener(stack *Stack, cfg *ConnConfig, addr string) (*Listener, error) {
 	listener := &Listener{
+		stack:      stack,
+		cfg:        cfg.normalize(),
 		Address:    addr,
 		InputChan:  make(chan string, LISTENERBUFSIZE),
-		OutputChan: make(chan string, LISTENERBUFSIZE),
+		OutputChan: stack.output,
 
 		requestCache: cache.New(10*time.Second, 1*time.Minute),
+		done:         make(chan struct{}),
+	}
+	if listener.cfg.AuthKey != nil {
+		listener.auth = newAuthChecker(listener.cfg.AuthKey)
+	}
+	if listener.cfg.SynCookies {
+		var err error
+		if listener.cookies, err = newCookieJar(); err != nil {
+			return nil, err
+		}
 	}
 	listener.sendResponse()
 	return listener, nil
 }
 
+//Re-send the SYN-ACKs of the pending handshakes, at most RETRYTIME times each and ResendRate per second
 func (l *Listener) sendResponse() {
 	go func() {
+		ticker := time.NewTicker(time.Millisecond * time.Duration(LISTENERRESENDINTERVAL))
+		defer ticker.Stop()
 		for {
+			select {
+			case <-l.done:
+				return
+			case <-ticker.C:
+			}
+
+			budget := l.cfg.ResendRate * LISTENERRESENDINTERVAL / 1000
+			if budget < 1 {
+				budget = 1
+			}
 			items := l.requestCache.Items()
 			for src := range items {
-				if respi, ok := l.requestCache.Get(src); ok {
-					resp := respi.(string)
-					l.OutputChan <- resp
+				if budget == 0 {
+					break
+				}
+				if reqi, ok := l.requestCache.Get(src); ok {
+					req := reqi.(*pendingRequest)
+					if req.resends < RETRYTIME {
+						req.resends++
+						budget--
+						trySend(l.OutputChan, req.response)
+					}
 				}
 			}
-			time.Sleep(time.Millisecond * 500)
 		}
 	}()
 }
 
 func (l *Listener) Accept() (net.Conn, error) {
+	return l.AcceptContext(context.Background())
+}
+
+//AcceptContext returns when a handshake is done, the ctx is done or the listener is closed
+func (l *Listener) AcceptContext(ctx context.Context) (net.Conn, error) {
 	for {
-		packet := <-l.InputChan
-		_, ipHeader, _, tcpHeader, data, _ := header.Get([]byte(packet))
-		src, dst := header.GetTcpAddr(ipHeader, tcpHeader)
-		if tcpHeader.Flags == header.SYN && len(data) == 0 {
-			seq, ack := 0, tcpHeader.Seq+1
-			ipHeaderTo, tcpHeaderTo := header.BuildTcpHeader(dst, src)
-			tcpHeaderTo.Seq, tcpHeaderTo.Ack = uint32(seq), uint32(ack)
-			tcpHeaderTo.Flags = (header.SYN | header.ACK)
-			response := string(header.BuildTcpPacket(ipHeaderTo, tcpHeaderTo, []byte{}))
-			l.requestCache.Set(src, response, cache.DefaultExpiration)
-			l.OutputChan <- response
-
-		} else if tcpHeader.Flags == header.ACK {
-			if _, ok := l.requestCache.Get(src); ok {
+		var packet string
+		select {
+		case packet = <-l.InputChan:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-l.done:
+			return nil, fmt.Errorf("listener closed")
+		}
+		sg, err := parseSegment([]byte(packet))
+		if err != nil {
+			continue
+		}
+		src, dst := sg.src, sg.dst
+		//Packets sent right after the final ACK, before the conn was created
+		if value, ok := l.stack.router.Load(connKey(dst, src)); ok {
+			value.(*Conn).input(packet, sg)
+			continue
+		}
+
+		if sg.flags == header.SYN {
+			//The granted keys must not change when the SYN is retransmitted
+			if reqi, ok := l.requestCache.Get(src); ok && reqi.(*pendingRequest).syn == string(sg.data) {
+				trySend(l.OutputChan, reqi.(*pendingRequest).response)
+				continue
+			}
+
+			h, err := parseHello(sg.data)
+			if err != nil {
+				continue
+			}
+			if l.auth != nil && l.auth.check(h, src, dst, l.cookies == nil) != nil {
+				continue
+			}
+
+			if l.cookies != nil {
+				l.cookieResponse(sg, h)
+				continue
+			}
+			if l.requestCache.ItemCount() >= l.cfg.MaxPending {
+				//The count includes the expired requests until the janitor runs
+				l.requestCache.DeleteExpired()
+				if l.requestCache.ItemCount() >= l.cfg.MaxPending {
+					continue
+				}
+			}
+
+			granted, err := h.accept(&l.cfg, nil, l.stack.mss(&l.cfg, src))
+			if err != nil {
+				continue
+			}
+			isn := uint32(0)
+			if granted.mimic {
+				if isn, err = randomIsn(); err != nil {
+					continue
+				}
+			}
+			response := string(l.synAck(sg, isn, granted))
+			l.requestCache.Set(src, &pendingRequest{
+				syn:      string(sg.data),
+				response: response,
+				hello:    granted,
+				isn:      isn,
+			}, cache.DefaultExpiration)
+			trySend(l.OutputChan, response)
+
+		} else if sg.flags == header.ACK {
+			if reqi, ok := l.requestCache.Get(src); ok {
+				req := reqi.(*pendingRequest)
+				//It must acknowledge the SYN-ACK, whose ISN is random in mimicry mode
+				if sg.ack != req.isn+1 {
+					continue
+				}
 				l.requestCache.Delete(src)
-				conn := NewConn(dst, src, CONNECTED)
-				ptcpServer.CreateConn(dst, src, conn)
+				conn := l.newConn(dst, src)
+				conn.sndIsn, conn.sndNxt = req.isn, req.isn+1
+				if err := conn.establish(req.hello, sg.seq); err != nil {
+					conn.Close()
+					continue
+				}
+				l.createConn(conn)
 				return conn, nil
+
+			} else if l.cookies != nil {
+				if conn := l.cookieConn(sg); conn != nil {
+					return conn, nil
+				}
 			}
 		}
 	}
 }
 
+//Answer a SYN without keeping any state, the ISN is the cookie
+func (l *Listener) cookieResponse(sg *segment, h *hello) {
+	src, dst := sg.src, sg.dst
+	cookie := l.cookies.make(time.Now(), src, dst, sg.data)
+	priv, err := l.cookies.privateKey(cookie, src, dst, sg.data)
+	if err != nil {
+		return
+	}
+	granted, err := h.accept(&l.cfg, priv, l.stack.mss(&l.cfg, src))
+	if err != nil {
+		return
+	}
+	trySend(l.OutputChan, string(l.synAck(sg, cookie, granted)))
+}
+
+//SYN-ACK with the options of a TCP stack in mimicry mode
+func (l *Listener) synAck(sg *segment, isn uint32, granted *hello) []byte {
+	var options []byte
+	if granted.mimic {
+		options = synOptions(l.stack.mss(&l.cfg, sg.src), isn, synTimestamp(sg))
+	}
+	return buildPacketWithOptions(sg.dst, sg.src, isn, sg.seq+1, header.SYN|header.ACK, options, granted.marshal())
+}
+
+//Check the cookie of a final ACK and rebuild the handshake from the echoed SYN options.
+//The SYN was already authenticated when its cookie was made.
+func (l *Listener) cookieConn(sg *segment) *Conn {
+	src, dst := sg.src, sg.dst
+	cookie := sg.ack - 1
+	if !l.cookies.check(time.Now(), cookie, src, dst, sg.data) {
+		return nil
+	}
+
+	h, err := parseHello(sg.data)
+	if err != nil {
+		return nil
+	}
+	priv, err := l.cookies.privateKey(cookie, src, dst, sg.data)
+	if err != nil {
+		return nil
+	}
+	granted, err := h.accept(&l.cfg, priv, l.stack.mss(&l.cfg, src))
+	if err != nil {
+		return nil
+	}
+
+	conn := l.newConn(dst, src)
+	conn.sndIsn, conn.sndNxt = cookie, cookie+1
+	if err := conn.establish(granted, sg.seq); err != nil {
+		conn.Close()
+		return nil
+	}
+	l.createConn(conn)
+	return conn
+}
+
+//Conn of a finished handshake, CONNECTING until it's established. The conns of a PacketConn have no goroutine and channel of their own.
+func (l *Listener) newConn(localAddr string, remoteAddr string) *Conn {
+	if l.packetConn != nil {
+		return l.packetConn.newConn(localAddr, remoteAddr)
+	}
+	return newConn(l.stack, &l.cfg, localAddr, remoteAddr, CONNECTING, make(chan string, CONNCHANBUFSIZE), l.stack.output)
+}
+
+//Register an established conn, the other goroutines see it only from here
+func (l *Listener) createConn(conn *Conn) {
+	conn.setState(CONNECTED)
+	if l.packetConn != nil {
+		l.packetConn.createConn(conn)
+		return
+	}
+	l.stack.CreateConn(conn.LocalAddr().String(), conn.RemoteAddr().String(), conn)
+	go conn.keepAlive()
+}
+
 func (l *Listener) Close() error {
-	go func() {
-		defer func() {
-			recover()
-		}()
-		close(l.InputChan)
-	}()
+	//InputChan stays open, the stack may still be sending to it. Accept waits on done.
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.stack.removeRSTFilter(l.Address, "")
+		l.stack.ports.release(l.Address)
+	})
 
-	go func() {
-		defer func() {
-			recover()
-		}()
-		close(l.OutputChan)
-	}()
-	ptcpServer.CloseListener(l.Address)
+	l.stack.CloseListener(l.Address)
 	return nil
 }
 
 func (l *Listener) Addr() net.Addr {
-	return nil
+	return NewAddr(l.Address)
 }
@@ -0,0 +1,156 @@
+package ptcp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+
+	"github.com/xitongsys/ethernet-go/header"
+)
+
+//Window scale announced in the SYNs of the mimicry mode
+var MIMICWSCALE = 7
+
+//NOP NOP TS
+const TIMESTAMPOPTLEN = 12
+
+//mimicState makes the segments of a conn look like a TCP flow.
+//The header seq/ack count the payload bytes from the ISNs, and the packet sequence numbers
+//of ptcp move to the timestamps option: TSval is the seq and TSecr is the ack - 1.
+type mimicState struct {
+	mu sync.Mutex
+	//Header seq of the next segment
+	sndNxt uint32
+	//Header ack: end of the highest payload received
+	rcvNxt uint32
+}
+
+func newMimicState(sndIsn uint32, rcvIsn uint32) *mimicState {
+	return &mimicState{
+		sndNxt: sndIsn + 1,
+		rcvNxt: rcvIsn + 1,
+	}
+}
+
+//Move the packet sequence numbers to the timestamps and put the byte ones in the header
+func (m *mimicState) output(sg *segment, window uint16) {
+	m.mu.Lock()
+	tsval, tsecr := sg.seq, sg.ack-1
+	sg.seq, sg.ack = m.sndNxt, m.rcvNxt
+	if sg.flags&header.PSH != 0 {
+		m.sndNxt += uint32(len(sg.data))
+	}
+	m.mu.Unlock()
+
+	sg.options = append(timestampOption(tsval, tsecr), sg.options...)
+	sg.window = window
+}
+
+//Restore the packet sequence numbers of a received segment
+func (m *mimicState) input(sg *segment) {
+	v, ok := sg.option(TCPOPTTIMESTAMP)
+	if !ok || len(v) != 8 {
+		return
+	}
+
+	if sg.flags&header.PSH != 0 {
+		m.mu.Lock()
+		if end := sg.seq + uint32(len(sg.data)); seqLess(m.rcvNxt, end) {
+			m.rcvNxt = end
+		}
+		m.mu.Unlock()
+	}
+	sg.seq, sg.ack = binary.BigEndian.Uint32(v), binary.BigEndian.Uint32(v[4:])+1
+}
+
+//NOP NOP TS, as in the segments of Linux
+func timestampOption(tsval uint32, tsecr uint32) []byte {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint32(v, tsval)
+	binary.BigEndian.PutUint32(v[4:], tsecr)
+	return appendOption([]byte{TCPOPTNOP, TCPOPTNOP}, TCPOPTTIMESTAMP, v)
+}
+
+//Options of a SYN in the order of Linux: MSS, SACK permitted, TS, NOP, window scale
+func synOptions(mss int, tsval uint32, tsecr uint32) []byte {
+	opts := appendOption([]byte{}, TCPOPTMSS, []byte{byte(mss >> 8), byte(mss)})
+	opts = appendOption(opts, TCPOPTSACKPERMITTED, []byte{})
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint32(v, tsval)
+	binary.BigEndian.PutUint32(v[4:], tsecr)
+	opts = appendOption(opts, TCPOPTTIMESTAMP, v)
+	opts = append(opts, TCPOPTNOP)
+	return appendOption(opts, TCPOPTWSCALE, []byte{byte(MIMICWSCALE)})
+}
+
+//MSS of the link MTU without the IP and TCP headers
+func synMSS(mtu int, addr string) int {
+	return mtu - ipHeaderLen(addr) - TCPHEADERLEN
+}
+
+//TSval of a SYN, 0 if it has no timestamps option
+func synTimestamp(sg *segment) uint32 {
+	if v, ok := sg.option(TCPOPTTIMESTAMP); ok && len(v) == 8 {
+		return binary.BigEndian.Uint32(v)
+	}
+	return 0
+}
+
+func randomIsn() (uint32, error) {
+	v := make([]byte, 4)
+	if _, err := rand.Read(v); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(v), nil
+}
+
+//Build a packet of the conn, seq and ack are the packet sequence numbers
+func (conn *Conn) packet(seq uint32, ack uint32, flags uint8, options []byte, data []byte) []byte {
+	sg := &segment{
+		src:     conn.LocalAddr().String(),
+		dst:     conn.RemoteAddr().String(),
+		seq:     seq,
+		ack:     ack,
+		flags:   flags,
+		options: options,
+		data:    data,
+	}
+	if conn.mimic != nil {
+		conn.mimic.output(sg, conn.window())
+	}
+	//The seqs an ICMP "too big" may quote, bytes in mimicry mode
+	if flags&header.PSH != 0 {
+		n, span := uint32(1), uint32(PMTUSEQWINDOW)
+		if conn.mimic != nil {
+			n, span = uint32(len(data)), span*uint32(conn.pmtu.get())
+		}
+		conn.pmtu.sent(sg.seq, n, span)
+	}
+	packet, err := sg.marshal()
+	if err != nil {
+		return []byte{}
+	}
+	return packet
+}
+
+//Receive window in the announced scale, from the free room of InputChan
+func (conn *Conn) window() uint16 {
+	free := cap(conn.InputChan) - len(conn.InputChan)
+	w := free * synMSS(conn.stack.link.MTU(), conn.RemoteAddr().String()) >> uint(MIMICWSCALE)
+	if w < 1 {
+		w = 1
+	}
+	if w > 0xffff {
+		w = 0xffff
+	}
+	return uint16(w)
+}
+
+//Parse a control packet read from InputChan, with the packet sequence numbers in mimicry mode
+func (conn *Conn) parseControl(b []byte) (*segment, error) {
+	sg, err := parseSegment(b)
+	if err == nil && conn.mimic != nil {
+		conn.mimic.input(sg)
+	}
+	return sg, err
+}
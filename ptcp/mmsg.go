@@ -0,0 +1,88 @@
+package ptcp
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+//Flag of recvmmsg, only the first message is waited for
+const MSG_WAITFORONE = 0x10000
+
+//struct mmsghdr
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+//mmsgBatch holds the headers of the messages received or sent by one recvmmsg/sendmmsg
+type mmsgBatch struct {
+	hdrs []mmsghdr
+	iovs []syscall.Iovec
+	//Receive buffers, nil for a send batch
+	bufs [][]byte
+}
+
+//Batch of n messages, with a receive buffer of bufSize bytes each if bufSize > 0
+func newMmsgBatch(n int, bufSize int) *mmsgBatch {
+	b := &mmsgBatch{
+		hdrs: make([]mmsghdr, n),
+		iovs: make([]syscall.Iovec, n),
+	}
+	for i := range b.hdrs {
+		b.hdrs[i].hdr.Iov = &b.iovs[i]
+		b.hdrs[i].hdr.Iovlen = 1
+	}
+	if bufSize > 0 {
+		b.bufs = make([][]byte, n)
+		for i := range b.bufs {
+			b.bufs[i] = make([]byte, bufSize)
+			b.iovs[i].Base = &b.bufs[i][0]
+			b.iovs[i].SetLen(bufSize)
+		}
+	}
+	return b
+}
+
+//Receive at least one message, and those already queued up to the size of the batch.
+//The message i is in bufs[i][:size(i)].
+func (b *mmsgBatch) recv(fd int) (int, error) {
+	for i := range b.hdrs {
+		b.hdrs[i].hdr.Flags = 0
+	}
+	n, _, errno := syscall.Syscall6(syscall.SYS_RECVMMSG, uintptr(fd), uintptr(unsafe.Pointer(&b.hdrs[0])), uintptr(len(b.hdrs)),
+		MSG_WAITFORONE, 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
+
+func (b *mmsgBatch) size(i int) int {
+	return int(b.hdrs[i].len)
+}
+
+//Send the frames to addr, by batches of the size of b
+func (b *mmsgBatch) send(fd int, frames [][]byte, addr *syscall.RawSockaddrLinklayer) error {
+	for len(frames) > 0 {
+		n := len(frames)
+		if n > len(b.hdrs) {
+			n = len(b.hdrs)
+		}
+		for i := 0; i < n; i++ {
+			h := &b.hdrs[i].hdr
+			h.Name = (*byte)(unsafe.Pointer(addr))
+			h.Namelen = syscall.SizeofSockaddrLinklayer
+			b.iovs[i].Base = &frames[i][0]
+			b.iovs[i].SetLen(len(frames[i]))
+		}
+		sent, _, errno := syscall.Syscall6(SYS_SENDMMSG, uintptr(fd), uintptr(unsafe.Pointer(&b.hdrs[0])), uintptr(n), 0, 0, 0)
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return errno
+		}
+		frames = frames[sent:]
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package ptcp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+func ListenPacket(addr string) (net.PacketConn, error) {
+	if defaultStack == nil {
+		return nil, fmt.Errorf("ptcp not initialized")
+	}
+	return defaultStack.ListenPacket(addr)
+}
+
+func (s *Stack) ListenPacket(addr string) (net.PacketConn, error) {
+	return s.ListenPacketWithConfig(addr, &s.cfg.Conn)
+}
+
+//The peers dial addr like a listener. Reliable, FEC and reordering are disabled,
+//they need goroutines for each conn.
+func (s *Stack) ListenPacketWithConfig(addr string, cfg *ConnConfig) (net.PacketConn, error) {
+	c := *cfg
+	c.Reliable, c.FECData, c.FECParity, c.ReorderWindow = false, 0, 0, 0
+	ln, err := s.ListenWithConfig("ptcp", addr, &c)
+	if err != nil {
+		return nil, err
+	}
+
+	pc := &PacketConn{
+		listener:      ln.(*Listener),
+		InputChan:     make(chan string, CONNCHANBUFSIZE),
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+	}
+	pc.listener.packetConn = pc
+	go pc.accept()
+	go pc.keepAlive()
+	return pc, nil
+}
+
+//PacketConn exchanges datagrams with all the peers handshaked with one listening address, like a UDP socket.
+//Its conns have no goroutine and channel of their own: the stack delivers their packets to the InputChan
+//of the PacketConn and they send on the OutputChan of its listener.
+type PacketConn struct {
+	listener  *Listener
+	InputChan chan string
+	//Key: remote address
+	conns sync.Map
+
+	readDeadline  *deadline
+	writeDeadline *deadline
+}
+
+//Run the handshakes, the listener adds the new conns to the PacketConn
+func (pc *PacketConn) accept() {
+	for {
+		if _, err := pc.listener.AcceptContext(context.Background()); err != nil {
+			return
+		}
+	}
+}
+
+//One goroutine for the keepalives of all the conns
+func (pc *PacketConn) keepAlive() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pc.listener.done:
+			return
+		case <-ticker.C:
+		}
+
+		pc.conns.Range(func(key interface{}, value interface{}) bool {
+			if conn := value.(*Conn); conn.State() == CONNECTED {
+				conn.sendPureAck()
+			}
+			return true
+		})
+	}
+}
+
+func (pc *PacketConn) newConn(localAddr string, remoteAddr string) *Conn {
+	l := pc.listener
+	conn := newConn(l.stack, &l.cfg, localAddr, remoteAddr, CONNECTING, pc.InputChan, l.OutputChan)
+	conn.packetConn = pc
+	conn.readDeadline, conn.writeDeadline = pc.readDeadline, pc.writeDeadline
+	return conn
+}
+
+func (pc *PacketConn) createConn(conn *Conn) {
+	local, remote := conn.LocalAddr().String(), conn.RemoteAddr().String()
+	pc.conns.Store(remote, conn)
+	pc.listener.stack.router.Store(connKey(local, remote), conn)
+}
+
+//Send one FIN or FIN-ACK without waiting for the answer and forget the conn, the shared channels stay open
+func (pc *PacketConn) closeConn(conn *Conn, flags uint8) {
+	conn.closeOnce.Do(func() {
+		if conn.State() == CONNECTED {
+			trySend(conn.OutputChan, string(conn.packet(1, 1, flags, nil, []byte{})))
+		}
+		conn.setState(CLOSED)
+		close(conn.done)
+
+		local, remote := conn.LocalAddr().String(), conn.RemoteAddr().String()
+		pc.listener.stack.router.Delete(connKey(local, remote))
+		if value, ok := pc.conns.Load(remote); ok && value.(*Conn) == conn {
+			pc.conns.Delete(remote)
+		}
+	})
+}
+
+//ReadFrom returns one datagram of any peer, the bytes that don't fit in b are dropped
+func (pc *PacketConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	for {
+		var s string
+		select {
+		case s = <-pc.InputChan:
+		case <-pc.readDeadline.wait():
+			return 0, nil, &timeoutError{}
+		case <-pc.listener.done:
+			return 0, nil, io.EOF
+		}
+
+		sg, err := parseSegment([]byte(s))
+		//Keepalive
+		if err != nil || len(sg.data) == 0 {
+			continue
+		}
+		return copy(b, sg.data), NewAddr(sg.src), nil
+	}
+}
+
+//WriteTo sends b to a peer which has dialed the PacketConn
+func (pc *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-pc.listener.done:
+		return 0, io.EOF
+	default:
+	}
+
+	remote, err := normalizeAddr(addr.String())
+	if err != nil {
+		return 0, err
+	}
+	value, ok := pc.conns.Load(remote)
+	if !ok {
+		return 0, fmt.Errorf("no conn with %v", remote)
+	}
+	return value.(*Conn).Write(b)
+}
+
+func (pc *PacketConn) Close() error {
+	pc.conns.Range(func(key interface{}, value interface{}) bool {
+		value.(*Conn).Close()
+		return true
+	})
+	return pc.listener.Close()
+}
+
+func (pc *PacketConn) LocalAddr() net.Addr {
+	return pc.listener.Addr()
+}
+
+func (pc *PacketConn) SetDeadline(t time.Time) error {
+	pc.readDeadline.set(t)
+	pc.writeDeadline.set(t)
+	return nil
+}
+
+func (pc *PacketConn) SetReadDeadline(t time.Time) error {
+	pc.readDeadline.set(t)
+	return nil
+}
+
+func (pc *PacketConn) SetWriteDeadline(t time.Time) error {
+	pc.writeDeadline.set(t)
+	return nil
+}
@@ -0,0 +1,78 @@
+package ptcp
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var PIPEBUFSIZE = 1024
+var PIPEMTU = 1500
+
+//Pipe is an in-memory Link. Two pipes created by NewPipe are connected to each other,
+//so two stacks can talk inside one process without a NIC or root privileges.
+type Pipe struct {
+	in        chan []byte
+	out       chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewPipe() (*Pipe, *Pipe) {
+	a2b, b2a := make(chan []byte, PIPEBUFSIZE), make(chan []byte, PIPEBUFSIZE)
+	a := &Pipe{
+		in:   b2a,
+		out:  a2b,
+		done: make(chan struct{}),
+	}
+	b := &Pipe{
+		in:   a2b,
+		out:  b2a,
+		done: make(chan struct{}),
+	}
+	return a, b
+}
+
+func (p *Pipe) Read() ([]byte, error) {
+	select {
+	case data := <-p.in:
+		return data, nil
+	case <-p.done:
+		return nil, fmt.Errorf("pipe closed")
+	case <-time.After(time.Millisecond * time.Duration(RAWREADTIMEOUT)):
+		return nil, fmt.Errorf("timeout")
+	}
+}
+
+//NoBlock, the packet is dropped if the peer is not reading fast enough
+func (p *Pipe) Write(data []byte) error {
+	select {
+	case <-p.done:
+		return fmt.Errorf("pipe closed")
+	default:
+	}
+
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	select {
+	case p.out <- buf:
+	default:
+	}
+	return nil
+}
+
+func (p *Pipe) MTU() int {
+	return PIPEMTU
+}
+
+func (p *Pipe) HardwareAddr() net.HardwareAddr {
+	return nil
+}
+
+func (p *Pipe) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.done)
+	})
+	return nil
+}
@@ -0,0 +1,226 @@
+package ptcp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//gateLink drops the written packets while it's shut
+type gateLink struct {
+	Link
+	shut int32
+}
+
+func (l *gateLink) Write(b []byte) error {
+	if atomic.LoadInt32(&l.shut) != 0 {
+		return nil
+	}
+	return l.Link.Write(b)
+}
+
+//Two stacks 10.0.0.1 and 10.0.0.2 on la and lb, closed at the end of the test
+func newStacks(t testing.TB, la Link, lb Link, ca ConnConfig, cb ConnConfig) (*Stack, *Stack) {
+	sa, err := NewStack(&Config{Link: la, LocalIP: "10.0.0.1", Conn: ca})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sa.Close() })
+	sb, err := NewStack(&Config{Link: lb, LocalIP: "10.0.0.2", Conn: cb})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sb.Close() })
+	return sa, sb
+}
+
+//Two stacks on a Pipe
+func newPipeStacks(t testing.TB, ca ConnConfig, cb ConnConfig) (*Stack, *Stack) {
+	a, b := NewPipe()
+	return newStacks(t, a, b, ca, cb)
+}
+
+//Conn dialed by sa and conn accepted by sb on port
+func connectPair(t testing.TB, sa *Stack, sb *Stack, port int) (*Conn, *Conn) {
+	addr := fmt.Sprintf("10.0.0.2:%d", port)
+	ln, err := sb.Listen("ptcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	accepted := make(chan *Conn, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		accepted <- c.(*Conn)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := sa.DialContext(ctx, "ptcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case s := <-accepted:
+		if s == nil {
+			t.Fatal("accept failed")
+		}
+		return c.(*Conn), s
+	case <-time.After(5 * time.Second):
+		t.Fatal("accept timeout")
+	}
+	return nil, nil
+}
+
+//Send n messages of different sizes from c to s, one at a time
+func exchange(t testing.TB, c *Conn, s *Conn, n int) {
+	buf := make([]byte, 2000)
+	for i := 0; i < n; i++ {
+		msg := bytes.Repeat([]byte{byte(i)}, 10+i)
+		if _, err := c.Write(msg); err != nil {
+			t.Fatal(i, err)
+		}
+		s.SetReadDeadline(time.Now().Add(5 * time.Second))
+		m, err := s.Read(buf)
+		if err != nil || !bytes.Equal(buf[:m], msg) {
+			t.Fatal(i, err, m)
+		}
+	}
+}
+
+//Wait until the read of c fails with io.EOF
+func waitEOF(t testing.TB, c *Conn, timeout time.Duration) {
+	c.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 2000)
+	for {
+		_, err := c.Read(buf)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+//Poll cond until it's true or timeout
+func waitFor(t testing.TB, timeout time.Duration, cond func() bool) {
+	end := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(end) {
+			t.Fatal("condition not met in", timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func countConns(s *Stack) int {
+	n := 0
+	s.router.Range(func(key interface{}, value interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+func TestDialAccept(t *testing.T) {
+	sa, sb := newPipeStacks(t, ConnConfig{}, ConnConfig{})
+	c, s := connectPair(t, sa, sb, 7000)
+	if c.RemoteAddr().String() != "10.0.0.2:7000" || s.LocalAddr().String() != "10.0.0.2:7000" ||
+		s.RemoteAddr().String() != c.LocalAddr().String() {
+		t.Fatal(c.LocalAddr(), c.RemoteAddr(), s.LocalAddr(), s.RemoteAddr())
+	}
+	exchange(t, c, s, 5)
+	exchange(t, s, c, 5)
+}
+
+func TestDialNoListener(t *testing.T) {
+	sa, _ := newPipeStacks(t, ConnConfig{}, ConnConfig{})
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if _, err := sa.DialContext(ctx, "ptcp", "10.0.0.2:7001"); err == nil {
+		t.Fatal("dialed without listener")
+	}
+	if countConns(sa) != 0 {
+		t.Fatal("conn left in the router")
+	}
+}
+
+func TestDuplicateSynAck(t *testing.T) {
+	sa, sb := newPipeStacks(t, ConnConfig{}, ConnConfig{})
+	ln, err := sb.Listen("ptcp", "10.0.0.2:7004")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	dialed := make(chan net.Conn, 1)
+	go func() {
+		c, err := sa.Dial("ptcp", "10.0.0.2:7004")
+		if err != nil {
+			t.Error(err)
+		}
+		dialed <- c
+	}()
+	//The retransmitted SYNs are answered after the first one, with the same SYN-ACK
+	time.Sleep(time.Duration(2*RETRYINTERVAL+200) * time.Millisecond)
+	s, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := <-dialed
+	if c == nil {
+		t.FailNow()
+	}
+	if _, err := s.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readN(t, c.(*Conn), 1); got[0] != "data" {
+		t.Fatalf("%q", got)
+	}
+}
+
+func TestFIN(t *testing.T) {
+	sa, sb := newPipeStacks(t, ConnConfig{}, ConnConfig{})
+	c, s := connectPair(t, sa, sb, 7002)
+	exchange(t, c, s, 1)
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	waitEOF(t, s, 5*time.Second)
+	if _, err := c.Write([]byte("late")); err != io.EOF {
+		t.Fatal(err)
+	}
+	//The listener side is removed once it gets the last ACK
+	waitFor(t, 5*time.Second, func() bool { return countConns(sa) == 0 && countConns(sb) == 0 })
+}
+
+func TestKeepAlive(t *testing.T) {
+	timeout := CONNTIMEOUT
+	CONNTIMEOUT = 2
+	t.Cleanup(func() { CONNTIMEOUT = timeout })
+
+	a, b := NewPipe()
+	ga := &gateLink{Link: a}
+	sa, sb := newStacks(t, ga, b, ConnConfig{}, ConnConfig{})
+	c, s := connectPair(t, sa, sb, 7003)
+
+	//The keepalives hold the idle conns open
+	time.Sleep(time.Duration(CONNTIMEOUT)*time.Second + 1500*time.Millisecond)
+	exchange(t, c, s, 1)
+
+	//Without the keepalives of the dialer, the listener side times out
+	atomic.StoreInt32(&ga.shut, 1)
+	waitEOF(t, s, time.Duration(3*CONNTIMEOUT)*time.Second)
+	waitFor(t, time.Second, func() bool { return countConns(sb) == 0 })
+}
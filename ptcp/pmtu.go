@@ -0,0 +1,221 @@
+package ptcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Lowest path MTU accepted from the ICMP messages, the minimum MTUs of ipv4 and ipv6
+var PMTUMIN4 = 576
+var PMTUMIN6 = 1280
+
+//Seconds before a path MTU lowered by ICMP is raised back to the negotiated one, as in RFC 1191
+var PMTUEXPIRE = 600
+
+//Recent data packets whose header seq is accepted in the quote of an ICMP message
+var PMTUSEQWINDOW = 1024
+
+//Returned by Write when the payload doesn't fit in one packet and the conn doesn't split
+type PayloadSizeError struct {
+	Size int
+	Max  int
+}
+
+func (e *PayloadSizeError) Error() string {
+	return fmt.Sprintf("payload too long: %v > %v", e.Size, e.Max)
+}
+
+//pathMTU is the max IP packet size towards the peer. It starts from the MSS negotiated
+//in the handshake and is lowered by the ICMP "fragmentation needed" and "packet too big" messages.
+type pathMTU struct {
+	mu     sync.Mutex
+	max    int
+	cur    int
+	expire time.Time
+	//Header seqs of the recent data packets, [seqLo, seqHi). The ICMP messages quoting another seq
+	//are forged or stale. In mimicry mode they count bytes, otherwise packets.
+	seqLo   uint32
+	seqHi   uint32
+	seqSent bool
+}
+
+func (p *pathMTU) init(mtu int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.max, p.cur = mtu, mtu
+}
+
+func (p *pathMTU) get() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cur < p.max && time.Now().After(p.expire) {
+		p.cur = p.max
+	}
+	return p.cur
+}
+
+//Record a data packet sent with header seq and n seq units. span is the size of the accepted range.
+func (p *pathMTU) sent(seq uint32, n uint32, span uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.seqSent {
+		p.seqLo, p.seqHi, p.seqSent = seq, seq, true
+	}
+	if end := seq + n; seqLess(p.seqHi, end) {
+		p.seqHi = end
+	}
+	if p.seqHi-p.seqLo > span {
+		p.seqLo = p.seqHi - span
+	}
+}
+
+//Returns true if the MTU is lowered. seq is the header seq of the quoted packet.
+func (p *pathMTU) lower(mtu int, seq uint32) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.max == 0 || mtu >= p.cur {
+		return false
+	}
+	if !p.seqSent || seqLess(seq, p.seqLo) || !seqLess(seq, p.seqHi) {
+		return false
+	}
+	p.cur, p.expire = mtu, time.Now().Add(time.Second*time.Duration(PMTUEXPIRE))
+	return true
+}
+
+func ipHeaderLen(addr string) int {
+	if isIpv6Addr(addr) {
+		return IPV6HEADERLEN
+	}
+	return IPV4HEADERLEN
+}
+
+func isIpv6Addr(addr string) bool {
+	ip, _, err := splitAddr(addr)
+	return err == nil && ip.To4() == nil
+}
+
+//MSS announced to a peer: the TCP payload of the link MTU, or cfg.MSS if it's lower
+func (s *Stack) mss(cfg *ConnConfig, addr string) int {
+	mss := synMSS(s.link.MTU(), addr)
+	if cfg.MSS > 0 && cfg.MSS < mss {
+		mss = cfg.MSS
+	}
+	return mss
+}
+
+//Payload bytes a Write sends in one packet: the path MTU without the headers, the mimicry timestamps,
+//the FEC option and shard length of the parity packets, and the encryption tag
+func (conn *Conn) MaxPayload() int {
+	remote := conn.RemoteAddr().String()
+	n := conn.pmtu.get() - ipHeaderLen(remote) - TCPHEADERLEN
+	if conn.mimic != nil {
+		n -= TIMESTAMPOPTLEN
+	}
+	if conn.fecEnc != nil {
+		//kind, length, ExID and subtype + FEC option + shard length
+		n -= 5 + FECOPTIONLEN + 2
+	}
+	if conn.aead != nil {
+		n -= AEADTAGLEN
+	}
+	return n
+}
+
+//The packets larger than the path MTU were queued before it was lowered, the last packet
+//of the batch is replaced by its fragments if it's one of them
+func (s *Stack) fragmentLowered(packets [][]byte) [][]byte {
+	last := packets[len(packets)-1]
+	if atomic.LoadInt32(&s.pmtuLowered) == 0 || len(last) <= PMTUMIN4 {
+		return packets
+	}
+	src, dst, tcp, err := parseIp(last)
+	if err != nil || len(tcp) < 4 {
+		return packets
+	}
+	local, remote := quotedAddrs(src, dst, tcp)
+	value, ok := s.router.Load(connKey(local, remote))
+	if !ok {
+		return packets
+	}
+	mtu := value.(*Conn).pmtu.get()
+	if mtu == 0 || len(last) <= mtu {
+		return packets
+	}
+	frags, err := fragment(last, mtu)
+	if err != nil {
+		return packets
+	}
+	return append(packets[:len(packets)-1], frags...)
+}
+
+//Lower the path MTU of the conn from local to remote, if seq is the one of a recent packet of the conn
+func (s *Stack) tooBig(local string, remote string, seq uint32, mtu int) {
+	min := PMTUMIN4
+	if isIpv6Addr(remote) {
+		min = PMTUMIN6
+	}
+	if mtu < min {
+		mtu = min
+	}
+	if value, ok := s.router.Load(connKey(local, remote)); ok && value.(*Conn).pmtu.lower(mtu, seq) {
+		atomic.StoreInt32(&s.pmtuLowered, 1)
+	}
+}
+
+//ICMP "fragmentation needed" or ICMPv6 "packet too big" -> local and remote addresses and header seq of the
+//TCP packet it quotes, next hop MTU. The MTU is 0 if the router doesn't give it.
+func parseTooBig(packet []byte) (string, string, uint32, int, error) {
+	if len(packet) >= IPV4HEADERLEN && packet[0]>>4 == 4 {
+		ihl := int(packet[0]&0x0f) * 4
+		if packet[9] != 1 || ihl < IPV4HEADERLEN || len(packet) < ihl+8 {
+			return "", "", 0, 0, fmt.Errorf("not icmp packet")
+		}
+		icmp := packet[ihl:]
+		if icmp[0] != 3 || icmp[1] != 4 {
+			return "", "", 0, 0, fmt.Errorf("not fragmentation needed")
+		}
+		inner := icmp[8:]
+		if len(inner) < IPV4HEADERLEN || inner[0]>>4 != 4 || inner[9] != 6 {
+			return "", "", 0, 0, fmt.Errorf("invalid quoted packet")
+		}
+		innerIhl := int(inner[0]&0x0f) * 4
+		if innerIhl < IPV4HEADERLEN || len(inner) < innerIhl+8 {
+			return "", "", 0, 0, fmt.Errorf("invalid quoted packet")
+		}
+		tcp := inner[innerIhl:]
+		local, remote := quotedAddrs(net.IP(inner[12:16]), net.IP(inner[16:20]), tcp)
+		return local, remote, binary.BigEndian.Uint32(tcp[4:]), int(binary.BigEndian.Uint16(icmp[6:])), nil
+	}
+
+	if len(packet) >= IPV6HEADERLEN && packet[0]>>4 == 6 {
+		if packet[6] != 58 || len(packet) < IPV6HEADERLEN+8 {
+			return "", "", 0, 0, fmt.Errorf("not icmpv6 packet")
+		}
+		icmp := packet[IPV6HEADERLEN:]
+		if icmp[0] != 2 || icmp[1] != 0 {
+			return "", "", 0, 0, fmt.Errorf("not packet too big")
+		}
+		inner := icmp[8:]
+		if len(inner) < IPV6HEADERLEN+8 || inner[0]>>4 != 6 || inner[6] != 6 {
+			return "", "", 0, 0, fmt.Errorf("invalid quoted packet")
+		}
+		tcp := inner[IPV6HEADERLEN:]
+		local, remote := quotedAddrs(net.IP(inner[8:24]), net.IP(inner[24:40]), tcp)
+		mtu := binary.BigEndian.Uint32(icmp[4:])
+		if mtu > 65535 {
+			mtu = 65535
+		}
+		return local, remote, binary.BigEndian.Uint32(tcp[4:]), int(mtu), nil
+	}
+	return "", "", 0, 0, fmt.Errorf("not icmp packet")
+}
+
+//The quoted packet was sent by the local side
+func quotedAddrs(src net.IP, dst net.IP, tcp []byte) (string, string) {
+	return joinAddr(src, binary.BigEndian.Uint16(tcp[0:])), joinAddr(dst, binary.BigEndian.Uint16(tcp[2:]))
+}
@@ -0,0 +1,242 @@
+package ptcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xitongsys/ethernet-go/header"
+)
+
+//ICMP fragmentation needed from 10.0.0.9, quoting the first 28 bytes of the ipv4 packet
+func icmpTooBig(packet []byte, mtu int) []byte {
+	icmp := make([]byte, 20+8+28)
+	icmp[0], icmp[8], icmp[9] = 0x45, 64, 1
+	copy(icmp[12:16], []byte{10, 0, 0, 9})
+	copy(icmp[16:20], packet[12:16])
+	icmp[20], icmp[21] = 3, 4
+	binary.BigEndian.PutUint16(icmp[26:], uint16(mtu))
+	copy(icmp[28:], packet[:28])
+	return icmp
+}
+
+//mtuLink drops the packets larger than mtu and answers with an ICMP fragmentation needed
+type mtuLink struct {
+	*Pipe
+	mtu int
+}
+
+func (l *mtuLink) Write(b []byte) error {
+	if len(b) > l.mtu {
+		if b[6]&0x40 == 0 {
+			panic("DF not set")
+		}
+		l.Pipe.in <- icmpTooBig(b, l.mtu)
+		return nil
+	}
+	return l.Pipe.Write(b)
+}
+
+func TestMSSNegotiation(t *testing.T) {
+	sa, sb := newPipeStacks(t, ConnConfig{MSS: 1000}, ConnConfig{})
+	c, s := connectPair(t, sa, sb, 7900)
+	if c.MaxPayload() != 1000 || s.MaxPayload() != 1000 {
+		t.Fatal(c.MaxPayload(), s.MaxPayload())
+	}
+	_, err := s.Write(make([]byte, 1001))
+	var se *PayloadSizeError
+	if !errors.As(err, &se) || se.Max != 1000 {
+		t.Fatal(err)
+	}
+	exchange(t, s, c, 3)
+}
+
+func TestPMTU(t *testing.T) {
+	for i, cfg := range []ConnConfig{
+		{Split: true, Stream: true, Reliable: true},
+		{Split: true, Stream: true, Reliable: true, Encrypt: true, Mimicry: true},
+	} {
+		a, b := NewPipe()
+		sa, sb := newStacks(t, &mtuLink{Pipe: a, mtu: 1200}, b, cfg, cfg)
+		c, s := connectPair(t, sa, sb, 7901+i)
+		full := c.MaxPayload()
+
+		msg := make([]byte, 20000)
+		for i := range msg {
+			msg[i] = byte(i * 7)
+		}
+		go func() {
+			if _, err := c.Write(msg); err != nil {
+				t.Error(err)
+			}
+		}()
+		got := make([]byte, len(msg))
+		s.SetReadDeadline(time.Now().Add(10 * time.Second))
+		if _, err := io.ReadFull(s, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatal("corrupted")
+		}
+		if c.MaxPayload() != full-(1500-1200) {
+			t.Fatal(full, c.MaxPayload())
+		}
+	}
+}
+
+func TestTooBigSeq(t *testing.T) {
+	for i, cfg := range []ConnConfig{{}, {Mimicry: true}} {
+		sa, sb, ma := newMangleStacks(t, cfg, cfg)
+		c, s := connectPair(t, sa, sb, 7910+i)
+		exchange(t, c, s, 3)
+		full := c.MaxPayload()
+
+		//The last data packet sent by c
+		var mu sync.Mutex
+		var sent []byte
+		ma.set(func(packet []byte) [][]byte {
+			if sg, err := parseSegment(packet); err == nil && sg.flags&header.PSH != 0 {
+				mu.Lock()
+				sent = packet
+				mu.Unlock()
+			}
+			return [][]byte{packet}
+		})
+		exchange(t, c, s, 1)
+		mu.Lock()
+		seq := binary.BigEndian.Uint32(sent[24:])
+		forged := append([]byte{}, sent...)
+		mu.Unlock()
+		pipe := ma.Link.(*Pipe)
+
+		//A quote of a seq never sent is ignored
+		binary.BigEndian.PutUint32(forged[24:], seq+1<<30)
+		pipe.in <- icmpTooBig(forged, 1000)
+		time.Sleep(50 * time.Millisecond)
+		if c.MaxPayload() != full {
+			t.Fatal("forged icmp accepted", i)
+		}
+
+		binary.BigEndian.PutUint32(forged[24:], seq)
+		pipe.in <- icmpTooBig(forged, 1000)
+		waitFor(t, time.Second, func() bool { return c.MaxPayload() == full-500 })
+	}
+}
+
+func TestParseTooBig(t *testing.T) {
+	packet := buildPacket("10.0.0.1:1000", "10.0.0.2:2000", 1234, 0, header.PSH|header.ACK, make([]byte, 100))
+	l, r, seq, mtu, err := parseTooBig(icmpTooBig(packet, 1200))
+	if err != nil || l != "10.0.0.1:1000" || r != "10.0.0.2:2000" || seq != 1234 || mtu != 1200 {
+		t.Fatal(l, r, seq, mtu, err)
+	}
+	//The quote must hold the seq
+	if _, _, _, _, err = parseTooBig(icmpTooBig(packet, 1200)[:20+8+24]); err == nil {
+		t.Fatal("short quote parsed")
+	}
+
+	orig := make([]byte, 60)
+	orig[0], orig[6] = 0x60, 6
+	orig[8+15], orig[24+15] = 1, 2
+	binary.BigEndian.PutUint16(orig[40:], 1000)
+	binary.BigEndian.PutUint16(orig[42:], 2000)
+	binary.BigEndian.PutUint32(orig[44:], 5678)
+	p := make([]byte, 40+8+60)
+	p[0], p[6] = 0x60, 58
+	p[40] = 2
+	binary.BigEndian.PutUint32(p[44:], 1400)
+	copy(p[48:], orig)
+	l, r, seq, mtu, err = parseTooBig(p)
+	if err != nil || l != "[::1]:1000" || r != "[::2]:2000" || seq != 5678 || mtu != 1400 {
+		t.Fatal(l, r, seq, mtu, err)
+	}
+}
+
+func TestFragmentOverlap(t *testing.T) {
+	packet := buildPacket("10.0.0.1:1234", "10.0.0.2:80", 5, 6, header.PSH|header.ACK, bytes.Repeat([]byte{1}, 3000))
+	frags, err := fragment(packet, 1280)
+	if err != nil || len(frags) != 3 {
+		t.Fatal(err, len(frags))
+	}
+	r := newReassembler()
+
+	//A duplicate drops the whole packet
+	r.add(frags[0])
+	if r.add(frags[0]) != nil || len(r.packets) != 0 || r.size != 0 {
+		t.Fatal("duplicate fragment kept", len(r.packets), r.size)
+	}
+
+	//So does a fragment overlapping the end of another one
+	overlap := append([]byte{}, frags[1]...)
+	flags := binary.BigEndian.Uint16(overlap[6:])
+	binary.BigEndian.PutUint16(overlap[6:], flags-1)
+	r.add(frags[0])
+	if r.add(overlap) != nil || len(r.packets) != 0 || r.size != 0 {
+		t.Fatal("overlapping fragment kept", len(r.packets), r.size)
+	}
+	for _, f := range frags[1:] {
+		if r.add(f) != nil {
+			t.Fatal("packet rebuilt without its first fragment")
+		}
+	}
+	if r.add(frags[0]) == nil || r.size != 0 {
+		t.Fatal("packet not rebuilt after the drop", r.size)
+	}
+}
+
+func TestFragmentMaxBytes(t *testing.T) {
+	max := FRAGMAXBYTES
+	FRAGMAXBYTES = 2000
+	t.Cleanup(func() { FRAGMAXBYTES = max })
+
+	r := newReassembler()
+	for i := 0; i < 3; i++ {
+		packet := buildPacket("10.0.0.1:1234", "10.0.0.2:80", uint32(i), 0, header.PSH|header.ACK, bytes.Repeat([]byte{1}, 3000))
+		frags, err := fragment(packet, 1280)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.add(frags[0])
+	}
+	if len(r.packets) != 1 || r.size > FRAGMAXBYTES {
+		t.Fatal("fragments buffered beyond FRAGMAXBYTES", len(r.packets), r.size)
+	}
+}
+
+func TestFragment(t *testing.T) {
+	for _, ip := range []string{"10.0.0.1", "fd00::1"} {
+		dst := "10.0.0.2:80"
+		if ip != "10.0.0.1" {
+			dst = "[fd00::2]:80"
+		}
+		packet := buildPacket(joinAddr(net.ParseIP(ip), 1234), dst, 5, 6, header.PSH|header.ACK, bytes.Repeat([]byte{1, 2, 3}, 1000))
+		frags, err := fragment(packet, 1280)
+		if err != nil || len(frags) != 3 {
+			t.Fatal(err, len(frags))
+		}
+
+		//Reassembled in any order
+		r := newReassembler()
+		for i := len(frags) - 1; i >= 0; i-- {
+			if len(frags[i]) > 1280 {
+				t.Fatal(len(frags[i]))
+			}
+			whole := r.add(frags[i])
+			if (whole != nil) != (i == 0) {
+				t.Fatal(ip, i)
+			}
+			if whole == nil {
+				continue
+			}
+			_, _, got, _ := parseIp(whole)
+			_, _, want, _ := parseIp(packet)
+			if !bytes.Equal(got, want) {
+				t.Fatal("reassembled packet differs", ip)
+			}
+		}
+	}
+}
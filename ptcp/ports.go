@@ -0,0 +1,136 @@
+package ptcp
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"syscall"
+)
+
+//portManager reserves the local ports of the listeners and dialed conns of a stack.
+//On a real interface each port is also held by a bound (not listening) kernel TCP socket,
+//so the kernel and the other processes never use it.
+type portManager struct {
+	mu       sync.Mutex
+	min      int
+	max      int
+	last     int
+	bindPort bool
+	//Key: normalized ip:port, Value: fd of the kernel socket, -1 if none
+	used map[string]int
+}
+
+func newPortManager(min int, max int, bindPort bool) *portManager {
+	if min <= 0 || max <= 0 {
+		min, max = EPHEMERALPORTMIN, EPHEMERALPORTMAX
+	}
+	if max < min {
+		min, max = max, min
+	}
+	return &portManager{
+		min:      min,
+		max:      max,
+		last:     min + rand.Intn(max-min+1),
+		bindPort: bindPort,
+		used:     map[string]int{},
+	}
+}
+
+//Reserve the address of a listener
+func (pm *portManager) reserve(addr string) error {
+	ip, port, err := splitAddr(addr)
+	if err != nil {
+		return err
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return pm.tryReserve(ip, int(port))
+}
+
+//Reserve a free port of the range on ip, returns the normalized address
+func (pm *portManager) allocate(ip net.IP) (string, error) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	n := pm.max - pm.min + 1
+	for i := 0; i < n; i++ {
+		pm.last++
+		if pm.last > pm.max {
+			pm.last = pm.min
+		}
+		if err := pm.tryReserve(ip, pm.last); err == nil {
+			return joinAddr(ip, uint16(pm.last)), nil
+		}
+	}
+	return "", fmt.Errorf("no free local port on %v", ip)
+}
+
+func (pm *portManager) tryReserve(ip net.IP, port int) error {
+	addr := joinAddr(ip, uint16(port))
+	if _, ok := pm.used[addr]; ok {
+		return fmt.Errorf("address %v already in use", addr)
+	}
+
+	fd := -1
+	if pm.bindPort {
+		var err error
+		if fd, err = bindTcpPort(ip, port); err != nil {
+			return err
+		}
+	}
+	pm.used[addr] = fd
+	return nil
+}
+
+func (pm *portManager) release(addr string) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if fd, ok := pm.used[addr]; ok {
+		if fd >= 0 {
+			syscall.Close(fd)
+		}
+		delete(pm.used, addr)
+	}
+}
+
+func (pm *portManager) close() {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	for addr, fd := range pm.used {
+		if fd >= 0 {
+			syscall.Close(fd)
+		}
+		delete(pm.used, addr)
+	}
+}
+
+//A TCP socket bound to ip:port without listening, the port is taken but the kernel accepts no conn on it
+func bindTcpPort(ip net.IP, port int) (int, error) {
+	var sa syscall.Sockaddr
+	family := syscall.AF_INET
+	if ip4 := ip.To4(); ip4 != nil {
+		sa4 := &syscall.SockaddrInet4{Port: port}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+
+	} else {
+		family = syscall.AF_INET6
+		sa6 := &syscall.SockaddrInet6{Port: port}
+		copy(sa6.Addr[:], ip.To16())
+		sa = sa6
+	}
+
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, syscall.IPPROTO_TCP)
+	if err != nil {
+		return -1, err
+	}
+	if err = syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return -1, fmt.Errorf("bind %v: %v", joinAddr(ip, uint16(port)), err)
+	}
+	return fd, nil
+}
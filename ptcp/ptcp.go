@@ -1,71 +1,268 @@
 package ptcp
 
 import (
+	"fmt"
+	"net"
+	"os"
 	"sync"
 	"time"
 
-	"github.com/xitongsys/ethernet-go/header"
 	"github.com/xitongsys/ptcp/netinfo"
 )
 
 var BUFFERSIZE = 65535
 var CHANBUFFERSIZE = 1024
 
-var ptcpServer *PTCP
-var arp *netinfo.Arp
-var route *netinfo.Route
-var local *netinfo.Local
+//Packets queued by all the conns and listeners of a stack for its transmit loop, and max packets it sends at once
+var TXCHANBUFSIZE = 4096
+var TXBATCHSIZE = 64
 
-func Init(interfaceName string) {
-	var err error
-	if ptcpServer, err = NewPTCP(interfaceName); err != nil {
-		panic(err)
-	}
+//Default port range of dialed conns
+var EPHEMERALPORTMIN = 32768
+var EPHEMERALPORTMAX = 61000
 
-	if arp, err = netinfo.NewArp(); err != nil {
+//Kinds of links on Config.Interface
+const (
+	//AF_PACKET socket, the frames are received and sent by batches of recvmmsg/sendmmsg
+	LINKPACKET = iota
+	//TPACKET_V3 rings mapped in memory, the frames are read by blocks and sent in batches
+	LINKRING
+	//Raw IP sockets, the kernel does the routing and the link layer. For the interfaces without Ethernet framing
+	LINKL3
+)
+
+//Stack used by the package level Init/Dial/Listen
+var defaultStack *Stack
+
+func Init(interfaceName string) {
+	stack, err := NewStack(&Config{
+		Interface: interfaceName,
+	})
+	if err != nil {
 		panic(err)
 	}
-	//fmt.Println(arp)
+	defaultStack = stack
+}
 
-	if route, err = netinfo.NewRoute(); err != nil {
-		panic(err)
+func Dial(proto string, remoteAddr string) (net.Conn, error) {
+	if defaultStack == nil {
+		return nil, fmt.Errorf("ptcp not initialized")
 	}
-	//fmt.Println(route)
+	return defaultStack.Dial(proto, remoteAddr)
+}
 
-	if local, err = netinfo.NewLocal(); err != nil {
-		panic(err)
+func Listen(proto, addr string) (net.Listener, error) {
+	if defaultStack == nil {
+		return nil, fmt.Errorf("ptcp not initialized")
 	}
-	//fmt.Println(local)
+	return defaultStack.Listen(proto, addr)
+}
 
-	ptcpServer.Start()
+type Config struct {
+	//Name of the network interface the stack is bound to
+	Interface string
+	//Packet backend of the stack. If nil, an AF_PACKET socket on Interface is used
+	Link Link
+	//Kind of the link on Interface when Link is nil, LINKPACKET if 0
+	LinkType int
+	//Source ip of dialed conns. If empty, it's chosen by the kernel routing table
+	LocalIP string
+	//Port range of dialed conns, EPHEMERALPORTMIN-EPHEMERALPORTMAX if 0
+	PortMin int
+	PortMax int
+	//Options of the conns created by the stack
+	Conn ConnConfig
+	//Optional, drops the kernel RSTs of the listeners and dialed conns. It's closed with the stack
+	RSTFilter RSTFilter
+	//Max payload bytes per second sent by all the conns of the stack, 0 for no limit
+	MaxRate int
 }
 
-type PTCP struct {
-	raw *Raw
-	//Key: ip:port
+//Stack is an independent PTCP engine on one interface.
+//It owns its link, its routing tables and all the conns/listeners created from it.
+type Stack struct {
+	cfg   Config
+	link  Link
+	arp   *netinfo.Arp
+	route *netinfo.Route
+	local *netinfo.Local
+	//ipv6 tables, empty if ipv6 is disabled
+	route6 *netinfo.Route6
+	neigh  *netinfo.Neigh
+	//Keeps the tables current, nil if the link isn't Raw
+	watcher *netinfo.Watcher
+	//Key: normalized ip:port or [ip6]:port
 	routerListener sync.Map
-	//Key: localIp:localPort:remoteIp:remotePort
+	//Key: connKey(localAddr, remoteAddr)
 	router sync.Map
+
+	//Local ports of the listeners and dialed conns
+	ports *portManager
+	//Shared by the conns, only used with MaxRate
+	limiter rateLimiter
+	frags   *reassembler
+	//OutputChan of all the conns and listeners, drained by the transmit loop
+	output chan string
+	//Set once a path MTU is lowered, the transmit loop only looks for the packets to fragment after
+	pmtuLowered int32
+	//Serializes the updates of the port filter of the link. The listeners and conns on each port, and the ports it admits
+	filterMu    sync.Mutex
+	portRefs    map[uint16]int
+	filterPorts []uint16
+	//CONNTIMEOUT when the stack was created
+	connTimeout time.Duration
+	done        chan struct{}
+	closeOnce   sync.Once
 }
 
-func NewPTCP(interfaceName string) (*PTCP, error) {
-	r, err := NewRaw(interfaceName)
-	if err != nil {
-		return nil, err
-	}
-	return &PTCP{
-		raw:            r,
+func NewStack(cfg *Config) (*Stack, error) {
+	s := &Stack{
+		cfg:            *cfg,
 		routerListener: sync.Map{},
 		router:         sync.Map{},
-	}, nil
+		link:           cfg.Link,
+		//Only a real interface shares its ports with the kernel
+		ports:       newPortManager(cfg.PortMin, cfg.PortMax, cfg.Link == nil),
+		frags:       newReassembler(),
+		output:      make(chan string, TXCHANBUFSIZE),
+		portRefs:    map[uint16]int{},
+		connTimeout: time.Second * time.Duration(CONNTIMEOUT),
+		done:        make(chan struct{}),
+	}
+
+	if s.link == nil && cfg.LinkType == LINKL3 {
+		//The kernel resolves the next hops, the tables are not needed
+		var err error
+		if s.link, err = NewL3Raw(cfg.Interface); err != nil {
+			return nil, err
+		}
+
+	} else if s.link == nil {
+		var err error
+		if s.arp, err = netinfo.NewArp(); err != nil {
+			return nil, err
+		}
+
+		if s.route, err = netinfo.NewRoute(); err != nil {
+			return nil, err
+		}
+
+		if s.local, err = netinfo.NewLocal(); err != nil {
+			return nil, err
+		}
+
+		if s.route6, err = netinfo.NewRoute6(); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		if s.neigh, err = netinfo.NewNeigh(); err != nil {
+			return nil, err
+		}
+
+		if s.watcher, err = netinfo.NewWatcher(s.route, s.arp, s.route6, s.neigh); err != nil {
+			return nil, err
+		}
+
+		newRaw := NewRaw
+		if cfg.LinkType == LINKRING {
+			newRaw = NewRingRaw
+		}
+		if s.link, err = newRaw(cfg.Interface, s.route, s.arp, s.route6, s.neigh); err != nil {
+			s.watcher.Close()
+			return nil, err
+		}
+	}
+
+	//No port is admitted until the first listener or conn
+	s.filterMu.Lock()
+	s.setFilter()
+	s.filterMu.Unlock()
+	s.Start()
+	return s, nil
 }
 
-func (p *PTCP) CleanTimeoutConns() {
+//Close shuts down all the conns and listeners of the stack and releases the link
+func (s *Stack) Close() error {
+	err := fmt.Errorf("stack already closed")
+	s.closeOnce.Do(func() {
+		var wg sync.WaitGroup
+		s.router.Range(func(key interface{}, value interface{}) bool {
+			conn := value.(*Conn)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				conn.Close()
+			}()
+			return true
+		})
+		wg.Wait()
+
+		s.routerListener.Range(func(key interface{}, value interface{}) bool {
+			value.(*Listener).Close()
+			return true
+		})
+
+		close(s.done)
+		s.ports.close()
+		if s.cfg.RSTFilter != nil {
+			s.cfg.RSTFilter.Close()
+		}
+		if s.watcher != nil {
+			s.watcher.Close()
+		}
+		err = s.link.Close()
+	})
+	return err
+}
+
+//Reserve a local address to dial remoteAddr
+func (s *Stack) localAddr(remoteAddr string) (string, error) {
+	remoteIp, _, err := splitAddr(remoteAddr)
+	if err != nil {
+		return "", err
+	}
+
+	var localIp net.IP
+	if s.cfg.LocalIP == "" {
+		addr, err := GetLocalAddr(remoteAddr)
+		if err != nil {
+			return "", err
+		}
+		if localIp, _, err = splitAddr(addr.String()); err != nil {
+			return "", err
+		}
+
+	} else {
+		localIp = net.ParseIP(s.cfg.LocalIP)
+		if localIp == nil || (localIp.To4() == nil) != (remoteIp.To4() == nil) {
+			return "", fmt.Errorf("local ip %v can't reach %v", s.cfg.LocalIP, remoteAddr)
+		}
+	}
+	return s.ports.allocate(localIp)
+}
+
+func (s *Stack) isClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Stack) CleanTimeoutConns() {
+	ticker := time.NewTicker(s.connTimeout / 2)
+	defer ticker.Stop()
 	for {
-		time.Sleep(time.Second * time.Duration(CONNTIMEOUT/2))
-		p.router.Range(func(key interface{}, value interface{}) bool {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		s.router.Range(func(key interface{}, value interface{}) bool {
 			conn := value.(*Conn)
-			if conn.IsTimeout() {
+			if conn.idle() > s.connTimeout {
 				conn.Close()
 			}
 			return true
@@ -73,71 +270,119 @@ func (p *PTCP) CleanTimeoutConns() {
 	}
 }
 
-func (p *PTCP) CloseListener(key string) {
-	p.routerListener.Delete(key)
+func (s *Stack) CloseListener(key string) {
+	if value, ok := s.routerListener.LoadAndDelete(key); ok {
+		s.removeFilterPort(value.(*Listener).Address)
+	}
 }
 
-func (p *PTCP) CreateListener(key string, listener *Listener) {
-	go func() {
-		for {
-			s := <-listener.OutputChan
-			p.raw.Write([]byte(s))
-		}
-	}()
-	p.routerListener.Store(key, listener)
+func (s *Stack) CreateListener(key string, listener *Listener) {
+	if _, ok := s.routerListener.Swap(key, listener); !ok {
+		s.addFilterPort(listener.Address)
+	}
 }
 
-func (p *PTCP) CreateConn(localAddr string, remoteAddr string, conn *Conn) {
-	key := localAddr + ":" + remoteAddr
-	go func() {
-		for {
-			s, ok := <-conn.OutputChan
-			if !ok {
-				return
-			}
-			p.raw.Write([]byte(s))
-		}
-	}()
-	p.router.Store(key, conn)
+func (s *Stack) CreateConn(localAddr string, remoteAddr string, conn *Conn) {
+	key := connKey(localAddr, remoteAddr)
+	if _, ok := s.router.Swap(key, conn); !ok {
+		s.addFilterPort(localAddr)
+	}
+}
+
+func (s *Stack) addRSTFilter(localAddr string, remoteAddr string) error {
+	if s.cfg.RSTFilter == nil {
+		return nil
+	}
+	return s.cfg.RSTFilter.Add(localAddr, remoteAddr)
 }
 
-func (p *PTCP) CloseConn(key string) {
-	p.router.Delete(key)
+func (s *Stack) removeRSTFilter(localAddr string, remoteAddr string) {
+	if s.cfg.RSTFilter != nil {
+		s.cfg.RSTFilter.Remove(localAddr, remoteAddr)
+	}
+}
+
+func (s *Stack) CloseConn(key string) {
+	if value, ok := s.router.LoadAndDelete(key); ok {
+		s.removeFilterPort(value.(*Conn).LocalAddr().String())
+	}
 }
 
-func (p *PTCP) Start() {
+func (s *Stack) Start() {
 	go func() {
-		for {
-			data, err := p.raw.Read()
-			if err == nil && len(data) > 0 {
-				if proto, ipHeader, _, tcpHeader, _, err := header.Get(data); err == nil && proto == "tcp" {
-					src, dst := header.GetTcpAddr(ipHeader, tcpHeader)
-					key := dst + ":" + src
-					if value, ok := p.router.Load(key); ok {
-						conn := value.(*Conn)
-						if tcpHeader.Flags == header.FIN {
-							go conn.CloseResponse()
-
-						} else if tcpHeader.Flags & header.ACK > 0 {
-							conn.UpdateTime()
-						}
-
-						select {
-						case conn.InputChan <- string(data):
-						default:
-						}
-
-					} else if value, ok := p.routerListener.Load(dst); ok {
-						listener := value.(*Listener)
-						select {
-						case listener.InputChan <- string(data):
-						default:
-						}
+		batch, ok := s.link.(BatchLink)
+		for !s.isClosed() {
+			if ok {
+				if packets, err := batch.ReadBatch(); err == nil {
+					for _, data := range packets {
+						s.input(data)
 					}
 				}
+			} else if data, err := s.link.Read(); err == nil {
+				s.input(data)
 			}
 		}
 	}()
 
-	go p.CleanTimeoutConns()
+	go s.transmit()
+	go s.CleanTimeoutConns()
+}
+
+//Dispatch a received packet to its conn or listener
+func (s *Stack) input(data []byte) {
+	//nil until the last fragment comes
+	if _, _, _, _, _, ok := parseFragment(data); ok {
+		data = s.frags.add(data)
+	}
+	if len(data) == 0 {
+		return
+	}
+
+	if sg, err := parseSegment(data); err == nil {
+		src, dst := sg.src, sg.dst
+		if value, ok := s.router.Load(connKey(dst, src)); ok {
+			conn := value.(*Conn)
+			conn.input(string(data), sg)
+
+		} else if value, ok := s.routerListener.Load(dst); ok {
+			listener := value.(*Listener)
+			trySend(listener.InputChan, string(data))
+		}
+
+	} else if local, remote, seq, mtu, err := parseTooBig(data); err == nil {
+		s.tooBig(local, remote, seq, mtu)
+	}
+}
+
+//Send the packets of all the conns and listeners. Those queued while the link is busy go in the next batch.
+func (s *Stack) transmit() {
+	batch, isBatch := s.link.(BatchLink)
+	packets := make([][]byte, 0, TXBATCHSIZE)
+	for {
+		var data string
+		select {
+		case data = <-s.output:
+		case <-s.done:
+			return
+		}
+		packets = s.fragmentLowered(append(packets[:0], []byte(data)))
+
+	drain:
+		for len(packets) < TXBATCHSIZE {
+			select {
+			case data = <-s.output:
+				packets = s.fragmentLowered(append(packets, []byte(data)))
+			default:
+				break drain
+			}
+		}
+
+		if isBatch {
+			batch.WriteBatch(packets)
+		} else {
+			for _, p := range packets {
+				s.link.Write(p)
+			}
+		}
+	}
 }
@@ -1,23 +1,49 @@
 package ptcp
 
 import (
+	"encoding/binary"
+	"fmt"
 	"net"
+	"sync"
 	"syscall"
 
 	"github.com/xitongsys/ethernet-go/header"
+	"github.com/xitongsys/ptcp/netinfo"
 	"github.com/xitongsys/ptcp/util"
 )
 
 var RAWBUFSIZE = 65535
 
+//Max frames received or sent by one recvmmsg/sendmmsg
+var RAWBATCHSIZE = 32
+
+//Read timeout of the raw socket, so the read loop can notice the stack is closed
+var RAWREADTIMEOUT = 500
+
+//Raw is the AF_PACKET Link, it resolves the next hop itself and does the Ethernet framing
 type Raw struct {
 	ifName string
 	iface  *net.Interface
 	fd     int
 	buf    []byte
+	route  *netinfo.Route
+	arp    *netinfo.Arp
+	route6 *netinfo.Route6
+	neigh  *netinfo.Neigh
+	//nil if the interface has no ipv4 address
+	resolver *arpResolver
+	//nil without the TPACKET_V3 rings, the frames are received and sent by recvmmsg/sendmmsg
+	ring *packetRing
+	//Allocated by the first ReadBatch, only used by the reading goroutine
+	readBatch *mmsgBatch
+	packets   [][]byte
+	//Serializes the WriteBatch calls
+	writeMu    sync.Mutex
+	writeBatch *mmsgBatch
+	frames     [][]byte
 }
 
-func NewRaw(interfaceName string) (*Raw, error) {
+func NewRaw(interfaceName string, route *netinfo.Route, arp *netinfo.Arp, route6 *netinfo.Route6, neigh *netinfo.Neigh) (*Raw, error) {
 	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(util.Htons(syscall.ETH_P_ALL)))
 	if err != nil {
 		return nil, err
@@ -25,72 +51,307 @@ func NewRaw(interfaceName string) (*Raw, error) {
 
 	iface, err := net.InterfaceByName(interfaceName)
 	if err != nil {
+		syscall.Close(fd)
 		return nil, err
 	}
 
 	if err = syscall.BindToDevice(fd, interfaceName); err != nil {
+		syscall.Close(fd)
 		return nil, err
 	}
 
 	if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		syscall.Close(fd)
 		return nil, err
 	}
 
-	return &Raw{
+	tv := syscall.NsecToTimeval(int64(RAWREADTIMEOUT) * 1000000)
+	if err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	r := &Raw{
 		ifName: interfaceName,
 		iface:  iface,
 		fd:     fd,
 		buf:    make([]byte, RAWBUFSIZE),
-	}, nil
+		route:  route,
+		arp:    arp,
+		route6: route6,
+		neigh:  neigh,
+	}
+	if ip := interfaceIpv4(iface); ip != nil {
+		r.resolver = newArpResolver(iface.HardwareAddr, ip, r.sendFrame)
+	}
+	return r, nil
 }
 
-func (r *Raw) Read() ([]byte, error) {
-	n, _, err := syscall.Recvfrom(r.fd, r.buf, 0)
+//Raw link which receives and sends the frames through TPACKET_V3 rings mapped in memory
+func NewRingRaw(interfaceName string, route *netinfo.Route, arp *netinfo.Arp, route6 *netinfo.Route6, neigh *netinfo.Neigh) (*Raw, error) {
+	r, err := NewRaw(interfaceName, route, arp, route6, neigh)
+	if err != nil {
+		return nil, err
+	}
+	if r.ring, err = newPacketRing(r.fd, r.iface.Index, r.iface.MTU); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
 
-	if err == nil {
-		eth := &header.Frame{}
-		err = eth.UnmarshalBinary(r.buf[:n])
-		return eth.Payload, err
+func interfaceIpv4(iface *net.Interface) net.IP {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if v, ok := addr.(*net.IPNet); ok && v.IP.To4() != nil {
+			return v.IP.To4()
+		}
 	}
-	return nil, err
+	return nil
 }
 
-func (r *Raw) Write(data []byte) error {
-	_, dstIp, err := header.GetIp(data)
+//The ARP packets are handled here and an empty packet is returned
+func (r *Raw) Read() ([]byte, error) {
+	var n int
+	var err error
+	if r.ring != nil {
+		n, err = r.ring.read(r.buf, true)
+	} else {
+		n, _, err = syscall.Recvfrom(r.fd, r.buf, 0)
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return r.input(r.buf[:n])
+}
 
+//Up to RAWBATCHSIZE packets received by one recvmmsg, or read from the ring. It waits for the first one like Read.
+//The packets are valid until the next read, the ARP packets are handled here.
+func (r *Raw) ReadBatch() ([][]byte, error) {
+	if r.readBatch == nil {
+		r.readBatch = newMmsgBatch(RAWBATCHSIZE, RAWBUFSIZE)
+	}
+	bufs := r.readBatch.bufs
+	frames := r.packets[:0]
+	if r.ring != nil {
+		for i := range bufs {
+			n, err := r.ring.read(bufs[i], i == 0)
+			if err != nil {
+				if i == 0 {
+					return nil, err
+				}
+				break
+			}
+			frames = append(frames, bufs[i][:n])
+		}
+	} else {
+		n, err := r.readBatch.recv(r.fd)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < n; i++ {
+			frames = append(frames, bufs[i][:r.readBatch.size(i)])
+		}
+	}
+
+	packets := frames[:0]
+	for _, frame := range frames {
+		if packet, err := r.input(frame); err == nil && len(packet) > 0 {
+			packets = append(packets, packet)
+		}
+	}
+	r.packets = packets
+	return packets, nil
+}
+
+//Received frame -> IP packet, empty for the ARP packets
+func (r *Raw) input(frame []byte) ([]byte, error) {
 	eth := &header.Frame{}
-	eth.EtherType = header.EtherTypeIPv4
+	if err := eth.UnmarshalBinary(frame); err != nil {
+		return nil, err
+	}
+	if eth.EtherType == header.EtherTypeARP {
+		if r.resolver != nil {
+			r.resolver.input(eth.Payload)
+		}
+		return []byte{}, nil
+	}
+	return eth.Payload, nil
+}
 
-	gatewayIp, err := route.GetGateway(dstIp)
-	if err != nil {
+func (r *Raw) Write(data []byte) error {
+	ethData, err := r.frame(data)
+	if err != nil || ethData == nil {
 		return err
+	}
+	return r.sendFrame(ethData)
+}
 
-	} else if gatewayIp == 0 {
-		eth.Destination = r.iface.HardwareAddr
+//Send the packets by one sendmmsg per RAWBATCHSIZE, or through the ring. The first error is returned,
+//the other packets are still sent.
+func (r *Raw) WriteBatch(packets [][]byte) error {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
 
+	var first error
+	frames := r.frames[:0]
+	for _, data := range packets {
+		ethData, err := r.frame(data)
+		if err != nil && first == nil {
+			first = err
+		}
+		if err == nil && ethData != nil {
+			frames = append(frames, ethData)
+		}
+	}
+	r.frames = frames[:0]
+	if len(frames) == 0 {
+		return first
+	}
+
+	var err error
+	if r.ring != nil {
+		for _, f := range frames {
+			if err = r.ring.write(f); err != nil {
+				break
+			}
+		}
 	} else {
-		gateWayHwAddr, err := arp.GetHwAddr(gatewayIp)
-		if err != nil {
-			return err
+		if r.writeBatch == nil {
+			r.writeBatch = newMmsgBatch(RAWBATCHSIZE, 0)
+		}
+		err = r.writeBatch.send(r.fd, frames, r.sendAddr())
+	}
+	if first == nil {
+		first = err
+	}
+	return first
+}
+
+//Ethernet frame of an IP packet. It's nil if the packet waits for the ARP reply of its next hop.
+func (r *Raw) frame(data []byte) ([]byte, error) {
+	_, dstIp, _, err := parseIp(data)
+	if err != nil {
+		return nil, err
+	}
+
+	eth := &header.Frame{}
+	if dstIp.To4() != nil {
+		eth.EtherType = header.EtherTypeIPv4
+		var hop net.IP
+		if eth.Destination, hop, err = r.nextHop4(dstIp); err == nil && eth.Destination == nil {
+			//Sent when the ARP reply comes
+			return nil, r.resolver.resolve(hop, data)
 		}
-		eth.Destination = gateWayHwAddr
+	} else {
+		eth.EtherType = header.EtherTypeIPv6
+		eth.Destination, err = r.nextHop6(dstIp)
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	eth.Source = r.iface.HardwareAddr
 	eth.Payload = data
-	ethData, err := eth.MarshalBinary()
-	if err != nil {
-		return err
-	}
+	return eth.MarshalBinary()
+}
 
+func (r *Raw) sendFrame(ethData []byte) error {
+	if r.ring != nil {
+		return r.ring.write(ethData)
+	}
+	src := r.iface.HardwareAddr
 	addr := syscall.SockaddrLinklayer{
 		Halen:   6,
-		Addr:    [8]byte{eth.Source[0], eth.Source[1], eth.Source[2], eth.Source[3], eth.Source[4], eth.Source[5], 0xff, 0xff},
+		Addr:    [8]byte{src[0], src[1], src[2], src[3], src[4], src[5], 0xff, 0xff},
 		Ifindex: r.iface.Index,
 	}
 
 	return syscall.Sendto(r.fd, ethData, 0, &addr)
 }
+
+//Destination of the sendmmsg frames, the same as sendFrame's
+func (r *Raw) sendAddr() *syscall.RawSockaddrLinklayer {
+	src := r.iface.HardwareAddr
+	return &syscall.RawSockaddrLinklayer{
+		Family:  syscall.AF_PACKET,
+		Halen:   6,
+		Addr:    [8]byte{src[0], src[1], src[2], src[3], src[4], src[5], 0xff, 0xff},
+		Ifindex: int32(r.iface.Index),
+	}
+}
+
+//Hardware address of the next hop to dstIp. It's nil if the next hop has to be resolved by ARP.
+func (r *Raw) nextHop4(dstIp net.IP) ([]byte, net.IP, error) {
+	dst := binary.BigEndian.Uint32(dstIp.To4())
+	gatewayIp, err := r.route.GetGateway(dst)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hop := make(net.IP, net.IPv4len)
+	if gatewayIp == 0 {
+		//On-link, the destination itself
+		gatewayIp = dst
+	}
+	binary.BigEndian.PutUint32(hop, gatewayIp)
+
+	if hw, err := r.arp.GetHwAddr(gatewayIp); err == nil {
+		return hw, hop, nil
+	}
+	if r.resolver == nil {
+		return nil, nil, fmt.Errorf("hw of ip %v not found", hop)
+	}
+	if hop.Equal(r.resolver.ip) {
+		return r.iface.HardwareAddr, hop, nil
+	}
+	if hw, ok := r.resolver.lookup(hop); ok {
+		return hw, hop, nil
+	}
+	return nil, hop, nil
+}
+
+func (r *Raw) nextHop6(dstIp net.IP) ([]byte, error) {
+	gatewayIp, err := r.route6.GetGateway(dstIp)
+	if err != nil {
+		return nil, err
+
+	} else if gatewayIp == nil {
+		//On-link, the destination itself
+		if hw, err := r.neigh.GetHwAddr(dstIp); err == nil {
+			return hw, nil
+		}
+		return r.iface.HardwareAddr, nil
+	}
+	return r.neigh.GetHwAddr(gatewayIp)
+}
+
+//Attach a BPF filter which drops in the kernel the frames of the other ports and protocols
+func (r *Raw) SetPorts(ports []uint16) error {
+	filter, err := portFilterProgram(ports)
+	if err != nil {
+		return err
+	}
+	return syscall.AttachLsf(r.fd, filter)
+}
+
+func (r *Raw) MTU() int {
+	return r.iface.MTU
+}
+
+func (r *Raw) HardwareAddr() net.HardwareAddr {
+	return r.iface.HardwareAddr
+}
+
+func (r *Raw) Close() error {
+	if r.resolver != nil {
+		r.resolver.close()
+	}
+	if r.ring != nil {
+		r.ring.close()
+	}
+	return syscall.Close(r.fd)
+}
@@ -0,0 +1,190 @@
+package ptcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/xitongsys/ethernet-go/header"
+)
+
+//Time in ms a packet waits for the hardware address of its next hop before it's dropped
+var ARPTIMEOUT = 3000
+
+//Interval in ms between two who-has requests for the same next hop
+var ARPRETRYINTERVAL = 1000
+
+//Max packets waiting for one next hop
+var ARPQUEUELEN = 64
+
+//Lifetime in seconds of the learned hardware addresses
+var ARPCACHETIME = 60
+
+const ARPPACKETLEN = 28
+
+//arpResolver sends ARP requests for the next hops missing in the kernel table, since the kernel never sees
+//the packets of ptcp. The packets are queued until the reply comes.
+type arpResolver struct {
+	hwAddr net.HardwareAddr
+	ip     net.IP
+	//Sends an Ethernet frame on the link
+	send func(frame []byte) error
+	//Key: next hop ip, Value: net.HardwareAddr
+	cache *cache.Cache
+
+	mu sync.Mutex
+	//Key: next hop ip
+	pending map[string]*arpQueue
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type arpQueue struct {
+	packets   [][]byte
+	started   time.Time
+	requested time.Time
+}
+
+func newArpResolver(hwAddr net.HardwareAddr, ip net.IP, send func(frame []byte) error) *arpResolver {
+	r := &arpResolver{
+		hwAddr:  hwAddr,
+		ip:      ip.To4(),
+		send:    send,
+		cache:   cache.New(time.Duration(ARPCACHETIME)*time.Second, time.Duration(ARPCACHETIME)*2*time.Second),
+		pending: map[string]*arpQueue{},
+		done:    make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+func (r *arpResolver) lookup(ip net.IP) (net.HardwareAddr, bool) {
+	if v, ok := r.cache.Get(ip.String()); ok {
+		return v.(net.HardwareAddr), true
+	}
+	return nil, false
+}
+
+//Queue the ip packet until the hardware address of hop is known
+func (r *arpResolver) resolve(hop net.IP, packet []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := hop.String()
+	q, ok := r.pending[key]
+	if !ok {
+		q = &arpQueue{
+			started: time.Now(),
+		}
+		r.pending[key] = q
+	}
+	if len(q.packets) >= ARPQUEUELEN {
+		return fmt.Errorf("arp queue of %v is full", key)
+	}
+	q.packets = append(q.packets, packet)
+
+	if !ok {
+		q.requested = time.Now()
+		return r.request(hop)
+	}
+	return nil
+}
+
+//Handle a received ARP packet. The sender is learned if the packet is for us,
+//and the packets waiting for it are sent.
+func (r *arpResolver) input(payload []byte) {
+	if len(payload) < ARPPACKETLEN ||
+		binary.BigEndian.Uint16(payload[0:]) != 1 ||
+		binary.BigEndian.Uint16(payload[2:]) != uint16(header.EtherTypeIPv4) ||
+		payload[4] != 6 || payload[5] != 4 {
+		return
+	}
+
+	senderHw := net.HardwareAddr(append([]byte{}, payload[8:14]...))
+	senderIp := net.IP(append([]byte{}, payload[14:18]...))
+	targetIp := net.IP(payload[24:28])
+	if !targetIp.Equal(r.ip) || senderIp.IsUnspecified() {
+		return
+	}
+
+	key := senderIp.String()
+	r.cache.Set(key, senderHw, cache.DefaultExpiration)
+
+	r.mu.Lock()
+	q, ok := r.pending[key]
+	delete(r.pending, key)
+	r.mu.Unlock()
+
+	if ok {
+		for _, packet := range q.packets {
+			if frame, err := r.frame(senderHw, header.EtherTypeIPv4, packet); err == nil {
+				r.send(frame)
+			}
+		}
+	}
+}
+
+//Drop the timed out queues and repeat the requests of the others
+func (r *arpResolver) run() {
+	ticker := time.NewTicker(time.Millisecond * time.Duration(ARPRETRYINTERVAL) / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		r.mu.Lock()
+		for key, q := range r.pending {
+			if now.Sub(q.started) >= time.Millisecond*time.Duration(ARPTIMEOUT) {
+				delete(r.pending, key)
+
+			} else if now.Sub(q.requested) >= time.Millisecond*time.Duration(ARPRETRYINTERVAL) {
+				q.requested = now
+				r.request(net.ParseIP(key))
+			}
+		}
+		r.mu.Unlock()
+	}
+}
+
+//Broadcast a who-has request
+func (r *arpResolver) request(ip net.IP) error {
+	payload := make([]byte, ARPPACKETLEN)
+	binary.BigEndian.PutUint16(payload[0:], 1)
+	binary.BigEndian.PutUint16(payload[2:], uint16(header.EtherTypeIPv4))
+	payload[4], payload[5] = 6, 4
+	binary.BigEndian.PutUint16(payload[6:], 1)
+	copy(payload[8:14], r.hwAddr)
+	copy(payload[14:18], r.ip)
+	copy(payload[24:28], ip.To4())
+
+	broadcast := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	frame, err := r.frame(broadcast, header.EtherTypeARP, payload)
+	if err != nil {
+		return err
+	}
+	return r.send(frame)
+}
+
+func (r *arpResolver) frame(dst net.HardwareAddr, etherType header.EtherType, payload []byte) ([]byte, error) {
+	eth := &header.Frame{
+		Source:      r.hwAddr,
+		Destination: dst,
+		EtherType:   etherType,
+		Payload:     payload,
+	}
+	return eth.MarshalBinary()
+}
+
+func (r *arpResolver) close() {
+	r.closeOnce.Do(func() {
+		close(r.done)
+	})
+}
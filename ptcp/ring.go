@@ -0,0 +1,307 @@
+package ptcp
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+//Size of the ring blocks, a multiple of the page size. RINGRXBLOCKS for the receive ring, RINGTXBLOCKS for the transmit ring
+var RINGBLOCKSIZE = 1 << 18
+var RINGRXBLOCKS = 32
+var RINGTXBLOCKS = 8
+
+//A receive block is handed over after this time in ms even if it isn't full, it's the added latency at low rates
+var RINGBLOCKTIMEOUT = 1
+
+//Socket options and values of linux/if_packet.h and poll.h
+const (
+	PACKET_VERSION = 10
+	PACKET_RX_RING = 5
+	PACKET_TX_RING = 13
+	TPACKET_V3     = 2
+
+	TP_STATUS_KERNEL       = 0
+	TP_STATUS_USER         = 1
+	TP_STATUS_AVAILABLE    = 0
+	TP_STATUS_SEND_REQUEST = 1
+	TP_STATUS_SENDING      = 2
+
+	//sizeof(struct tpacket3_hdr), where the frame starts in a transmit slot
+	TPACKET3HDRLEN = 48
+
+	POLLIN   = 0x1
+	POLLERR  = 0x8
+	POLLNVAL = 0x20
+)
+
+//struct tpacket_req3
+type tpacketReq3 struct {
+	blockSize      uint32
+	blockNr        uint32
+	frameSize      uint32
+	frameNr        uint32
+	retireBlkTov   uint32
+	sizeofPriv     uint32
+	featureReqWord uint32
+}
+
+//packetRing is a pair of TPACKET_V3 rings mapped from an AF_PACKET socket. The kernel fills the receive ring
+//by blocks of frames, which are read without syscalls. The frames written in the transmit ring are sent
+//by one syscall for all those queued in the meantime.
+type packetRing struct {
+	fd  int
+	mem []byte
+	//Destination of the sends, its protocol is 0 so the kernel takes it from the frames
+	addr *syscall.SockaddrLinklayer
+
+	//Receive ring, only used by the reading goroutine
+	rx        []byte
+	blockSize int
+	rxBlocks  int
+	block     int
+	//Packets read in the current block and offset of the next one
+	readPkts int
+	offset   int
+
+	//Transmit ring
+	txMu      sync.Mutex
+	tx        []byte
+	frameSize int
+	txFrames  int
+	txNext    int
+	kick      chan struct{}
+
+	//Held while the memory is accessed, so it's not unmapped under a reader
+	mu     sync.RWMutex
+	closed bool
+	done   chan struct{}
+}
+
+//Map the rings of an AF_PACKET socket on the interface ifIndex. The transmit slots fit a frame of mtu bytes.
+func newPacketRing(fd int, ifIndex int, mtu int) (*packetRing, error) {
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_PACKET, PACKET_VERSION, TPACKET_V3); err != nil {
+		return nil, fmt.Errorf("TPACKET_V3 not supported: %v", err)
+	}
+
+	//Power of 2 slots with room for the header and the Ethernet frame
+	frameSize := 2048
+	for frameSize < TPACKET3HDRLEN+14+mtu {
+		frameSize *= 2
+	}
+	blockSize := RINGBLOCKSIZE
+	if blockSize < frameSize {
+		blockSize = frameSize
+	}
+
+	rxReq := tpacketReq3{
+		blockSize:    uint32(blockSize),
+		blockNr:      uint32(RINGRXBLOCKS),
+		frameSize:    uint32(frameSize),
+		frameNr:      uint32(blockSize / frameSize * RINGRXBLOCKS),
+		retireBlkTov: uint32(RINGBLOCKTIMEOUT),
+	}
+	if err := setsockoptRing(fd, PACKET_RX_RING, &rxReq); err != nil {
+		return nil, err
+	}
+	txReq := tpacketReq3{
+		blockSize: uint32(blockSize),
+		blockNr:   uint32(RINGTXBLOCKS),
+		frameSize: uint32(frameSize),
+		frameNr:   uint32(blockSize / frameSize * RINGTXBLOCKS),
+	}
+	if err := setsockoptRing(fd, PACKET_TX_RING, &txReq); err != nil {
+		return nil, err
+	}
+
+	rxSize := blockSize * RINGRXBLOCKS
+	mem, err := syscall.Mmap(fd, 0, rxSize+blockSize*RINGTXBLOCKS, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &packetRing{
+		fd:        fd,
+		mem:       mem,
+		addr:      &syscall.SockaddrLinklayer{Ifindex: ifIndex, Halen: 6},
+		rx:        mem[:rxSize],
+		blockSize: blockSize,
+		rxBlocks:  RINGRXBLOCKS,
+		tx:        mem[rxSize:],
+		frameSize: frameSize,
+		txFrames:  int(txReq.frameNr),
+		kick:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	go r.flush()
+	return r, nil
+}
+
+func setsockoptRing(fd int, opt int, req *tpacketReq3) error {
+	_, _, errno := syscall.Syscall6(SYS_SETSOCKOPT, uintptr(fd), uintptr(syscall.SOL_PACKET), uintptr(opt),
+		uintptr(unsafe.Pointer(req)), unsafe.Sizeof(*req), 0)
+	if errno != 0 {
+		return fmt.Errorf("ring setup failed: %v", errno)
+	}
+	return nil
+}
+
+func u32At(b []byte, off int) *uint32 {
+	return (*uint32)(unsafe.Pointer(&b[off]))
+}
+
+func u16At(b []byte, off int) uint16 {
+	return *(*uint16)(unsafe.Pointer(&b[off]))
+}
+
+//Copy the next received frame in buf. If wait, it waits at most RAWREADTIMEOUT ms for a block,
+//else it returns EAGAIN when no frame is ready.
+//
+//Block descriptor: version (4) + offset to priv (4) + status (4) + packet count (4) + offset to the first packet (4)...
+//Packet header: offset to the next packet (4) + time (8) + captured length (4) + length (4) + status (4) + offset to the frame (2)...
+func (r *packetRing) read(buf []byte, wait bool) (int, error) {
+	for {
+		r.mu.RLock()
+		if r.closed {
+			r.mu.RUnlock()
+			return 0, fmt.Errorf("ring closed")
+		}
+		block := r.rx[r.block*r.blockSize : (r.block+1)*r.blockSize]
+		if atomic.LoadUint32(u32At(block, 8))&TP_STATUS_USER == 0 {
+			r.mu.RUnlock()
+			if !wait {
+				return 0, syscall.EAGAIN
+			}
+			if ready, err := r.poll(POLLIN); err != nil || !ready {
+				//Like a socket read timeout
+				if err == nil {
+					err = syscall.EAGAIN
+				}
+				return 0, err
+			}
+			continue
+		}
+
+		count := int(*u32At(block, 12))
+		if r.readPkts == 0 {
+			r.offset = int(*u32At(block, 16))
+		}
+		n := 0
+		if r.readPkts < count {
+			pkt := block[r.offset:]
+			snaplen, mac := int(*u32At(pkt, 12)), int(u16At(pkt, 24))
+			n = copy(buf, pkt[mac:mac+snaplen])
+			r.offset += int(*u32At(pkt, 0))
+			r.readPkts++
+		}
+		//Give the block back to the kernel once all its packets are read
+		if r.readPkts >= count {
+			atomic.StoreUint32(u32At(block, 8), TP_STATUS_KERNEL)
+			r.block, r.readPkts = (r.block+1)%r.rxBlocks, 0
+		}
+		r.mu.RUnlock()
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+//Returns false on timeout
+func (r *packetRing) poll(events int16) (bool, error) {
+	pfd := struct {
+		fd      int32
+		events  int16
+		revents int16
+	}{fd: int32(r.fd), events: events}
+	ts := syscall.NsecToTimespec(int64(RAWREADTIMEOUT) * int64(time.Millisecond))
+	n, _, errno := syscall.Syscall6(syscall.SYS_PPOLL, uintptr(unsafe.Pointer(&pfd)), 1, uintptr(unsafe.Pointer(&ts)), 0, 0, 0)
+	if errno == syscall.EINTR {
+		return true, nil
+	}
+	if errno != 0 {
+		return false, errno
+	}
+	if pfd.revents&(POLLERR|POLLNVAL) != 0 {
+		return false, fmt.Errorf("ring poll failed")
+	}
+	return n > 0, nil
+}
+
+//Queue a frame in the transmit ring, it waits for a free slot if the ring is full.
+//Once a socket has a transmit ring, its sends only flush the ring.
+func (r *packetRing) write(frame []byte) error {
+	if TPACKET3HDRLEN+len(frame) > r.frameSize {
+		return fmt.Errorf("frame too long: %v", len(frame))
+	}
+
+	for {
+		r.mu.RLock()
+		if r.closed {
+			r.mu.RUnlock()
+			return fmt.Errorf("ring closed")
+		}
+		r.txMu.Lock()
+		slot := r.tx[r.txNext*r.frameSize : (r.txNext+1)*r.frameSize]
+		status := atomic.LoadUint32(u32At(slot, 20))
+		free := status != TP_STATUS_SEND_REQUEST && status != TP_STATUS_SENDING
+		if free {
+			r.txNext = (r.txNext + 1) % r.txFrames
+			copy(slot[TPACKET3HDRLEN:], frame)
+			*u32At(slot, 16) = uint32(len(frame))
+			*u32At(slot, 12) = uint32(len(frame))
+			atomic.StoreUint32(u32At(slot, 20), TP_STATUS_SEND_REQUEST)
+		}
+		r.txMu.Unlock()
+		r.mu.RUnlock()
+
+		select {
+		case r.kick <- struct{}{}:
+		default:
+		}
+		if free {
+			return nil
+		}
+		//The ring is full, wait until its frames are sent. POLLOUT doesn't tell it, a packet socket is always writable.
+		if err := r.send(0); err != nil {
+			return err
+		}
+	}
+}
+
+func (r *packetRing) send(flags int) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return fmt.Errorf("ring closed")
+	}
+	//Sendto fills the raw sockaddr, each sender needs its own
+	addr := *r.addr
+	return syscall.Sendto(r.fd, nil, flags, &addr)
+}
+
+//Send the queued frames without waiting for them. The frames written during a send wait for the next one, so they go in one batch.
+func (r *packetRing) flush() {
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-r.kick:
+		}
+		r.send(syscall.MSG_DONTWAIT)
+	}
+}
+
+//Unmap the rings, the socket is closed by its owner
+func (r *packetRing) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	close(r.done)
+	return syscall.Munmap(r.mem)
+}
@@ -0,0 +1,285 @@
+package ptcp
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//RSTFilter keeps the kernel from resetting the ptcp conns, since it doesn't know them.
+//The stack adds an entry for each listener (remoteAddr is empty) and each dialed conn, and removes it on Close.
+type RSTFilter interface {
+	Add(localAddr string, remoteAddr string) error
+	Remove(localAddr string, remoteAddr string) error
+	//Remove all the entries
+	Close() error
+}
+
+//nft if it's installed, else iptables
+func NewRSTFilter() (RSTFilter, error) {
+	if _, err := exec.LookPath("nft"); err == nil {
+		return NewNftFilter()
+	}
+	return NewIptablesFilter()
+}
+
+func runCommand(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%v %v: %v %v", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+//Rules are tagged with the pid of their process, the ones of dead processes are removed
+func processAlive(pid int) bool {
+	_, err := os.Stat("/proc/" + strconv.Itoa(pid))
+	return err == nil
+}
+
+//Entries added more than once are removed on the last Remove
+type rstRefs struct {
+	mu   sync.Mutex
+	refs map[string]int
+}
+
+func (r *rstRefs) inc(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.refs[key]++
+	return r.refs[key] == 1
+}
+
+func (r *rstRefs) dec(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.refs[key] == 0 {
+		return false
+	}
+	r.refs[key]--
+	if r.refs[key] == 0 {
+		delete(r.refs, key)
+		return true
+	}
+	return false
+}
+
+//Match of the outgoing RSTs from localAddr to remoteAddr: ipv6, src ip, src port, dst ip, dst port
+func rstMatch(localAddr string, remoteAddr string) (bool, string, string, string, string, error) {
+	ip, port, err := splitAddr(localAddr)
+	if err != nil {
+		return false, "", "", "", "", err
+	}
+	ipv6 := ip.To4() == nil
+	if remoteAddr == "" {
+		return ipv6, ip.String(), strconv.Itoa(int(port)), "", "", nil
+	}
+	rip, rport, err := splitAddr(remoteAddr)
+	if err != nil {
+		return false, "", "", "", "", err
+	}
+	return ipv6, ip.String(), strconv.Itoa(int(port)), rip.String(), strconv.Itoa(int(rport)), nil
+}
+
+//IptablesFilter adds an iptables/ip6tables DROP rule in OUTPUT for each entry
+type IptablesFilter struct {
+	tag  string
+	refs rstRefs
+}
+
+var iptablesTagRe = regexp.MustCompile(`--comment "?ptcp-(\d+)"?`)
+
+func NewIptablesFilter() (*IptablesFilter, error) {
+	f := &IptablesFilter{
+		tag:  "ptcp-" + strconv.Itoa(os.Getpid()),
+		refs: rstRefs{refs: map[string]int{}},
+	}
+	for _, cmd := range []string{"iptables", "ip6tables"} {
+		if err := f.sweep(cmd, false); err != nil && cmd == "iptables" {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (f *IptablesFilter) rule(localAddr string, remoteAddr string) (string, []string, error) {
+	ipv6, sip, sport, dip, dport, err := rstMatch(localAddr, remoteAddr)
+	if err != nil {
+		return "", nil, err
+	}
+	cmd := "iptables"
+	if ipv6 {
+		cmd = "ip6tables"
+	}
+	args := []string{"OUTPUT", "-p", "tcp", "--tcp-flags", "RST", "RST", "-s", sip, "--sport", sport}
+	if dip != "" {
+		args = append(args, "-d", dip, "--dport", dport)
+	}
+	args = append(args, "-m", "comment", "--comment", f.tag, "-j", "DROP")
+	return cmd, args, nil
+}
+
+func (f *IptablesFilter) Add(localAddr string, remoteAddr string) error {
+	cmd, args, err := f.rule(localAddr, remoteAddr)
+	if err != nil {
+		return err
+	}
+	key := connKey(localAddr, remoteAddr)
+	if !f.refs.inc(key) {
+		return nil
+	}
+	if _, err = runCommand(cmd, append([]string{"-w", "-A"}, args...)...); err != nil {
+		f.refs.dec(key)
+	}
+	return err
+}
+
+func (f *IptablesFilter) Remove(localAddr string, remoteAddr string) error {
+	cmd, args, err := f.rule(localAddr, remoteAddr)
+	if err != nil {
+		return err
+	}
+	if !f.refs.dec(connKey(localAddr, remoteAddr)) {
+		return nil
+	}
+	_, err = runCommand(cmd, append([]string{"-w", "-D"}, args...)...)
+	return err
+}
+
+func (f *IptablesFilter) Close() error {
+	f.refs.mu.Lock()
+	f.refs.refs = map[string]int{}
+	f.refs.mu.Unlock()
+
+	err := f.sweep("iptables", true)
+	if err6 := f.sweep("ip6tables", true); err == nil {
+		err = err6
+	}
+	return err
+}
+
+//Delete the rules of the dead processes, and ours if own is true
+func (f *IptablesFilter) sweep(cmd string, own bool) error {
+	out, err := runCommand(cmd, "-w", "-S", "OUTPUT")
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(out, "\n") {
+		m := iptablesTagRe.FindStringSubmatch(line)
+		if m == nil || !strings.HasPrefix(line, "-A ") {
+			continue
+		}
+		pid, _ := strconv.Atoi(m[1])
+		if (pid == os.Getpid()) != own || (!own && processAlive(pid)) {
+			continue
+		}
+		args := strings.Fields(strings.Replace(line, `"`, "", -1))
+		args[0] = "-D"
+		runCommand(cmd, append([]string{"-w"}, args...)...)
+	}
+	return nil
+}
+
+//NftFilter keeps its rules in its own table inet ptcp_<pid>, which is deleted on Close
+type NftFilter struct {
+	table string
+	refs  rstRefs
+
+	mu sync.Mutex
+	//Key: connKey, Value: rule handle
+	handles map[string]string
+}
+
+var nftTableRe = regexp.MustCompile(`table inet ptcp_(\d+)`)
+var nftHandleRe = regexp.MustCompile(`# handle (\d+)`)
+
+func NewNftFilter() (*NftFilter, error) {
+	f := &NftFilter{
+		table:   "ptcp_" + strconv.Itoa(os.Getpid()),
+		refs:    rstRefs{refs: map[string]int{}},
+		handles: map[string]string{},
+	}
+
+	out, err := runCommand("nft", "list", "tables")
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range nftTableRe.FindAllStringSubmatch(out, -1) {
+		if pid, _ := strconv.Atoi(m[1]); pid == os.Getpid() || !processAlive(pid) {
+			runCommand("nft", "delete", "table", "inet", "ptcp_"+m[1])
+		}
+	}
+
+	if _, err = runCommand("nft", "add", "table", "inet", f.table); err != nil {
+		return nil, err
+	}
+	if _, err = runCommand("nft", "add", "chain", "inet", f.table, "output", "{ type filter hook output priority 0 ; }"); err != nil {
+		runCommand("nft", "delete", "table", "inet", f.table)
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *NftFilter) Add(localAddr string, remoteAddr string) error {
+	ipv6, sip, sport, dip, dport, err := rstMatch(localAddr, remoteAddr)
+	if err != nil {
+		return err
+	}
+	key := connKey(localAddr, remoteAddr)
+	if !f.refs.inc(key) {
+		return nil
+	}
+
+	family := "ip"
+	if ipv6 {
+		family = "ip6"
+	}
+	args := []string{"-e", "-a", "add", "rule", "inet", f.table, "output", family, "saddr", sip, "tcp", "sport", sport}
+	if dip != "" {
+		args = append(args, family, "daddr", dip, "tcp", "dport", dport)
+	}
+	args = append(args, "tcp", "flags", "&", "rst", "==", "rst", "drop")
+
+	out, err := runCommand("nft", args...)
+	if err != nil {
+		f.refs.dec(key)
+		return err
+	}
+	m := nftHandleRe.FindStringSubmatch(out)
+	if m == nil {
+		f.refs.dec(key)
+		return fmt.Errorf("no handle in nft output: %v", out)
+	}
+
+	f.mu.Lock()
+	f.handles[key] = m[1]
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *NftFilter) Remove(localAddr string, remoteAddr string) error {
+	key := connKey(localAddr, remoteAddr)
+	if !f.refs.dec(key) {
+		return nil
+	}
+
+	f.mu.Lock()
+	handle, ok := f.handles[key]
+	delete(f.handles, key)
+	f.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	_, err := runCommand("nft", "delete", "rule", "inet", f.table, "output", "handle", handle)
+	return err
+}
+
+func (f *NftFilter) Close() error {
+	_, err := runCommand("nft", "delete", "table", "inet", f.table)
+	return err
+}
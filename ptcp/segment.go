@@ -0,0 +1,323 @@
+package ptcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	IPV4HEADERLEN = 20
+	IPV6HEADERLEN = 40
+	TCPHEADERLEN  = 20
+	TCPOPTMAXLEN  = 40
+
+	//TCP option kinds
+	TCPOPTEND           = 0
+	TCPOPTNOP           = 1
+	TCPOPTMSS           = 2
+	TCPOPTWSCALE        = 3
+	TCPOPTSACKPERMITTED = 4
+	TCPOPTSACK          = 5
+	TCPOPTTIMESTAMP     = 8
+	//Experimental option of RFC 6994, used for the ptcp extensions
+	TCPOPTEXP = 254
+	PTCPEXID  = 0x5054
+
+	//Subtypes of the ptcp experimental option
+	EXPFEC = 1
+	//Congestion feedback of a receiver, see congestion
+	EXPRATE = 2
+)
+
+var TCPWINDOW = 65535
+var IPTTL = 64
+
+//IP identification of the built packets
+var ipId uint32
+
+//segment is a fake TCP packet
+type segment struct {
+	src     string
+	dst     string
+	seq     uint32
+	ack     uint32
+	flags   uint8
+	window  uint16
+	options []byte
+	data    []byte
+}
+
+//ip:port or [ip6]:port -> ip, port. The zone of a link-local address is dropped, the link is bound to one interface.
+func splitAddr(addr string) (net.IP, uint16, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, 0, fmt.Errorf("invalid ip %v", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid port %v", port)
+	}
+	return ip, uint16(p), nil
+}
+
+func joinAddr(ip net.IP, port uint16) string {
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+//Canonical form of an address, the same as in the parsed packets. e.g. [2001:DB8:0::1]:80 -> [2001:db8::1]:80
+func normalizeAddr(addr string) (string, error) {
+	ip, port, err := splitAddr(addr)
+	if err != nil {
+		return "", err
+	}
+	return joinAddr(ip, port), nil
+}
+
+//Key of a conn in the stack router, the addresses are normalized
+func connKey(localAddr string, remoteAddr string) string {
+	return localAddr + "-" + remoteAddr
+}
+
+func (sg *segment) marshal() ([]byte, error) {
+	srcIp, srcPort, err := splitAddr(sg.src)
+	if err != nil {
+		return nil, err
+	}
+	dstIp, dstPort, err := splitAddr(sg.dst)
+	if err != nil {
+		return nil, err
+	}
+	if (srcIp.To4() == nil) != (dstIp.To4() == nil) {
+		return nil, fmt.Errorf("mixed ip versions %v -> %v", sg.src, sg.dst)
+	}
+
+	optLen := (len(sg.options) + 3) / 4 * 4
+	if optLen > TCPOPTMAXLEN {
+		return nil, fmt.Errorf("tcp options too long: %v", len(sg.options))
+	}
+	tcpLen := TCPHEADERLEN + optLen
+
+	var b, ip, src, dst []byte
+	if srcIp.To4() != nil {
+		total := IPV4HEADERLEN + tcpLen + len(sg.data)
+		if total > 65535 {
+			return nil, fmt.Errorf("packet too long: %v", total)
+		}
+		b = make([]byte, total)
+		ip = b[:IPV4HEADERLEN]
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(total))
+		binary.BigEndian.PutUint16(ip[4:], uint16(atomic.AddUint32(&ipId, 1)))
+		//Don't fragment, the routers send an ICMP message instead, see pmtu.go
+		ip[6] = 0x40
+		ip[8] = byte(IPTTL)
+		ip[9] = 6
+		src, dst = ip[12:16], ip[16:20]
+		copy(src, srcIp.To4())
+		copy(dst, dstIp.To4())
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip, 0))
+
+	} else {
+		payloadLen := tcpLen + len(sg.data)
+		if payloadLen > 65535 {
+			return nil, fmt.Errorf("packet too long: %v", IPV6HEADERLEN+payloadLen)
+		}
+		b = make([]byte, IPV6HEADERLEN+payloadLen)
+		ip = b[:IPV6HEADERLEN]
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(payloadLen))
+		ip[6] = 6
+		ip[7] = byte(IPTTL)
+		src, dst = ip[8:24], ip[24:40]
+		copy(src, srcIp.To16())
+		copy(dst, dstIp.To16())
+	}
+
+	tcp := b[len(ip):]
+	binary.BigEndian.PutUint16(tcp[0:], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], sg.seq)
+	binary.BigEndian.PutUint32(tcp[8:], sg.ack)
+	tcp[12] = byte(tcpLen/4) << 4
+	tcp[13] = sg.flags
+	window := sg.window
+	if window == 0 {
+		window = uint16(TCPWINDOW)
+	}
+	binary.BigEndian.PutUint16(tcp[14:], window)
+	//Padding of the options is zero, which is the end option
+	copy(tcp[TCPHEADERLEN:], sg.options)
+	copy(tcp[tcpLen:], sg.data)
+
+	sum := pseudoHeaderSum(src, dst, len(tcp))
+	binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, sum))
+	return b, nil
+}
+
+//IP packet -> src ip, dst ip, tcp part
+func parseIp(packet []byte) (net.IP, net.IP, []byte, error) {
+	if len(packet) == 0 {
+		return nil, nil, nil, fmt.Errorf("empty packet")
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		return parseIpv4(packet)
+	case 6:
+		return parseIpv6(packet)
+	}
+	return nil, nil, nil, fmt.Errorf("unknown ip version %v", packet[0]>>4)
+}
+
+func parseIpv4(packet []byte) (net.IP, net.IP, []byte, error) {
+	if len(packet) < IPV4HEADERLEN {
+		return nil, nil, nil, fmt.Errorf("invalid ipv4 header")
+	}
+	ihl := int(packet[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(packet[2:]))
+	if ihl < IPV4HEADERLEN || total < ihl || total > len(packet) {
+		return nil, nil, nil, fmt.Errorf("invalid ipv4 header")
+	}
+	if packet[9] != 6 {
+		return nil, nil, nil, fmt.Errorf("not tcp packet")
+	}
+	//Fragments are not supported
+	if binary.BigEndian.Uint16(packet[6:])&0x3fff != 0 {
+		return nil, nil, nil, fmt.Errorf("fragmented packet")
+	}
+	return net.IP(packet[12:16]), net.IP(packet[16:20]), packet[ihl:total], nil
+}
+
+//Extension headers are not supported, the fake TCP packets never have them
+func parseIpv6(packet []byte) (net.IP, net.IP, []byte, error) {
+	if len(packet) < IPV6HEADERLEN {
+		return nil, nil, nil, fmt.Errorf("invalid ipv6 header")
+	}
+	total := IPV6HEADERLEN + int(binary.BigEndian.Uint16(packet[4:]))
+	if total > len(packet) {
+		return nil, nil, nil, fmt.Errorf("invalid ipv6 header")
+	}
+	if packet[6] != 6 {
+		return nil, nil, nil, fmt.Errorf("not tcp packet")
+	}
+	return net.IP(packet[8:24]), net.IP(packet[24:40]), packet[IPV6HEADERLEN:total], nil
+}
+
+func parseSegment(packet []byte) (*segment, error) {
+	srcIp, dstIp, tcp, err := parseIp(packet)
+	if err != nil {
+		return nil, err
+	}
+	if len(tcp) < TCPHEADERLEN {
+		return nil, fmt.Errorf("invalid tcp header")
+	}
+	tcpLen := int(tcp[12]>>4) * 4
+	if tcpLen < TCPHEADERLEN || tcpLen > len(tcp) {
+		return nil, fmt.Errorf("invalid tcp header")
+	}
+
+	return &segment{
+		src:     joinAddr(srcIp, binary.BigEndian.Uint16(tcp[0:])),
+		dst:     joinAddr(dstIp, binary.BigEndian.Uint16(tcp[2:])),
+		seq:     binary.BigEndian.Uint32(tcp[4:]),
+		ack:     binary.BigEndian.Uint32(tcp[8:]),
+		flags:   tcp[13],
+		window:  binary.BigEndian.Uint16(tcp[14:]),
+		options: tcp[TCPHEADERLEN:tcpLen],
+		data:    tcp[tcpLen:],
+	}, nil
+}
+
+//Call f for each option until it returns false
+func (sg *segment) rangeOptions(f func(kind byte, value []byte) bool) {
+	opts := sg.options
+	for len(opts) > 0 {
+		switch opts[0] {
+		case TCPOPTEND:
+			return
+		case TCPOPTNOP:
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || int(opts[1]) < 2 || int(opts[1]) > len(opts) {
+			return
+		}
+		if !f(opts[0], opts[2:opts[1]]) {
+			return
+		}
+		opts = opts[opts[1]:]
+	}
+}
+
+//Value of the first option of this kind
+func (sg *segment) option(kind byte) ([]byte, bool) {
+	var res []byte
+	found := false
+	sg.rangeOptions(func(k byte, value []byte) bool {
+		if k == kind {
+			res, found = value, true
+		}
+		return !found
+	})
+	return res, found
+}
+
+//Value of the ptcp experimental option of this subtype
+func (sg *segment) expOption(subtype byte) ([]byte, bool) {
+	var res []byte
+	found := false
+	sg.rangeOptions(func(k byte, value []byte) bool {
+		if k == TCPOPTEXP && len(value) >= 3 && binary.BigEndian.Uint16(value) == PTCPEXID && value[2] == subtype {
+			res, found = value[3:], true
+		}
+		return !found
+	})
+	return res, found
+}
+
+func appendOption(opts []byte, kind byte, value []byte) []byte {
+	opts = append(opts, kind, byte(len(value)+2))
+	return append(opts, value...)
+}
+
+func appendExpOption(opts []byte, subtype byte, value []byte) []byte {
+	v := make([]byte, 3, 3+len(value))
+	binary.BigEndian.PutUint16(v, PTCPEXID)
+	v[2] = subtype
+	return appendOption(opts, TCPOPTEXP, append(v, value...))
+}
+
+//Same for ipv4 and ipv6 since the tcp length always fits in 16 bits
+func pseudoHeaderSum(src []byte, dst []byte, length int) uint32 {
+	sum := uint32(0)
+	for i := 0; i+1 < len(src); i += 2 {
+		sum += uint32(src[i])<<8 | uint32(src[i+1])
+		sum += uint32(dst[i])<<8 | uint32(dst[i+1])
+	}
+	sum += 6
+	sum += uint32(length)
+	return sum
+}
+
+func checksum(b []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,217 @@
+package ptcp
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+//Number of skipped sequence numbers remembered to recognize late packets
+var SEQHISTORY = 1024
+
+//Counters of the received data packets of a conn
+type ConnStats struct {
+	//Packets delivered to Read
+	Received uint64
+	//Packets dropped because they were already received
+	Duplicates uint64
+	//Packets arrived after a packet with a larger sequence number
+	Reordered uint64
+	//Packets never arrived
+	Lost uint64
+	//Packets sent again in reliable mode
+	Retransmitted uint64
+	//Lost packets rebuilt by FEC
+	Recovered uint64
+	//Packets dropped by the decryption in encrypted mode
+	AuthFailed uint64
+	//Current pacing rate in bytes/s and min RTT in congestion mode
+	PacingRate uint64
+	MinRTT     time.Duration
+}
+
+//recvWindow orders the received data packets by their sequence number.
+//With size 0 it only drops duplicated and late packets,
+//otherwise up to size packets are held back waiting for the missing ones.
+type recvWindow struct {
+	mu      sync.Mutex
+	next    uint32
+	highest uint32
+	size    int
+	timeout time.Duration
+	//Never give up missing packets, the sender retransmits them
+	reliable bool
+	pending  map[uint32]*pendingPacket
+	skipped  map[uint32]bool
+	stats    ConnStats
+}
+
+type pendingPacket struct {
+	packet  string
+	arrival time.Time
+}
+
+func newRecvWindow(next uint32, size int, timeout time.Duration) *recvWindow {
+	return &recvWindow{
+		next:    next,
+		highest: next - 1,
+		size:    size,
+		timeout: timeout,
+		pending: map[uint32]*pendingPacket{},
+		skipped: map[uint32]bool{},
+	}
+}
+
+//a < b in sequence space
+func seqLess(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+//Returns the packets which can be delivered in order
+func (w *recvWindow) push(seq uint32, packet string) []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if seqLess(seq, w.highest) {
+		if w.skipped[seq] {
+			//Counted as lost when the gap was skipped, but it's only late
+			delete(w.skipped, seq)
+			w.stats.Lost--
+			w.stats.Reordered++
+			return nil
+		}
+		if _, ok := w.pending[seq]; !ok && !seqLess(seq, w.next) {
+			w.stats.Reordered++
+		}
+	} else {
+		w.highest = seq
+	}
+
+	if seqLess(seq, w.next) {
+		w.stats.Duplicates++
+		return nil
+	}
+
+	if _, ok := w.pending[seq]; ok {
+		w.stats.Duplicates++
+		return nil
+	}
+
+	res := []string{}
+	if seq == w.next {
+		res = append(res, packet)
+		w.stats.Received++
+		w.next++
+		return w.drain(res)
+	}
+
+	if w.reliable && seq-w.next >= uint32(w.size) {
+		//The sender doesn't respect the window
+		return nil
+	}
+
+	w.pending[seq] = &pendingPacket{
+		packet:  packet,
+		arrival: time.Now(),
+	}
+	if seq-w.next < uint32(w.size) {
+		return w.expire(res)
+	}
+
+	//Out of the window, give up the oldest missing packets
+	res = w.skipTo(seq-uint32(w.size)+1, res)
+	return w.drain(res)
+}
+
+//Deliver the pending packets which are in order
+func (w *recvWindow) drain(res []string) []string {
+	for {
+		p, ok := w.pending[w.next]
+		if !ok {
+			return res
+		}
+		delete(w.pending, w.next)
+		res = append(res, p.packet)
+		w.stats.Received++
+		w.next++
+	}
+}
+
+//Give up the missing packets before seq
+func (w *recvWindow) skipTo(seq uint32, res []string) []string {
+	if gap := seq - w.next; int(gap) > SEQHISTORY {
+		seqs := []uint32{}
+		for s := range w.pending {
+			if seqLess(s, seq) {
+				seqs = append(seqs, s)
+			}
+		}
+		sort.Slice(seqs, func(i, j int) bool { return seqLess(seqs[i], seqs[j]) })
+		for _, s := range seqs {
+			res = append(res, w.pending[s].packet)
+			delete(w.pending, s)
+		}
+		w.stats.Received += uint64(len(seqs))
+		w.stats.Lost += uint64(gap) - uint64(len(seqs))
+		w.next = seq
+		w.skipped = map[uint32]bool{}
+		return res
+	}
+
+	for ; seqLess(w.next, seq); w.next++ {
+		if p, ok := w.pending[w.next]; ok {
+			delete(w.pending, w.next)
+			res = append(res, p.packet)
+			w.stats.Received++
+
+		} else {
+			w.stats.Lost++
+			w.skipped[w.next] = true
+		}
+	}
+
+	for s := range w.skipped {
+		if w.next-s > uint32(SEQHISTORY) {
+			delete(w.skipped, s)
+		}
+	}
+	return res
+}
+
+//Give up the missing packets if the oldest pending one waited too long
+func (w *recvWindow) expire(res []string) []string {
+	if len(w.pending) == 0 || w.reliable {
+		return res
+	}
+
+	now := time.Now()
+	oldest, found := uint32(0), false
+	for seq, p := range w.pending {
+		if now.Sub(p.arrival) >= w.timeout && (!found || seqLess(seq, oldest)) {
+			oldest, found = seq, true
+		}
+	}
+	if !found {
+		return res
+	}
+	res = w.skipTo(oldest, res)
+	return w.drain(res)
+}
+
+func (w *recvWindow) flush() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.expire([]string{})
+}
+
+func (w *recvWindow) nextSeq() uint32 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.next
+}
+
+func (w *recvWindow) getStats() ConnStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.stats
+}
@@ -0,0 +1,159 @@
+package ptcp
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+//mangleLink passes the written packets through fn, which returns the packets to write instead
+type mangleLink struct {
+	Link
+	mu sync.Mutex
+	fn func(packet []byte) [][]byte
+}
+
+func (l *mangleLink) Write(b []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.fn == nil {
+		return l.Link.Write(b)
+	}
+	for _, packet := range l.fn(append([]byte{}, b...)) {
+		if err := l.Link.Write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *mangleLink) set(fn func(packet []byte) [][]byte) {
+	l.mu.Lock()
+	l.fn = fn
+	l.mu.Unlock()
+}
+
+//Stacks whose dialer side writes through a mangleLink
+func newMangleStacks(t testing.TB, ca ConnConfig, cb ConnConfig) (*Stack, *Stack, *mangleLink) {
+	a, b := NewPipe()
+	ma := &mangleLink{Link: a}
+	sa, sb := newStacks(t, ma, b, ca, cb)
+	return sa, sb, ma
+}
+
+//Read n messages from c
+func readN(t testing.TB, c *Conn, n int) []string {
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2000)
+	res := []string{}
+	for i := 0; i < n; i++ {
+		m, err := c.Read(buf)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		res = append(res, string(buf[:m]))
+	}
+	return res
+}
+
+func TestRecvWindow(t *testing.T) {
+	w := newRecvWindow(1, 0, time.Second)
+	out := []string{}
+	for _, s := range []uint32{1, 2, 2, 4, 3, 5} {
+		out = append(out, w.push(s, fmt.Sprint(s))...)
+	}
+	st := w.getStats()
+	if fmt.Sprint(out) != "[1 2 4 5]" || st.Duplicates != 1 || st.Lost != 0 || st.Reordered != 1 || st.Received != 4 {
+		t.Fatal(out, st)
+	}
+
+	w = newRecvWindow(1, 4, 50*time.Millisecond)
+	out = []string{}
+	for _, s := range []uint32{1, 3, 2, 5, 4, 4, 7, 12} {
+		out = append(out, w.push(s, fmt.Sprint(s))...)
+	}
+	st = w.getStats()
+	if fmt.Sprint(out) != "[1 2 3 4 5 7]" || st.Lost != 2 {
+		t.Fatal(out, st)
+	}
+	//12 waits for the missing ones until the timeout
+	time.Sleep(60 * time.Millisecond)
+	if out = w.flush(); fmt.Sprint(out) != "[12]" {
+		t.Fatal(out, w.getStats())
+	}
+}
+
+func TestRecvWindowWrap(t *testing.T) {
+	w := newRecvWindow(^uint32(0)-1, 4, time.Second)
+	out := []string{}
+	for _, s := range []uint32{^uint32(0), 0, ^uint32(0) - 1, 1} {
+		out = append(out, w.push(s, fmt.Sprint(s))...)
+	}
+	if fmt.Sprint(out) != fmt.Sprint([]uint32{^uint32(0) - 1, ^uint32(0), 0, 1}) {
+		t.Fatal(out, w.getStats())
+	}
+}
+
+func TestSequencingReorder(t *testing.T) {
+	cfg := ConnConfig{Sequencing: true, ReorderWindow: 8}
+	sa, sb, ma := newMangleStacks(t, cfg, cfg)
+	c, s := connectPair(t, sa, sb, 7010)
+
+	//Swap every two packets
+	var held []byte
+	ma.set(func(packet []byte) [][]byte {
+		if held == nil {
+			held = packet
+			return nil
+		}
+		res := [][]byte{packet, held}
+		held = nil
+		return res
+	})
+	const N = 10
+	for i := 0; i < N; i++ {
+		if _, err := c.Write([]byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{}
+	for i := 0; i < N; i++ {
+		want = append(want, fmt.Sprint(i))
+	}
+	if got := readN(t, s, N); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatal(got)
+	}
+	if st := s.Stats(); st.Received != N || st.Reordered != N/2 || st.Lost != 0 {
+		t.Fatal(st)
+	}
+}
+
+func TestSequencingLossAndDuplicates(t *testing.T) {
+	cfg := ConnConfig{Sequencing: true}
+	sa, sb, ma := newMangleStacks(t, cfg, cfg)
+	c, s := connectPair(t, sa, sb, 7011)
+
+	//Drop the second packet, send the others twice
+	n := 0
+	ma.set(func(packet []byte) [][]byte {
+		n++
+		if n == 2 {
+			return nil
+		}
+		return [][]byte{packet, packet}
+	})
+	for i := 0; i < 4; i++ {
+		if _, err := c.Write([]byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := readN(t, s, 3); fmt.Sprint(got) != "[0 2 3]" {
+		t.Fatal(got)
+	}
+	//The duplicates are dropped once they're seen
+	waitFor(t, time.Second, func() bool { return s.Stats().Duplicates == 3 })
+	if st := s.Stats(); st.Received != 3 || st.Lost != 1 {
+		t.Fatal(st)
+	}
+}
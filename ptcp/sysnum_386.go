@@ -0,0 +1,5 @@
+package ptcp
+
+//Missing in the syscall package of 386, which goes through socketcall
+const SYS_SENDMMSG = 345
+const SYS_SETSOCKOPT = 366
@@ -0,0 +1,8 @@
+package ptcp
+
+import "syscall"
+
+//Missing in the syscall package of amd64
+const SYS_SENDMMSG = 307
+
+const SYS_SETSOCKOPT = syscall.SYS_SETSOCKOPT
@@ -0,0 +1,9 @@
+//go:build !amd64 && !386
+// +build !amd64,!386
+
+package ptcp
+
+import "syscall"
+
+const SYS_SENDMMSG = syscall.SYS_SENDMMSG
+const SYS_SETSOCKOPT = syscall.SYS_SETSOCKOPT
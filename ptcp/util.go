@@ -9,5 +9,40 @@ func GetLocalAddr(remoteAddr string) (net.Addr, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer conn.Close()
 	return conn.LocalAddr(), nil
-}
\ No newline at end of file
+}
+
+//NoBlock, drop the data if the channel is full or already closed
+func trySend(ch chan string, s string) {
+	defer func() {
+		recover()
+	}()
+
+	select {
+	case ch <- s:
+	default:
+	}
+}
+
+func buildPacket(src string, dst string, seq uint32, ack uint32, flags uint8, data []byte) []byte {
+	return buildPacketWithOptions(src, dst, seq, ack, flags, nil, data)
+}
+
+//The addresses are checked when conns and listeners are created, so it never fails in practice
+func buildPacketWithOptions(src string, dst string, seq uint32, ack uint32, flags uint8, options []byte, data []byte) []byte {
+	sg := &segment{
+		src:     src,
+		dst:     dst,
+		seq:     seq,
+		ack:     ack,
+		flags:   flags,
+		options: options,
+		data:    data,
+	}
+	packet, err := sg.marshal()
+	if err != nil {
+		return []byte{}
+	}
+	return packet
+}
@@ -0,0 +1,167 @@
+package tun
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/xitongsys/ptcp/ptcp"
+)
+
+type ClientConfig struct {
+	//Address of the server
+	Server string
+	//Name of the tun device, chosen by the kernel if empty
+	Device string
+	//Options of the conn, those of the stack if nil. The Stream mode is turned off
+	Conn *ptcp.ConnConfig
+}
+
+//Client gets its address from the server and forwards the packets of its tun device over its conn
+type Client struct {
+	conn *ptcp.Conn
+	dev  *Device
+	addr *net.IPNet
+}
+
+//Dial the server, wait for the address and open the device with it
+func NewClient(stack *ptcp.Stack, cfg *ClientConfig) (*Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(CONFIGTIMEOUT))
+	defer cancel()
+	var c net.Conn
+	var err error
+	if cfg.Conn != nil {
+		c, err = stack.DialWithConfig(ctx, "ptcp", cfg.Server, cfg.Conn)
+	} else {
+		c, err = stack.DialContext(ctx, "ptcp", cfg.Server)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn, err := toMessageConn(c)
+	if err != nil {
+		return nil, err
+	}
+
+	addr, mtu, err := readConfig(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if m := tunnelMTU(conn); m < mtu {
+		mtu = m
+	}
+
+	client := &Client{conn: conn, addr: addr}
+	if client.dev, err = Open(cfg.Device); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err = client.dev.SetMTU(mtu); err == nil {
+		if err = client.dev.SetAddr(addr); err == nil {
+			err = client.dev.Up()
+		}
+	}
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+//The MSGCONFIG of the server, acknowledged. The data packets before it are dropped
+func readConfig(conn *ptcp.Conn) (*net.IPNet, int, error) {
+	conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(CONFIGTIMEOUT)))
+	defer conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, READBUFSIZE)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, 0, err
+		}
+		if n < HEADERLEN || buf[0] != MSGCONFIG {
+			continue
+		}
+		msg := buf[HEADERLEN:n]
+		if len(msg) != 3+net.IPv4len && len(msg) != 3+net.IPv6len {
+			return nil, 0, fmt.Errorf("invalid config message")
+		}
+		ip := net.IP(append([]byte{}, msg[3:]...))
+		bits := 8 * len(ip)
+		if int(msg[2]) > bits {
+			return nil, 0, fmt.Errorf("invalid prefix length %v", msg[2])
+		}
+		if _, err := conn.Write([]byte{MSGCONFIGACK}); err != nil {
+			return nil, 0, err
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(int(msg[2]), bits)}, int(binary.BigEndian.Uint16(msg)), nil
+	}
+}
+
+//Address of the client in the tunnel network
+func (c *Client) Addr() *net.IPNet {
+	return c.addr
+}
+
+func (c *Client) Device() *Device {
+	return c.dev
+}
+
+//Forward the packets in both directions until the conn or the device fails, then close the client
+func (c *Client) Run() error {
+	defer c.Close()
+	errs := make(chan error, 2)
+	go func() {
+		errs <- devToConn(c.dev, c.conn)
+	}()
+	go func() {
+		buf := make([]byte, READBUFSIZE)
+		for {
+			n, err := c.conn.Read(buf)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if n > HEADERLEN && buf[0] == MSGPACKET {
+				c.dev.Write(buf[HEADERLEN:n])
+			}
+			//The server didn't get the ack
+			if n >= HEADERLEN && buf[0] == MSGCONFIG {
+				c.conn.Write([]byte{MSGCONFIGACK})
+			}
+		}
+	}()
+	err := <-errs
+	if err == io.EOF {
+		err = nil
+	}
+	return err
+}
+
+func (c *Client) Close() error {
+	c.dev.Close()
+	return c.conn.Close()
+}
+
+//Forward the packets read from dev to conn, until one of them fails. The packets larger than the conn's
+//MaxPayload, after its path MTU dropped, are lost.
+func devToConn(dev *Device, conn *ptcp.Conn) error {
+	buf := make([]byte, READBUFSIZE)
+	buf[0] = MSGPACKET
+	for {
+		n, err := dev.Read(buf[HEADERLEN:])
+		if err != nil {
+			return err
+		}
+		if _, err := conn.Write(buf[:HEADERLEN+n]); err != nil {
+			if _, ok := err.(*ptcp.PayloadSizeError); ok {
+				continue
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package tun
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+//Path of the TUN clone device
+var TUNPATH = "/dev/net/tun"
+
+//struct ifreq with the short or int member of its union
+type ifreq struct {
+	name  [syscall.IFNAMSIZ]byte
+	flags uint16
+	_     [22]byte
+}
+
+type ifreqMTU struct {
+	name [syscall.IFNAMSIZ]byte
+	mtu  int32
+	_    [20]byte
+}
+
+type ifreqAddr struct {
+	name [syscall.IFNAMSIZ]byte
+	addr syscall.RawSockaddrInet4
+	_    [8]byte
+}
+
+//struct in6_ifreq
+type in6Ifreq struct {
+	addr      [16]byte
+	prefixLen uint32
+	ifIndex   int32
+}
+
+//Device is a Linux TUN interface. Read and Write carry one IP packet each, without the packet information header.
+type Device struct {
+	file *os.File
+	name string
+}
+
+//Create a TUN interface, named by the kernel (tunN) if name is empty
+func Open(name string) (*Device, error) {
+	if len(name) >= syscall.IFNAMSIZ {
+		return nil, fmt.Errorf("interface name too long: %v", name)
+	}
+	fd, err := syscall.Open(TUNPATH, syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	req := ifreq{flags: syscall.IFF_TUN | syscall.IFF_NO_PI}
+	copy(req.name[:], name)
+	if err = ioctl(fd, syscall.TUNSETIFF, unsafe.Pointer(&req)); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	//Non-blocking, so the reads go through the runtime poller and Close interrupts them
+	if err = syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	return &Device{
+		file: os.NewFile(uintptr(fd), TUNPATH),
+		name: cString(req.name[:]),
+	}, nil
+}
+
+func (d *Device) Name() string {
+	return d.name
+}
+
+func (d *Device) Read(b []byte) (int, error) {
+	return d.file.Read(b)
+}
+
+func (d *Device) Write(b []byte) (int, error) {
+	return d.file.Write(b)
+}
+
+//The interface is deleted with its last file descriptor
+func (d *Device) Close() error {
+	return d.file.Close()
+}
+
+func (d *Device) SetMTU(mtu int) error {
+	req := ifreqMTU{mtu: int32(mtu)}
+	copy(req.name[:], d.name)
+	return ifIoctl(syscall.AF_INET, syscall.SIOCSIFMTU, unsafe.Pointer(&req))
+}
+
+//Assign an ipv4 or ipv6 address to the interface, the route of its network goes through it
+func (d *Device) SetAddr(addr *net.IPNet) error {
+	ones, _ := addr.Mask.Size()
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		req := ifreqAddr{addr: syscall.RawSockaddrInet4{Family: syscall.AF_INET}}
+		copy(req.name[:], d.name)
+		copy(req.addr.Addr[:], ip4)
+		if err := ifIoctl(syscall.AF_INET, syscall.SIOCSIFADDR, unsafe.Pointer(&req)); err != nil {
+			return err
+		}
+		copy(req.addr.Addr[:], net.IP(net.CIDRMask(ones, 32)).To4())
+		return ifIoctl(syscall.AF_INET, syscall.SIOCSIFNETMASK, unsafe.Pointer(&req))
+	}
+
+	iface, err := net.InterfaceByName(d.name)
+	if err != nil {
+		return err
+	}
+	req := in6Ifreq{prefixLen: uint32(ones), ifIndex: int32(iface.Index)}
+	copy(req.addr[:], addr.IP.To16())
+	return ifIoctl(syscall.AF_INET6, syscall.SIOCSIFADDR, unsafe.Pointer(&req))
+}
+
+//Bring the interface up
+func (d *Device) Up() error {
+	req := ifreq{}
+	copy(req.name[:], d.name)
+	if err := ifIoctl(syscall.AF_INET, syscall.SIOCGIFFLAGS, unsafe.Pointer(&req)); err != nil {
+		return err
+	}
+	req.flags |= syscall.IFF_UP | syscall.IFF_RUNNING
+	return ifIoctl(syscall.AF_INET, syscall.SIOCSIFFLAGS, unsafe.Pointer(&req))
+}
+
+//ioctl on a datagram socket of family, as the interface configuration ones need
+func ifIoctl(family int, req uintptr, arg unsafe.Pointer) error {
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	return ioctl(fd, req, arg)
+}
+
+func ioctl(fd int, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func cString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
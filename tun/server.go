@@ -0,0 +1,241 @@
+package tun
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/xitongsys/ptcp/ptcp"
+)
+
+type ServerConfig struct {
+	//Address of the ptcp listener
+	Addr string
+	//Network of the tunnel in CIDR notation. The server has its first address, the clients get the next ones
+	Network string
+	//Name of the tun device, chosen by the kernel if empty
+	Device string
+	//Options of the conns, those of the stack if nil. The Stream mode is turned off
+	Conn *ptcp.ConnConfig
+}
+
+//Server assigns an address of the tunnel network to each client and routes the packets of its tun device
+//to the client of their destination. The packets of the clients are written to the device, the kernel routes them.
+type Server struct {
+	cfg     ServerConfig
+	ln      net.Listener
+	dev     *Device
+	network *net.IPNet
+	//Addresses of the clients, the offset in network is the index of the address
+	size int
+
+	mu sync.Mutex
+	//Key: client address
+	clients map[string]*ptcp.Conn
+	//Lowered to the MaxPayload of the clients
+	mtu int
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewServer(stack *ptcp.Stack, cfg *ServerConfig) (*Server, error) {
+	ip, network, err := net.ParseCIDR(cfg.Network)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := network.Mask.Size()
+	//Without the network and the ipv4 broadcast address
+	size := 1<<16 - 1
+	if bits-ones < 16 {
+		size = 1<<uint(bits-ones) - 1
+	}
+	if ip.To4() != nil {
+		size--
+	}
+	if size < 2 {
+		return nil, fmt.Errorf("network %v too small", cfg.Network)
+	}
+
+	s := &Server{
+		cfg:     *cfg,
+		network: network,
+		size:    size,
+		clients: map[string]*ptcp.Conn{},
+		done:    make(chan struct{}),
+	}
+	if s.dev, err = Open(cfg.Device); err != nil {
+		return nil, err
+	}
+	if err = s.dev.SetAddr(&net.IPNet{IP: nthAddr(network, 1), Mask: network.Mask}); err != nil {
+		s.dev.Close()
+		return nil, err
+	}
+	if err = s.dev.Up(); err != nil {
+		s.dev.Close()
+		return nil, err
+	}
+
+	if cfg.Conn != nil {
+		s.ln, err = stack.ListenWithConfig("ptcp", cfg.Addr, cfg.Conn)
+	} else {
+		s.ln, err = stack.Listen("ptcp", cfg.Addr)
+	}
+	if err != nil {
+		s.dev.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Server) Device() *Device {
+	return s.dev
+}
+
+//Accept and serve the clients until the server is closed
+func (s *Server) Serve() error {
+	go s.route()
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+				return nil
+			default:
+			}
+			return err
+		}
+		conn, err := toMessageConn(c)
+		if err != nil {
+			continue
+		}
+		go s.serveClient(conn)
+	}
+}
+
+func (s *Server) serveClient(conn *ptcp.Conn) {
+	defer conn.Close()
+	addr, err := s.register(conn)
+	if err != nil {
+		return
+	}
+	defer s.unregister(addr)
+
+	mtu := tunnelMTU(conn)
+	s.lowerMTU(mtu)
+	ones, _ := s.network.Mask.Size()
+	msg := make([]byte, HEADERLEN+3, HEADERLEN+3+net.IPv6len)
+	msg[0] = MSGCONFIG
+	binary.BigEndian.PutUint16(msg[1:], uint16(mtu))
+	msg[3] = byte(ones)
+	if ip4 := addr.To4(); ip4 != nil {
+		msg = append(msg, ip4...)
+	} else {
+		msg = append(msg, addr...)
+	}
+
+	//The config is sent again until the first message of the client, its ack or a packet
+	configured := false
+	deadline := time.Now().Add(time.Second * time.Duration(CONFIGTIMEOUT))
+	buf := make([]byte, READBUFSIZE)
+	for {
+		if !configured {
+			if time.Now().After(deadline) {
+				return
+			}
+			if _, err := conn.Write(msg); err != nil {
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(time.Millisecond * time.Duration(CONFIGRESEND)))
+		}
+		n, err := conn.Read(buf)
+		if err != nil {
+			if !configured && isTimeout(err) {
+				continue
+			}
+			return
+		}
+		if !configured {
+			configured = true
+			conn.SetReadDeadline(time.Time{})
+		}
+		//A client only sends from its own address
+		if n > HEADERLEN && buf[0] == MSGPACKET {
+			if src, err := packetSrc(buf[HEADERLEN:n]); err == nil && src.Equal(addr) {
+				s.dev.Write(buf[HEADERLEN:n])
+			}
+		}
+	}
+}
+
+//Give the first free address of the network to conn
+func (s *Server) register(conn *ptcp.Conn) (net.IP, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 2; i <= s.size; i++ {
+		ip := nthAddr(s.network, i)
+		if _, ok := s.clients[ip.String()]; !ok {
+			s.clients[ip.String()] = conn
+			return ip, nil
+		}
+	}
+	return nil, fmt.Errorf("no free address in %v", s.network)
+}
+
+func (s *Server) unregister(ip net.IP) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.clients, ip.String())
+}
+
+//The device MTU fits the conn with the lowest max payload
+func (s *Server) lowerMTU(mtu int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mtu == 0 || mtu < s.mtu {
+		if s.dev.SetMTU(mtu) == nil {
+			s.mtu = mtu
+		}
+	}
+}
+
+//Send the packets of the device to the client of their destination
+func (s *Server) route() {
+	defer s.Close()
+	buf := make([]byte, READBUFSIZE)
+	buf[0] = MSGPACKET
+	for {
+		n, err := s.dev.Read(buf[HEADERLEN:])
+		if err != nil {
+			return
+		}
+		dst, err := packetDst(buf[HEADERLEN : HEADERLEN+n])
+		if err != nil {
+			continue
+		}
+		s.mu.Lock()
+		conn := s.clients[dst.String()]
+		s.mu.Unlock()
+		if conn != nil {
+			conn.Write(buf[:HEADERLEN+n])
+		}
+	}
+}
+
+//Close the listener, the clients and the device
+func (s *Server) Close() error {
+	err := fmt.Errorf("server already closed")
+	s.closeOnce.Do(func() {
+		close(s.done)
+		err = s.ln.Close()
+		s.mu.Lock()
+		for _, conn := range s.clients {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		s.dev.Close()
+	})
+	return err
+}
@@ -0,0 +1,84 @@
+package tun
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/xitongsys/ptcp/ptcp"
+)
+
+//Seconds a client waits for its address after the handshake, and the server for the answer of the client
+var CONFIGTIMEOUT = 10
+
+//Interval in ms of the MSGCONFIG resends, until the client answers
+var CONFIGRESEND = 500
+
+//Size of the read buffers, larger than any IP packet
+var READBUFSIZE = 65535
+
+//Type of the messages, the first byte of each conn payload
+const (
+	//Server -> client: MTU (2) + prefix length (1) + address of the client (4 or 16)
+	MSGCONFIG = 1
+	//An IP packet
+	MSGPACKET = 2
+	//Client -> server: no payload, answers each MSGCONFIG
+	MSGCONFIGACK = 3
+)
+
+//Header of the messages
+const HEADERLEN = 1
+
+//Max IP packet carried by a conn. The tun MTU is set to it, so the kernel never hands a packet the conn refuses.
+func tunnelMTU(conn *ptcp.Conn) int {
+	return conn.MaxPayload() - HEADERLEN
+}
+
+//Destination ip of an IP packet
+func packetDst(packet []byte) (net.IP, error) {
+	if len(packet) >= 20 && packet[0]>>4 == 4 {
+		return net.IP(packet[16:20]), nil
+	}
+	if len(packet) >= 40 && packet[0]>>4 == 6 {
+		return net.IP(packet[24:40]), nil
+	}
+	return nil, fmt.Errorf("invalid ip packet")
+}
+
+//Source ip of an IP packet
+func packetSrc(packet []byte) (net.IP, error) {
+	if len(packet) >= 20 && packet[0]>>4 == 4 {
+		return net.IP(packet[12:16]), nil
+	}
+	if len(packet) >= 40 && packet[0]>>4 == 6 {
+		return net.IP(packet[8:24]), nil
+	}
+	return nil, fmt.Errorf("invalid ip packet")
+}
+
+func isTimeout(err error) bool {
+	e, ok := err.(net.Error)
+	return ok && e.Timeout()
+}
+
+//The conns keep the message boundaries, one message per packet
+func toMessageConn(c net.Conn) (*ptcp.Conn, error) {
+	conn, ok := c.(*ptcp.Conn)
+	if !ok {
+		c.Close()
+		return nil, fmt.Errorf("not a ptcp conn")
+	}
+	conn.SetStream(false)
+	return conn, nil
+}
+
+//n-th address of network
+func nthAddr(network *net.IPNet, n int) net.IP {
+	ip := append(net.IP{}, network.IP...)
+	for i := len(ip) - 1; i >= 0 && n > 0; i-- {
+		sum := int(ip[i]) + n&0xff
+		ip[i] = byte(sum)
+		n = n>>8 + sum>>8
+	}
+	return ip
+}